@@ -25,6 +25,9 @@ func NewHandler(handle func(w http.ResponseWriter, r *http.Request) error, eemiD
 	return Handler{handle: handle, eemiData: eemiData}
 }
 
+// unhandledMessageID selects the eemi data used for errors without a known eemi code
+const unhandledMessageID = "UNHANDLED"
+
 // Wrap http handler that allows handler functions to return an error
 // This centralises the logic for creating error responses
 // Loads eemi info based on the supplied map. Localises message and responseaction values
@@ -32,26 +35,48 @@ func (fn Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := fn.handle(w, r); err != nil {
 		eemiError, ok := err.(Error)
 		if !ok {
-			eemiError = New(err, "UNHANDLED") // If no eemi code was detected, return with a predefined `unhandled` generic error message
+			eemiError = New(err, unhandledMessageID) // If no eemi code was detected, return with a predefined `unhandled` generic error message
 		}
 		logger.Error(eemiError)
 
 		// get data for eemi error based on messageId in eemi error
 		eemiData := fn.eemiData[eemiError.MessageID]
 
-		// translate textual parts of response
-		message := translateMessageByID(r.Context(), eemiData.Message, eemiError.TemplateData)
-		responseAction := translateMessageByID(r.Context(), eemiData.ResponseAction, eemiError.TemplateData)
+		writeEemiResponse(w, r, eemiData, eemiData.Status, eemiError.TemplateData)
+	}
+}
 
-		eemiResponse := NewEemiResponse(eemiData.MessageID, message, responseAction, eemiData.Category, eemiData.SeverityLevel)
-		utils.WriteResponse(w, eemiData.Status, eemiResponse, utils.JSONContentType)
+// NewErrorResponder returns a middleware.ErrorResponder writing localized eemi responses, so requests rejected
+// by a middleware get the same response format as handler errors. The status decided by the middleware is kept,
+// the unhandled eemi data is used for message ids missing from the supplied map.
+func NewErrorResponder(eemiData map[string]Config) middleware.ErrorResponder {
+	return func(w http.ResponseWriter, r *http.Request, status int, messageID string, templateData map[string]string) {
+		config, ok := eemiData[messageID]
+		if !ok {
+			config = eemiData[unhandledMessageID]
+		}
+		writeEemiResponse(w, r, config, status, templateData)
 	}
 }
 
+// writeEemiResponse translates the textual parts of the eemi data and writes the response
+func writeEemiResponse(w http.ResponseWriter, r *http.Request, eemiData Config, status int, templateData map[string]string) {
+	// translate textual parts of response
+	message := translateMessageByID(r.Context(), eemiData.Message, templateData)
+	responseAction := translateMessageByID(r.Context(), eemiData.ResponseAction, templateData)
+
+	eemiResponse := NewEemiResponse(eemiData.MessageID, message, responseAction, eemiData.Category, eemiData.SeverityLevel)
+	eemiResponse.RequestID = middleware.GetRequestID(r)
+	utils.WriteResponse(w, status, eemiResponse, utils.JSONContentType)
+}
+
 // translateMessageByID utility function to translate message based on current locale information
 func translateMessageByID(ctx context.Context, messageID string, messageArgs map[string]string) string {
-	// retrieve localizer instance from context
-	localizer := ctx.Value(middleware.ContextLocalizerKey).(*i18n.Localizer)
+	// retrieve localizer instance from context, the message id is returned when no locale was selected
+	localizer, ok := ctx.Value(middleware.ContextLocalizerKey).(*i18n.Localizer)
+	if !ok {
+		return messageID
+	}
 
 	// construct message
 	message := localizer.MustLocalize(&i18n.LocalizeConfig{
@@ -112,3 +112,61 @@ func getErrorFromBody(r *http.Response) (eemi Config, err error) {
 	}
 	return
 }
+
+// Test that the request id assigned by the request id middleware is returned in the eemi response
+func Test_EEMIHandler_Returns_Request_Id(t *testing.T) {
+	currentFolder, _ := os.Getwd()
+	SetLogger(log.NewLogger("", ""))
+	eemiData, _ := LoadEemiFromFile(currentFolder+"/testData/eemi_test_data.json", utils.FileSystem{})
+
+	handler := NewHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return New(nil, "NGCI0001")
+	}, eemiData)
+
+	request, _ := http.NewRequest("GET", "/winterfell", nil)
+	request.Header.Set(middleware.RequestIDHeader, "request-123")
+	respRecorder := httptest.NewRecorder()
+
+	appRouter := mux.NewRouter().StrictSlash(true)
+	appRouter.Use(middleware.RequestIDMiddleware(log.NewLogger("", "")))
+	appRouter.Handle("/winterfell", handler)
+	wrapAppRouter(appRouter).ServeHTTP(respRecorder, request)
+
+	var eemi Response
+	json.Unmarshal(respRecorder.Body.Bytes(), &eemi)
+	assert.Equal(t, 404, respRecorder.Code)
+	assert.Equal(t, "request-123", eemi.RequestID, "Request id should be returned in the eemi response")
+	assert.Equal(t, "request-123", respRecorder.Header().Get(middleware.RequestIDHeader))
+}
+
+// Test that the error responder used by the middlewares writes a localized eemi response with the middleware status
+func Test_ErrorResponder_Writes_EEMI_Response_With_Middleware_Status(t *testing.T) {
+	currentFolder, _ := os.Getwd()
+	eemiData, _ := LoadEemiFromFile(currentFolder+"/testData/eemi_test_data.json", utils.FileSystem{})
+	responder := NewErrorResponder(eemiData)
+
+	appRouter := mux.NewRouter().StrictSlash(true)
+	appRouter.HandleFunc("/winterfell", func(w http.ResponseWriter, r *http.Request) {
+		responder(w, r, http.StatusTooManyRequests, "NGCI0002", map[string]string{"Name": "Stark", "Season": "Winter"})
+	})
+	appRouter.HandleFunc("/unknown", func(w http.ResponseWriter, r *http.Request) {
+		responder(w, r, http.StatusUnauthorized, "MISSING", nil)
+	})
+
+	respRecorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "/winterfell", nil)
+	wrapAppRouter(appRouter).ServeHTTP(respRecorder, request)
+
+	eemi, _ := getErrorFromBody(respRecorder.Result())
+	assert.Equal(t, http.StatusTooManyRequests, respRecorder.Code, "Status from the middleware should be returned")
+	assert.Equal(t, "NGCI0002", eemi.MessageID)
+	assert.Equal(t, "example of a template error message: Stark", eemi.Message)
+
+	respRecorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "/unknown", nil)
+	wrapAppRouter(appRouter).ServeHTTP(respRecorder, request)
+
+	eemi, _ = getErrorFromBody(respRecorder.Result())
+	assert.Equal(t, http.StatusUnauthorized, respRecorder.Code)
+	assert.Equal(t, "An internal error has occurred", eemi.Message, "Unhandled message should be used for unknown ids")
+}
@@ -6,6 +6,7 @@ type Response struct {
 	ResponseAction string `json:"responseAction"`
 	Category       string `json:"category"`
 	SeverityLevel  string `json:"severity"`
+	RequestID      string `json:"requestId,omitempty"`
 }
 
 // CreateEEMIError create a new instance of Error
@@ -0,0 +1,58 @@
+package log
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const maximumCallerDepth = 32
+
+var (
+	logrusPackage = reflect.TypeOf(logrus.Entry{}).PkgPath()
+	loggerPackage = reflect.TypeOf(CustomLogger{}).PkgPath()
+)
+
+// callerHook replaces the caller resolved by logrus, which stops at the CustomLogger wrapper,
+// with the first frame outside of the logging code plus the configured number of skipped frames
+type callerHook struct {
+	skip int
+}
+
+func (h *callerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *callerHook) Fire(e *logrus.Entry) error {
+	if caller := resolveCaller(h.skip); caller != nil {
+		e.Caller = caller
+	}
+	return nil
+}
+
+// resolveCaller walks the stack past logrus and the logger wrappers and returns the calling frame
+func resolveCaller(skip int) *runtime.Frame {
+	pcs := make([]uintptr, maximumCallerDepth)
+	depth := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:depth])
+
+	for f, again := frames.Next(); again; f, again = frames.Next() {
+		if isLoggingFrame(f.Function) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		return &f
+	}
+	return nil
+}
+
+func isLoggingFrame(function string) bool {
+	return strings.HasPrefix(function, logrusPackage+".") ||
+		strings.HasPrefix(function, loggerPackage+".(*CustomLogger).") ||
+		strings.HasPrefix(function, loggerPackage+".(*callerHook).")
+}
@@ -0,0 +1,73 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCallerLogger(buffer *bytes.Buffer, skip int) LoggerType {
+	templog := logrus.Logger{
+		Out:          buffer,
+		Formatter:    CustomFormatter{Formatter: &logrus.JSONFormatter{}},
+		Hooks:        make(logrus.LevelHooks),
+		Level:        logrus.DebugLevel,
+		ReportCaller: true,
+	}
+	templog.AddHook(&callerHook{skip: skip})
+	return &CustomLogger{Entry: templog.WithField("app", "app")}
+}
+
+func logThroughHelper(logger LoggerType) {
+	logger.Info("from helper")
+}
+
+func decodeEntry(t *testing.T, buffer *bytes.Buffer) map[string]interface{} {
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(buffer.Bytes(), &entry); err != nil {
+		t.Fatalf("Expecting a JSON log entry, got %s", buffer.String())
+	}
+	return entry
+}
+
+func TestCallerReportsCallingFunctionNotWrapper(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := newCallerLogger(buffer, 0)
+
+	logger.WithCustomFields(map[string]interface{}{"component": "test"}).Infof("hello %s", "world")
+
+	entry := decodeEntry(t, buffer)
+	assert.True(t, strings.HasSuffix(entry["func"].(string), "TestCallerReportsCallingFunctionNotWrapper"))
+	assert.Contains(t, entry["file"], "caller_hook_test.go:")
+}
+
+func TestCallerSkipPointsAboveHelper(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger := newCallerLogger(buffer, 1)
+
+	logThroughHelper(logger)
+
+	entry := decodeEntry(t, buffer)
+	assert.True(t, strings.HasSuffix(entry["func"].(string), "TestCallerSkipPointsAboveHelper"))
+}
+
+func TestCallerNotReportedByDefault(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	templog := logrus.Logger{
+		Out:       buffer,
+		Formatter: CustomFormatter{Formatter: &logrus.JSONFormatter{}},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	logger := &CustomLogger{Entry: templog.WithField("app", "app")}
+
+	logger.Info("no caller")
+
+	entry := decodeEntry(t, buffer)
+	assert.NotContains(t, entry, "func")
+	assert.NotContains(t, entry, "file")
+}
@@ -0,0 +1,42 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+var exitHooks struct {
+	sync.Mutex
+	hooks []func()
+}
+
+// RegisterExitHook registers a function to run before Fatal* exits or while Panic* unwinds,
+// e.g. to flush buffered sinks, close clients or write the last trace spans.
+// Hooks run in the order they were registered.
+func RegisterExitHook(hook func()) {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+	exitHooks.hooks = append(exitHooks.hooks, hook)
+}
+
+func runExitHooks() {
+	exitHooks.Lock()
+	hooks := make([]func(), len(exitHooks.hooks))
+	copy(hooks, exitHooks.hooks)
+	exitHooks.Unlock()
+
+	for _, hook := range hooks {
+		runExitHook(hook)
+	}
+}
+
+// runExitHook runs a single hook, making sure a failing hook does not stop the remaining ones
+func runExitHook(hook func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "Exit hook failed: %v\n", r)
+		}
+	}()
+	hook()
+}
@@ -0,0 +1,75 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newExitTestLogger(buffer *bytes.Buffer, exitCode *int) *CustomLogger {
+	templog := &logrus.Logger{
+		Out:       buffer,
+		Formatter: CustomFormatter{Formatter: &logrus.JSONFormatter{}},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+		ExitFunc:  func(code int) { *exitCode = code },
+	}
+	return &CustomLogger{Entry: templog.WithField("app", "app")}
+}
+
+func resetExitHooks() {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+	exitHooks.hooks = nil
+}
+
+func TestFatalRunsExitHooksAfterWritingEntry(t *testing.T) {
+	defer resetExitHooks()
+	buffer := &bytes.Buffer{}
+	exitCode := 0
+	logger := newExitTestLogger(buffer, &exitCode)
+
+	var calls []string
+	RegisterExitHook(func() {
+		assert.Contains(t, buffer.String(), "fatal message", "Entry should be written before hooks run")
+		calls = append(calls, "first")
+	})
+	RegisterExitHook(func() { calls = append(calls, "second") })
+
+	logger.Fatalf("fatal %s", "message")
+
+	assert.Equal(t, []string{"first", "second"}, calls)
+	assert.Equal(t, 1, exitCode)
+}
+
+func TestPanicRunsExitHooks(t *testing.T) {
+	defer resetExitHooks()
+	buffer := &bytes.Buffer{}
+	exitCode := 0
+	logger := newExitTestLogger(buffer, &exitCode)
+
+	called := false
+	RegisterExitHook(func() { called = true })
+
+	assert.Panics(t, func() { logger.Panic("panic message") })
+	assert.True(t, called)
+	assert.Contains(t, buffer.String(), "panic message")
+}
+
+func TestFailingExitHookDoesNotStopOthers(t *testing.T) {
+	defer resetExitHooks()
+	buffer := &bytes.Buffer{}
+	exitCode := 0
+	logger := newExitTestLogger(buffer, &exitCode)
+
+	called := false
+	RegisterExitHook(func() { panic("broken hook") })
+	RegisterExitHook(func() { called = true })
+
+	logger.Fatalln("fatal")
+
+	assert.True(t, called)
+	assert.Equal(t, 1, exitCode)
+}
@@ -68,15 +68,72 @@ func (dl *CustomLogger) WithCustomFields(fields map[string]interface{}) LoggerTy
 	return &CustomLogger{dl.WithFields(fields)}
 }
 
+// Fatal logs the message, runs the registered exit hooks and then exits
+func (dl *CustomLogger) Fatal(args ...interface{}) {
+	dl.Log(logrus.FatalLevel, args...)
+	runExitHooks()
+	dl.Logger.Exit(1)
+}
+
+// Fatalf logs the formatted message, runs the registered exit hooks and then exits
+func (dl *CustomLogger) Fatalf(format string, args ...interface{}) {
+	dl.Logf(logrus.FatalLevel, format, args...)
+	runExitHooks()
+	dl.Logger.Exit(1)
+}
+
+// Fatalln logs the message, runs the registered exit hooks and then exits
+func (dl *CustomLogger) Fatalln(args ...interface{}) {
+	dl.Logln(logrus.FatalLevel, args...)
+	runExitHooks()
+	dl.Logger.Exit(1)
+}
+
+// Panic logs the message and runs the registered exit hooks while the panic unwinds
+func (dl *CustomLogger) Panic(args ...interface{}) {
+	defer runExitHooks()
+	dl.Entry.Panic(args...)
+}
+
+// Panicf logs the formatted message and runs the registered exit hooks while the panic unwinds
+func (dl *CustomLogger) Panicf(format string, args ...interface{}) {
+	defer runExitHooks()
+	dl.Entry.Panicf(format, args...)
+}
+
+// Panicln logs the message and runs the registered exit hooks while the panic unwinds
+func (dl *CustomLogger) Panicln(args ...interface{}) {
+	defer runExitHooks()
+	dl.Entry.Panicln(args...)
+}
+
+// LoggerOptions holds the optional settings for NewLoggerWithOptions
+type LoggerOptions struct {
+	// ReportCaller adds the file:line and function of the calling code to every entry
+	ReportCaller bool
+	// CallerSkip is the number of additional frames to skip when reporting the caller,
+	// for services that log through their own helper functions
+	CallerSkip int
+}
+
 // NewLogger initializes a new logger instance
 func NewLogger(app string, version string) LoggerType {
+	return NewLoggerWithOptions(app, version, LoggerOptions{})
+}
+
+// NewLoggerWithOptions initializes a new logger instance using the provided options
+func NewLoggerWithOptions(app string, version string, options LoggerOptions) LoggerType {
 	tempLogger := logrus.Logger{
 		Out: os.Stdout,
 		Formatter: CustomFormatter{&logrus.JSONFormatter{
 			TimestampFormat: time.RFC3339Nano,
 		}},
-		Hooks: make(logrus.LevelHooks),
-		Level: logrus.DebugLevel,
+		Hooks:        make(logrus.LevelHooks),
+		Level:        logrus.DebugLevel,
+		ReportCaller: options.ReportCaller,
+	}
+	if options.ReportCaller {
+		tempLogger.AddHook(&callerHook{skip: options.CallerSkip})
 	}
 
 	return &CustomLogger{tempLogger.WithField("app", app).WithField("version", version)}
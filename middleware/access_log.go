@@ -0,0 +1,154 @@
+package middleware
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// AccessLogFormat selects how access log lines are written
+type AccessLogFormat int
+
+const (
+	// AccessLogJSON writes the access log details as structured log fields
+	AccessLogJSON AccessLogFormat = iota
+	// AccessLogCombined writes the access log line in the Apache combined log format
+	AccessLogCombined
+)
+
+// combinedLogTimeFormat is the time layout used by the Apache combined log format
+const combinedLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogOptions enables the access log mode of the logging middleware, which writes one line per request
+// at a level based on the response status: error for 5xx, warning for 4xx and info otherwise
+type AccessLogOptions struct {
+	// Format of the access log line, AccessLogJSON by default
+	Format AccessLogFormat
+	// Skip lists the routes that are never logged, e.g. health and metrics probes
+	Skip []RouteMatcher
+	// Sample lists the routes that are only logged for a fraction of the requests.
+	// Server errors are always logged.
+	Sample []AccessLogSampling
+}
+
+// AccessLogSampling logs the given fraction, between 0 and 1, of the requests matching the route
+type AccessLogSampling struct {
+	RouteMatcher
+	Rate float64
+}
+
+func accessLogWrapper(next http.Handler, logger log.LoggerType, options AccessLogOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, skip := range options.Skip {
+			if skip.Matches(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		loggingRW := &loggingResponseWriter{ResponseWriter: w, maxBodySize: -1}
+		start := time.Now()
+
+		// call next
+		next.ServeHTTP(wrapResponseWriter(loggingRW, w), r)
+
+		duration := time.Since(start)
+		status := loggingRW.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status < http.StatusInternalServerError && !sampled(r, options.Sample) {
+			return
+		}
+
+		var entry log.LoggerType
+		var message string
+		switch options.Format {
+		case AccessLogCombined:
+			entry = logger
+			message = combinedLogLine(r, start, status, loggingRW.written)
+		default:
+			entry = logger.WithCustomFields(map[string]interface{}{
+				"request-id":     GetRequestID(r),
+				"request-method": r.Method,
+				"request-uri":    requestURI(r),
+				"route":          RouteTemplate(r),
+				"response-code":  status,
+				"response-bytes": loggingRW.written,
+				"response-time":  duration.Milliseconds(),
+				"remote-ip":      remoteIP(r),
+				"user-agent":     r.UserAgent(),
+			})
+			message = fmt.Sprintf("%s %s %d", r.Method, requestURI(r), status)
+		}
+
+		switch {
+		case status >= http.StatusInternalServerError:
+			entry.Error(message)
+		case status >= http.StatusBadRequest:
+			entry.Warn(message)
+		default:
+			entry.Info(message)
+		}
+	})
+}
+
+// sampled reports whether the request should be logged according to the first matching sampling rule
+func sampled(r *http.Request, samples []AccessLogSampling) bool {
+	for _, sample := range samples {
+		if sample.Matches(r) {
+			return rand.Float64() < sample.Rate
+		}
+	}
+	return true
+}
+
+func combinedLogLine(r *http.Request, start time.Time, status int, written int64) string {
+	size := "-"
+	if written > 0 {
+		size = fmt.Sprintf("%d", written)
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %s %q %q",
+		remoteIP(r),
+		start.Format(combinedLogTimeFormat),
+		fmt.Sprintf("%s %s %s", r.Method, requestURI(r), r.Proto),
+		status,
+		size,
+		orDash(r.Referer()),
+		orDash(r.UserAgent()))
+}
+
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// remoteIP returns the client address resolved by the ClientIPResolver, or the address of the connecting peer
+func remoteIP(r *http.Request) string {
+	if clientIP, ok := r.Context().Value(ContextClientIPKey).(string); ok && clientIP != "" {
+		return clientIP
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address of the connecting peer without the port
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAccessLogRouter(buffer *bytes.Buffer, options AccessLogOptions) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(LoggingMiddlewareWithOptions(newBufferedLogger(buffer), LoggingOptions{AccessLog: &options}))
+	appRouter.HandleFunc("/api/assets/{type}", successHandler)
+	appRouter.HandleFunc("/health", successHandler)
+	appRouter.HandleFunc("/metrics", successHandler)
+	appRouter.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	appRouter.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	return appRouter
+}
+
+func Test_AccessLog_Json_Writes_One_Line_With_Request_Details(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	appRouter := setupAccessLogRouter(buffer, AccessLogOptions{})
+
+	req := httptest.NewRequest("GET", "/api/assets/cam?page=1", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := readLogEntries(t, buffer)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "info", entries[0]["level"])
+	assert.Equal(t, "/api/assets/{type}", entries[0]["route"])
+	assert.Equal(t, float64(200), entries[0]["response-code"])
+	assert.Equal(t, float64(len("response value")), entries[0]["response-bytes"])
+	assert.Equal(t, "192.0.2.1", entries[0]["remote-ip"])
+	assert.Equal(t, "test-agent", entries[0]["user-agent"])
+	assert.Contains(t, entries[0], "response-time")
+	assert.NotContains(t, entries[0], "request-body")
+}
+
+func Test_AccessLog_Level_Depends_On_Status(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	appRouter := setupAccessLogRouter(buffer, AccessLogOptions{})
+
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, "error", entries[0]["level"])
+	assert.Equal(t, "warning", entries[1]["level"])
+}
+
+func Test_AccessLog_Skips_And_Samples_Routes(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	appRouter := setupAccessLogRouter(buffer, AccessLogOptions{
+		Skip:   []RouteMatcher{{Route: "/health"}},
+		Sample: []AccessLogSampling{{RouteMatcher: RouteMatcher{Route: "/metrics"}, Rate: 0}},
+	})
+
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 0, buffer.Len(), "Skipped and unsampled routes should not be logged")
+}
+
+func Test_AccessLog_Combined_Format(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	appRouter := setupAccessLogRouter(buffer, AccessLogOptions{Format: AccessLogCombined})
+
+	req := httptest.NewRequest("GET", "/api/assets/cam", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Referer", "http://ui")
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := readLogEntries(t, buffer)
+	combined := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /api/assets/cam HTTP/1\.1" 200 14 "http://ui" "test-agent"$`)
+	assert.Regexp(t, combined, entries[0]["msg"])
+}
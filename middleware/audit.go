@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+const (
+	// AuditOutcomeSuccess is the outcome of the requests answered with a 1xx, 2xx or 3xx status
+	AuditOutcomeSuccess = "success"
+	// AuditOutcomeDenied is the outcome of the requests answered with a 401 or 403
+	AuditOutcomeDenied = "denied"
+	// AuditOutcomeFailure is the outcome of the other requests
+	AuditOutcomeFailure = "failure"
+)
+
+// AnonymousActor is the actor of the requests without bearer token
+const AnonymousActor = "anonymous"
+
+// AuditRecord records who changed which resource, when and with which outcome
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	Actor     string    `json:"actor"`
+	ClientIP  string    `json:"clientIp,omitempty"`
+	Action    string    `json:"action"`
+	// Resource is the route template, Params holds its path params
+	Resource string            `json:"resource"`
+	Params   map[string]string `json:"params,omitempty"`
+	Outcome  string            `json:"outcome"`
+	Status   int               `json:"status"`
+	// Payload is the redacted request body, when payloads are recorded
+	Payload interface{} `json:"payload,omitempty"`
+	// Changes are the redacted values of the payload differing from the snapshot of the resource
+	Changes []AuditChange `json:"changes,omitempty"`
+}
+
+// AuditChange is a value changed by the request, Path is a JSON path such as $.owner.name or $.tags[0]
+type AuditChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// AuditRoute audits the requests selected by its RouteMatcher as the action
+type AuditRoute struct {
+	RouteMatcher
+	// Action names the audited action, e.g. "asset.update", the request method when empty
+	Action string
+}
+
+// AuditOptions configures the audit middleware
+type AuditOptions struct {
+	// Routes select the audited requests, every POST, PUT, PATCH and DELETE request when empty
+	Routes []AuditRoute
+	// Sink receives the records
+	Sink AuditSink
+	// RecordPayload adds the JSON request body to the records, a body that is not JSON is recorded as redacted
+	RecordPayload bool
+	// MaxPayloadSize is the largest body read for the records, DefaultMaxBodySize when zero. A larger body is
+	// recorded as redacted and passed to the handler unread.
+	MaxPayloadSize int64
+	// MaskPaths are the JSON paths of the payload values replaced with MaskedLogValue, see LogFilterConfig
+	MaskPaths []string
+	// Snapshot returns the JSON of the resource before the request, the payload values differing from it are
+	// recorded as changes. Only the values present in the payload are compared.
+	Snapshot func(r *http.Request) ([]byte, error)
+}
+
+// Auditor records the audited requests to its sink
+type Auditor struct {
+	options   AuditOptions
+	logger    log.LoggerType
+	maskPaths []jsonPath
+}
+
+// NewAuditor validates the options and creates the auditor
+func NewAuditor(options AuditOptions, logger log.LoggerType) (*Auditor, error) {
+	if options.Sink == nil {
+		return nil, fmt.Errorf("audit sink is required")
+	}
+	if options.MaxPayloadSize <= 0 {
+		options.MaxPayloadSize = DefaultMaxBodySize
+	}
+	auditor := &Auditor{options: options, logger: logger}
+	for _, path := range options.MaskPaths {
+		parsed, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		auditor.maskPaths = append(auditor.maskPaths, parsed)
+	}
+	return auditor, nil
+}
+
+// Middleware is a gorilla mux middleware auditing the configured requests
+func (a *Auditor) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.Wrapper(next)
+	}
+}
+
+// Wrapper records the audited requests once answered, a sink failure is logged and does not fail the request
+func (a *Auditor) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, ok := a.options.actionFor(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		record := AuditRecord{
+			Time:      time.Now().UTC(),
+			RequestID: GetRequestID(r),
+			Actor:     AnonymousActor,
+			ClientIP:  remoteIP(r),
+			Action:    action,
+			Resource:  RouteTemplate(r),
+			Params:    mux.Vars(r),
+		}
+		if record.Resource == "" {
+			record.Resource = requestPath(r)
+		}
+		if claims := GetClaims(r); claims != nil && claims.Subject != "" {
+			record.Actor = claims.Subject
+		}
+
+		var payload interface{}
+		if a.options.RecordPayload || a.options.Snapshot != nil {
+			payload = a.readPayload(r)
+			if a.options.RecordPayload {
+				record.Payload = payload
+			}
+		}
+		if a.options.Snapshot != nil && payload != nil {
+			record.Changes = a.changes(r, payload)
+		}
+
+		sw := &statusResponseWriter{ResponseWriter: w}
+		defer func() {
+			record.Status = sw.status
+			if record.Status == 0 {
+				// the handler panicked before answering
+				record.Status = http.StatusInternalServerError
+			}
+			record.Outcome = auditOutcome(record.Status)
+			if err := a.options.Sink.Write(r.Context(), record); err != nil {
+				a.logger.Errorf("Failed writing audit record of request %s %s: %v", r.Method, requestURI(r), err)
+			}
+		}()
+
+		// call next
+		next.ServeHTTP(wrapResponseWriter(sw, w), r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+	})
+}
+
+// Close closes the sink when it holds resources
+func (a *Auditor) Close() error {
+	if closer, ok := a.options.Sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// actionFor returns the action of an audited request, false when the request is not audited
+func (o AuditOptions) actionFor(r *http.Request) (string, bool) {
+	if len(o.Routes) == 0 {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+			return r.Method, true
+		}
+		return "", false
+	}
+	for i := range o.Routes {
+		if o.Routes[i].Matches(r) {
+			if o.Routes[i].Action != "" {
+				return o.Routes[i].Action, true
+			}
+			return r.Method, true
+		}
+	}
+	return "", false
+}
+
+// readPayload returns the redacted JSON body and restores the body for the handler
+func (a *Auditor) readPayload(r *http.Request) interface{} {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	// read one byte over the limit to tell a body at the limit from a larger one
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, a.options.MaxPayloadSize+1))
+	if int64(len(body)) > a.options.MaxPayloadSize {
+		// the handler reads what was read followed by the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return RedactedLogMessage
+	}
+	if err != nil {
+		// the handler gets the read error after what was read, not a short body ending cleanly
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), errReader{err}), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		return nil
+	}
+	document, ok := a.redact(body)
+	if !ok {
+		return RedactedLogMessage
+	}
+	return document
+}
+
+// errReader returns its error on every read
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// redact decodes the JSON document and masks the configured paths
+func (a *Auditor) redact(body []byte) (interface{}, bool) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, false
+	}
+	for _, path := range a.maskPaths {
+		document = path.mask(document)
+	}
+	return document, true
+}
+
+// changes compares the payload values with the snapshot of the resource
+func (a *Auditor) changes(r *http.Request, payload interface{}) []AuditChange {
+	snapshot, err := a.options.Snapshot(r)
+	if err != nil {
+		a.logger.Warnf("Failed reading the audit snapshot of request %s %s: %v", r.Method, requestURI(r), err)
+		return nil
+	}
+	var before interface{}
+	if len(snapshot) > 0 {
+		var ok bool
+		if before, ok = a.redact(snapshot); !ok {
+			a.logger.Warnf("Audit snapshot of request %s %s is not JSON", r.Method, requestURI(r))
+			return nil
+		}
+	}
+
+	oldValues, newValues := map[string]interface{}{}, map[string]interface{}{}
+	flattenJSON("$", before, oldValues)
+	flattenJSON("$", payload, newValues)
+	var changes []AuditChange
+	for path, value := range newValues {
+		if old, ok := oldValues[path]; !ok || fmt.Sprint(old) != fmt.Sprint(value) {
+			changes = append(changes, AuditChange{Path: path, Old: old, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// flattenJSON collects the leaf values of the document by JSON path
+func flattenJSON(path string, node interface{}, values map[string]interface{}) {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		for key, value := range typed {
+			flattenJSON(path+"."+key, value, values)
+		}
+	case []interface{}:
+		for i, value := range typed {
+			flattenJSON(path+"["+strconv.Itoa(i)+"]", value, values)
+		}
+	case nil:
+		if path != "$" {
+			values[path] = nil
+		}
+	default:
+		values[path] = typed
+	}
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditOutcomeDenied
+	case status >= http.StatusBadRequest:
+		return AuditOutcomeFailure
+	default:
+		return AuditOutcomeSuccess
+	}
+}
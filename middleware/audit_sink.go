@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
+)
+
+const (
+	// DefaultAuditWebhookTimeout bounds the webhook calls by default
+	DefaultAuditWebhookTimeout = 5 * time.Second
+	// DefaultAuditWebhookQueueSize is how many records wait for the webhook by default
+	DefaultAuditWebhookQueueSize = 1000
+)
+
+// errAuditQueueFull is returned when a record is dropped because the webhook queue is full
+var errAuditQueueFull = errors.New("audit webhook queue is full, record dropped")
+
+// maxAuditLineSize bounds the lines read back from an audit file
+const maxAuditLineSize = 16 * 1024 * 1024
+
+// AuditSink stores the audit records
+type AuditSink interface {
+	Write(ctx context.Context, record AuditRecord) error
+}
+
+// MemoryAuditSink keeps the records in memory, for tests and development
+type MemoryAuditSink struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+// NewMemoryAuditSink creates an empty in-memory sink
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+// Write appends the record
+func (s *MemoryAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+// Records returns a copy of the records written so far
+func (s *MemoryAuditSink) Records() []AuditRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AuditRecord(nil), s.records...)
+}
+
+// auditEntry is a line of an audit file, Hash is the SHA-256 of PrevHash followed by Record
+type auditEntry struct {
+	Hash     string          `json:"hash"`
+	PrevHash string          `json:"prevHash"`
+	Record   json.RawMessage `json:"record"`
+}
+
+// FileAuditSink appends the records to a file as JSON lines chained by hash, so an edited, removed or reordered
+// line is detected by VerifyAuditFile
+type FileAuditSink struct {
+	mu       sync.Mutex
+	file     *os.File
+	lastHash string
+}
+
+// NewFileAuditSink opens the audit file in append mode, the chain continues from its last line
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	lastHash, _, err := readAuditChain(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{file: file, lastHash: lastHash}, nil
+}
+
+// Write appends the record chained to the previous one
+func (s *FileAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := auditEntry{Hash: auditHash(s.lastHash, body), PrevHash: s.lastHash, Record: body}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.lastHash = entry.Hash
+	return nil
+}
+
+// Close closes the audit file
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// VerifyAuditFile checks the hash chain of an audit file, the error names the first line breaking it
+func VerifyAuditFile(path string) error {
+	_, _, err := readAuditChain(path)
+	return err
+}
+
+// readAuditChain verifies the chain and returns the hash of the last line and the number of lines
+func readAuditChain(path string) (string, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditLineSize)
+	lastHash, lines := "", 0
+	for scanner.Scan() {
+		lines++
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return "", lines, fmt.Errorf("audit file %s line %d is invalid: %v", path, lines, err)
+		}
+		if entry.PrevHash != lastHash {
+			return "", lines, fmt.Errorf("audit file %s line %d does not follow the previous line", path, lines)
+		}
+		if entry.Hash != auditHash(entry.PrevHash, entry.Record) {
+			return "", lines, fmt.Errorf("audit file %s line %d was modified", path, lines)
+		}
+		lastHash = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", lines, err
+	}
+	return lastHash, lines, nil
+}
+
+func auditHash(prevHash string, record []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(prevHash))
+	hash.Write(record)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// WebhookAuditOptions configures the webhook audit sink
+type WebhookAuditOptions struct {
+	// URL receives each record as a JSON POST, a response other than 2xx is a failed delivery
+	URL string
+	// Header is sent with every record, e.g. the Authorization of the webhook
+	Header http.Header
+	// Client posts the records, a client timing out after DefaultAuditWebhookTimeout when nil
+	Client *http.Client
+	// QueueSize is how many records wait for the webhook, DefaultAuditWebhookQueueSize when zero
+	QueueSize int
+}
+
+// WebhookAuditSink posts the records to a webhook in the background, so the requests do not wait for it. The
+// records are queued and dropped when the queue is full, the failed deliveries are logged.
+type WebhookAuditSink struct {
+	options WebhookAuditOptions
+	logger  log.LoggerType
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan webhookDelivery
+	done   chan struct{}
+}
+
+// webhookDelivery is a queued record with the headers of its request
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// NewWebhookAuditSink creates a webhook sink and starts its delivery goroutine, Close stops it
+func NewWebhookAuditSink(options WebhookAuditOptions, logger log.LoggerType) *WebhookAuditSink {
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: DefaultAuditWebhookTimeout}
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultAuditWebhookQueueSize
+	}
+	s := &WebhookAuditSink{
+		options: options,
+		logger:  logger,
+		queue:   make(chan webhookDelivery, options.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.deliver()
+	return s
+}
+
+// Write queues the record with the request id of the context, it returns an error when the record is dropped
+func (s *WebhookAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	for name, values := range s.options.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	// only the request id is forwarded, the time budget and locale of the request are stale once delivered
+	if ctx != nil {
+		if requestID := trace.GetRequestID(ctx); requestID != "" {
+			header.Set(trace.RequestIDHeader, requestID)
+		}
+	}
+	header.Set(contentTypeHeader, "application/json")
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errors.New("audit webhook sink is closed")
+	}
+	select {
+	case s.queue <- webhookDelivery{header: header, body: body}:
+		return nil
+	default:
+		return errAuditQueueFull
+	}
+}
+
+// Close stops accepting records and waits for the queued records to be delivered
+func (s *WebhookAuditSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func (s *WebhookAuditSink) deliver() {
+	defer close(s.done)
+	for delivery := range s.queue {
+		if err := s.post(delivery); err != nil {
+			s.logger.Errorf("Failed delivering audit record to webhook: %v", err)
+		}
+	}
+}
+
+func (s *WebhookAuditSink) post(delivery webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, s.options.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	req.Header = delivery.header
+	resp, err := s.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_File_Audit_Sink_Chains_Records(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileAuditSink(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), AuditRecord{Actor: "user-1", Action: "create"}))
+	assert.NoError(t, sink.Write(context.Background(), AuditRecord{Actor: "user-1", Action: "update"}))
+	assert.NoError(t, sink.Close())
+
+	// reopening continues the chain
+	sink, err = NewFileAuditSink(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), AuditRecord{Actor: "user-2", Action: "delete"}))
+	assert.NoError(t, sink.Close())
+	assert.NoError(t, VerifyAuditFile(path))
+
+	content, _ := ioutil.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 3)
+
+	tampered := strings.Replace(string(content), `"actor":"user-1","action":"update"`, `"actor":"user-3","action":"update"`, 1)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(tampered), 0600))
+	err = VerifyAuditFile(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "line 2")
+	_, err = NewFileAuditSink(path)
+	assert.Error(t, err, "a broken chain is not extended")
+
+	removed := lines[0] + "\n" + lines[2] + "\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(removed), 0600))
+	assert.Error(t, VerifyAuditFile(path))
+}
+
+func Test_Webhook_Audit_Sink(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	var mu sync.Mutex
+	var received []AuditRecord
+	var authorization, requestID, timeout string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var record AuditRecord
+		json.NewDecoder(r.Body).Decode(&record)
+		mu.Lock()
+		defer mu.Unlock()
+		authorization = r.Header.Get("Authorization")
+		requestID, timeout = r.Header.Get(trace.RequestIDHeader), r.Header.Get(trace.RequestTimeoutHeader)
+		received = append(received, record)
+		if record.Actor == "rejected" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	sink := NewWebhookAuditSink(WebhookAuditOptions{URL: server.URL, Header: http.Header{"Authorization": []string{"Bearer token"}}}, newBufferedLogger(buffer))
+	ctx, cancel := context.WithTimeout(trace.ContextWithRequestID(context.Background(), "request-1"), time.Minute)
+	defer cancel()
+	assert.NoError(t, sink.Write(ctx, AuditRecord{Actor: "user-1", Action: "create"}))
+	assert.NoError(t, sink.Write(ctx, AuditRecord{Actor: "rejected"}))
+	assert.NoError(t, sink.Close())
+	assert.Error(t, sink.Write(context.Background(), AuditRecord{Actor: "user-1"}), "a closed sink drops the records")
+
+	assert.Len(t, received, 2)
+	assert.Equal(t, "user-1", received[0].Actor)
+	assert.Equal(t, "Bearer token", authorization)
+	assert.Equal(t, "request-1", requestID)
+	assert.Empty(t, timeout, "the request time budget should not be forwarded")
+	entries := readLogEntries(t, buffer)
+	assert.Len(t, entries, 1)
+	assert.Contains(t, entries[0]["msg"], "status 500")
+}
+
+func Test_Webhook_Audit_Sink_Does_Not_Block_Requests(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	buffer := &bytes.Buffer{}
+	sink := NewWebhookAuditSink(WebhookAuditOptions{URL: server.URL, QueueSize: 1}, log.NewLogger("", ""))
+	auditor, err := NewAuditor(AuditOptions{Sink: sink}, newBufferedLogger(buffer))
+	assert.NoError(t, err)
+	handler := auditor.Wrapper(http.HandlerFunc(successHandler))
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/assets", nil))
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "the requests should not wait for the webhook")
+
+	close(release)
+	assert.NoError(t, auditor.Close())
+	assert.NotEmpty(t, readLogEntries(t, buffer), "the dropped records should be logged")
+}
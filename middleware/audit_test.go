@@ -0,0 +1,179 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAuditRouter(t *testing.T, options AuditOptions, handler http.HandlerFunc) *mux.Router {
+	auditor, err := NewAuditor(options, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	appRouter := mux.NewRouter()
+	appRouter.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subject := r.Header.Get("X-Test-Subject"); subject != "" {
+				r = r.WithContext(context.WithValue(r.Context(), ContextClaimsKey, &Claims{Subject: subject}))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	appRouter.Use(auditor.Middleware())
+	appRouter.HandleFunc("/api/assets/{id}", handler)
+	return appRouter
+}
+
+func Test_Audit_Records_Mutating_Requests(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	appRouter := setupAuditRouter(t, AuditOptions{Sink: sink}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/assets/7", nil)
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, sink.Records())
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/assets/7", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	req.Header.Set("X-Test-Subject", "user-1")
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := sink.Records()
+	assert.Len(t, records, 1)
+	assert.Equal(t, "user-1", records[0].Actor)
+	assert.Equal(t, http.MethodDelete, records[0].Action)
+	assert.Equal(t, "/api/assets/{id}", records[0].Resource)
+	assert.Equal(t, map[string]string{"id": "7"}, records[0].Params)
+	assert.Equal(t, AuditOutcomeSuccess, records[0].Outcome)
+	assert.Equal(t, http.StatusNoContent, records[0].Status)
+	assert.False(t, records[0].Time.IsZero())
+}
+
+func Test_Audit_Outcomes(t *testing.T) {
+	for status, outcome := range map[int]string{
+		http.StatusOK:                  AuditOutcomeSuccess,
+		http.StatusUnauthorized:        AuditOutcomeDenied,
+		http.StatusForbidden:           AuditOutcomeDenied,
+		http.StatusConflict:            AuditOutcomeFailure,
+		http.StatusInternalServerError: AuditOutcomeFailure,
+	} {
+		sink := NewMemoryAuditSink()
+		appRouter := setupAuditRouter(t, AuditOptions{Sink: sink}, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		})
+		appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/assets/1", nil))
+		records := sink.Records()
+		assert.Len(t, records, 1)
+		assert.Equal(t, outcome, records[0].Outcome, "status %d", status)
+		assert.Equal(t, AnonymousActor, records[0].Actor)
+	}
+}
+
+func Test_Audit_Routes_Name_Actions(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	options := AuditOptions{Sink: sink, Routes: []AuditRoute{
+		{RouteMatcher: RouteMatcher{Route: "/api/assets/{id}", Methods: []string{http.MethodPut}}, Action: "asset.update"},
+	}}
+	appRouter := setupAuditRouter(t, options, successHandler)
+
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/api/assets/1", nil))
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/api/assets/1", strings.NewReader("{}")))
+
+	records := sink.Records()
+	assert.Len(t, records, 1)
+	assert.Equal(t, "asset.update", records[0].Action)
+}
+
+func Test_Audit_Records_Redacted_Payload_And_Changes(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	var received string
+	options := AuditOptions{
+		Sink:          sink,
+		RecordPayload: true,
+		MaskPaths:     []string{"$.password"},
+		Snapshot: func(r *http.Request) ([]byte, error) {
+			return []byte(`{"name":"old","owner":{"id":1},"password":"before"}`), nil
+		},
+	}
+	appRouter := setupAuditRouter(t, options, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+	})
+
+	body := `{"name":"new","owner":{"id":1},"password":"secret"}`
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPatch, "/api/assets/1", strings.NewReader(body)))
+
+	assert.Equal(t, body, received, "the handler reads the whole body")
+	records := sink.Records()
+	assert.Len(t, records, 1)
+	payload := records[0].Payload.(map[string]interface{})
+	assert.Equal(t, "new", payload["name"])
+	assert.Equal(t, MaskedLogValue, payload["password"])
+	assert.Equal(t, []AuditChange{{Path: "$.name", Old: "old", New: "new"}}, records[0].Changes)
+}
+
+func Test_Audit_Non_JSON_Payload_Is_Redacted(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	appRouter := setupAuditRouter(t, AuditOptions{Sink: sink, RecordPayload: true}, successHandler)
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/assets/1", strings.NewReader("plain")))
+	assert.Equal(t, RedactedLogMessage, sink.Records()[0].Payload)
+}
+
+func Test_Audit_Caps_Payload_Read(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	body := `{"name":"` + strings.Repeat("a", 64) + `"}`
+	var received string
+	appRouter := setupAuditRouter(t, AuditOptions{Sink: sink, RecordPayload: true, MaxPayloadSize: 16}, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		received = string(data)
+	})
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/assets/1", strings.NewReader(body)))
+	assert.Equal(t, RedactedLogMessage, sink.Records()[0].Payload)
+	assert.Equal(t, body, received, "the handler should read the whole body")
+}
+
+func Test_Audit_Passes_Body_Read_Errors_To_Handler(t *testing.T) {
+	sink := NewMemoryAuditSink()
+	readErr := errors.New("client went away")
+	var received string
+	var handlerErr error
+	appRouter := setupAuditRouter(t, AuditOptions{Sink: sink, RecordPayload: true}, func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		received, handlerErr = string(data), err
+	})
+	body := ioutil.NopCloser(io.MultiReader(strings.NewReader(`{"name":`), errReader{readErr}))
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/assets/1", body))
+
+	assert.Equal(t, `{"name":`, received)
+	assert.Equal(t, readErr, handlerErr, "the handler should see the read error")
+	assert.Nil(t, sink.Records()[0].Payload)
+}
+
+type failingAuditSink struct{}
+
+func (failingAuditSink) Write(ctx context.Context, record AuditRecord) error {
+	return errors.New("sink down")
+}
+
+func Test_Audit_Sink_Failure_Does_Not_Fail_Request(t *testing.T) {
+	appRouter := setupAuditRouter(t, AuditOptions{Sink: failingAuditSink{}}, successHandler)
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/assets/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_Audit_Requires_Sink_And_Valid_Mask_Paths(t *testing.T) {
+	_, err := NewAuditor(AuditOptions{}, log.NewLogger("", ""))
+	assert.Error(t, err)
+	_, err = NewAuditor(AuditOptions{Sink: NewMemoryAuditSink(), MaskPaths: []string{"password"}}, log.NewLogger("", ""))
+	assert.Error(t, err)
+}
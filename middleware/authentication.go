@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// AuthorizationHeader represents the Authorization Header param
+const AuthorizationHeader = "Authorization"
+
+// WWWAuthenticateHeader represents the WWW-Authenticate Header param
+const WWWAuthenticateHeader = "WWW-Authenticate"
+
+// UnauthorizedMessageID is the message id used for requests without a valid bearer token
+const UnauthorizedMessageID = "UNAUTHORIZED"
+
+// DefaultJWTAlgorithms are the signing algorithms accepted when JWTOptions.Algorithms is empty
+var DefaultJWTAlgorithms = []string{AlgorithmRS256, AlgorithmES256}
+
+// JWTOptions configures the bearer token authentication
+type JWTOptions struct {
+	// JWKSFile is the path of a local JWKS document holding the verification keys
+	JWKSFile string
+	// PEMFiles are the paths of PEM encoded public keys or certificates, the file name without extension is
+	// used as key id
+	PEMFiles []string
+	// ReloadInterval is how often the key files are checked for changes, they are only read once when zero
+	ReloadInterval time.Duration
+	// Algorithms are the accepted signing algorithms, DefaultJWTAlgorithms when empty.
+	// HS256 verifies against the oct keys of the JWKS document.
+	Algorithms []string
+	// Issuers are the accepted iss claims, any issuer is accepted when empty
+	Issuers []string
+	// Audiences are the accepted aud claims, any audience is accepted when empty
+	Audiences []string
+	// ClockSkew is the tolerance applied when checking the exp and nbf claims
+	ClockSkew time.Duration
+	// RequireExpiry rejects the tokens without an exp claim, true when nil
+	RequireExpiry *bool
+	// Realm is the realm returned in the WWW-Authenticate header
+	Realm string
+	// Skip lists the routes that do not require a token, e.g. health probes
+	Skip []RouteMatcher
+	// ErrorResponder writes the 401 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the 401 responses, UnauthorizedMessageID when empty
+	MessageID string
+}
+
+// JWTAuthenticator validates bearer tokens and stores their claims in the request context
+type JWTAuthenticator struct {
+	options    JWTOptions
+	keys       *keySet
+	validation tokenValidation
+	watcher    *fileWatcher
+	logger     log.LoggerType
+}
+
+// NewJWTAuthenticator loads the verification keys and starts watching the key files for changes
+func NewJWTAuthenticator(options JWTOptions, logger log.LoggerType) (*JWTAuthenticator, error) {
+	if len(options.Algorithms) == 0 {
+		options.Algorithms = DefaultJWTAlgorithms
+	}
+	if options.MessageID == "" {
+		options.MessageID = UnauthorizedMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+
+	a := &JWTAuthenticator{
+		options: options,
+		keys:    &keySet{},
+		validation: tokenValidation{
+			algorithms:    options.Algorithms,
+			issuers:       options.Issuers,
+			audiences:     options.Audiences,
+			clockSkew:     options.ClockSkew,
+			requireExpiry: options.RequireExpiry == nil || *options.RequireExpiry,
+			now:           time.Now,
+		},
+		logger: logger,
+	}
+	if err := a.keys.load(options.JWKSFile, options.PEMFiles); err != nil {
+		return nil, err
+	}
+
+	files := append([]string{}, options.PEMFiles...)
+	if options.JWKSFile != "" {
+		files = append(files, options.JWKSFile)
+	}
+	a.watcher = watchFiles(files, options.ReloadInterval, a.reload)
+	return a, nil
+}
+
+func (a *JWTAuthenticator) reload() {
+	if err := a.keys.load(a.options.JWKSFile, a.options.PEMFiles); err != nil {
+		a.logger.Errorf("Failed to reload token verification keys, keeping the current keys: %v", err)
+		return
+	}
+	a.logger.Infof("Reloaded token verification keys")
+}
+
+// Close stops watching the key files
+func (a *JWTAuthenticator) Close() {
+	a.watcher.Stop()
+}
+
+// Middleware returns a gorilla mux middleware authenticating the requests
+func (a *JWTAuthenticator) Middleware() func(http.Handler) http.Handler {
+	return a.Wrapper
+}
+
+// Wrapper authenticates the request before calling the next handler. Requests without a valid bearer token
+// are rejected with a 401 including the WWW-Authenticate header.
+func (a *JWTAuthenticator) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, skip := range a.options.Skip {
+			if skip.Matches(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			a.reject(w, r, nil)
+			return
+		}
+
+		claims, err := parseToken(token, a.keys, a.validation)
+		if err != nil {
+			a.logger.Debugf("Rejected bearer token: %v", err)
+			a.reject(w, r, err)
+			return
+		}
+
+		// call next
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ContextClaimsKey, claims)))
+	})
+}
+
+// reject writes the 401 response, describing the token error as defined by RFC 6750
+func (a *JWTAuthenticator) reject(w http.ResponseWriter, r *http.Request, err error) {
+	challenge := "Bearer"
+	if a.options.Realm != "" {
+		challenge += fmt.Sprintf(" realm=%q,", a.options.Realm)
+	}
+	if err != nil {
+		challenge += fmt.Sprintf(" error=\"invalid_token\", error_description=%q", err.Error())
+	}
+	w.Header().Set(WWWAuthenticateHeader, strings.TrimSuffix(challenge, ","))
+	a.options.ErrorResponder(w, r, http.StatusUnauthorized, a.options.MessageID, nil)
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get(AuthorizationHeader)
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(authorization[7:])
+	return token, token != ""
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type testKeys struct {
+	rsa      *rsa.PrivateKey
+	ec       *ecdsa.PrivateKey
+	secret   []byte
+	jwksFile string
+	pemFile  string
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := testKeys{rsa: rsaKey, ec: ecKey, secret: []byte("0123456789abcdef0123456789abcdef")}
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": "hmac-1", "k": encode(keys.secret)},
+	}}
+	dir := t.TempDir()
+	keys.jwksFile = filepath.Join(dir, "jwks.json")
+	data, _ := json.Marshal(jwks)
+	ioutil.WriteFile(keys.jwksFile, data, 0600)
+
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	keys.pemFile = filepath.Join(dir, "pem-key.pem")
+	ioutil.WriteFile(keys.pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	return keys
+}
+
+func (k testKeys) sign(t *testing.T, algorithm string, kid string, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": algorithm, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch algorithm {
+	case AlgorithmRS256:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case AlgorithmES256:
+		r, s, _ := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case AlgorithmHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://issuer",
+		"sub":   "user-1",
+		"aud":   []string{"assets"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nbf":   time.Now().Add(-time.Minute).Unix(),
+		"scope": "assets:read assets:write",
+		"roles": []string{"admin"},
+		"tier":  "gold",
+	}
+}
+
+func setupAuthRouter(t *testing.T, options JWTOptions) (*mux.Router, *Claims) {
+	authenticator, err := NewJWTAuthenticator(options, log.NewLogger("", ""))
+	if err != nil {
+		t.Fatalf("Not expecting error creating authenticator: %v", err)
+	}
+	t.Cleanup(authenticator.Close)
+
+	claims := &Claims{}
+	appRouter := mux.NewRouter()
+	appRouter.Use(authenticator.Middleware())
+	appRouter.HandleFunc("/api/assets", func(w http.ResponseWriter, r *http.Request) {
+		*claims = *GetClaims(r)
+	})
+	appRouter.HandleFunc("/health", successHandler)
+	return appRouter, claims
+}
+
+func authenticatedRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	if token != "" {
+		req.Header.Set(AuthorizationHeader, "Bearer "+token)
+	}
+	return req
+}
+
+func Test_JWT_Accepts_Valid_Tokens_For_Each_Algorithm(t *testing.T) {
+	keys := newTestKeys(t)
+	appRouter, claims := setupAuthRouter(t, JWTOptions{
+		JWKSFile:   keys.jwksFile,
+		Algorithms: []string{AlgorithmRS256, AlgorithmES256, AlgorithmHS256},
+		Issuers:    []string{"https://issuer"},
+		Audiences:  []string{"assets"},
+	})
+
+	for _, tc := range []struct{ algorithm, kid string }{{AlgorithmRS256, "rsa-1"}, {AlgorithmES256, "ec-1"}, {AlgorithmHS256, "hmac-1"}, {AlgorithmRS256, ""}} {
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, authenticatedRequest(keys.sign(t, tc.algorithm, tc.kid, validClaims())))
+
+		assert.Equal(t, http.StatusOK, w.Code, tc.algorithm)
+		assert.Equal(t, "user-1", claims.Subject)
+		assert.Equal(t, []string{"assets:read", "assets:write"}, claims.Scopes())
+		assert.Equal(t, []string{"admin"}, claims.Roles)
+		assert.Equal(t, "gold", claims.Raw["tier"])
+	}
+}
+
+func Test_JWT_Rejects_Invalid_Tokens_With_Challenge(t *testing.T) {
+	keys := newTestKeys(t)
+	appRouter, _ := setupAuthRouter(t, JWTOptions{
+		JWKSFile:  keys.jwksFile,
+		Issuers:   []string{"https://issuer"},
+		Audiences: []string{"assets"},
+		ClockSkew: time.Minute,
+		Realm:     "assets",
+	})
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+	notYetValid := validClaims()
+	notYetValid["nbf"] = time.Now().Add(2 * time.Minute).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://other"
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "other"
+
+	for name, tc := range map[string]struct{ token, description string }{
+		"missing":      {"", ""},
+		"malformed":    {"not-a-token", "token is malformed"},
+		"hmac blocked": {keys.sign(t, AlgorithmHS256, "hmac-1", validClaims()), "token algorithm is not allowed"},
+		"unknown kid":  {keys.sign(t, AlgorithmRS256, "other", validClaims()), "token signature is invalid"},
+		"wrong key":    {keys.sign(t, AlgorithmRS256, "ec-1", validClaims()), "token signature is invalid"},
+		"expired":      {keys.sign(t, AlgorithmRS256, "rsa-1", expired), "token is expired"},
+		"no expiry":    {keys.sign(t, AlgorithmRS256, "rsa-1", noExpiry), "token has no expiry"},
+		"nbf":          {keys.sign(t, AlgorithmRS256, "rsa-1", notYetValid), "token is not valid yet"},
+		"issuer":       {keys.sign(t, AlgorithmRS256, "rsa-1", wrongIssuer), "token issuer is not accepted"},
+		"audience":     {keys.sign(t, AlgorithmES256, "ec-1", wrongAudience), "token audience is not accepted"},
+	} {
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, authenticatedRequest(tc.token))
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, name)
+		challenge := w.Header().Get(WWWAuthenticateHeader)
+		if tc.description == "" {
+			assert.Equal(t, `Bearer realm="assets"`, challenge, name)
+		} else {
+			assert.Equal(t, `Bearer realm="assets", error="invalid_token", error_description="`+tc.description+`"`, challenge, name)
+		}
+	}
+}
+
+func Test_JWT_Clock_Skew_Accepts_Recently_Expired_Token(t *testing.T) {
+	keys := newTestKeys(t)
+	appRouter, _ := setupAuthRouter(t, JWTOptions{JWKSFile: keys.jwksFile, ClockSkew: time.Minute})
+
+	claims := validClaims()
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, authenticatedRequest(keys.sign(t, AlgorithmRS256, "rsa-1", claims)))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_JWT_Accepts_Token_Without_Expiry_When_Not_Required(t *testing.T) {
+	keys := newTestKeys(t)
+	requireExpiry := false
+	appRouter, _ := setupAuthRouter(t, JWTOptions{JWKSFile: keys.jwksFile, RequireExpiry: &requireExpiry})
+
+	claims := validClaims()
+	delete(claims, "exp")
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, authenticatedRequest(keys.sign(t, AlgorithmRS256, "rsa-1", claims)))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_JWT_Uses_Error_Responder_And_Skips_Routes(t *testing.T) {
+	keys := newTestKeys(t)
+	var messageID string
+	appRouter, _ := setupAuthRouter(t, JWTOptions{
+		PEMFiles: []string{keys.pemFile},
+		Skip:     []RouteMatcher{{Route: "/health"}},
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, templateData map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	})
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, authenticatedRequest(keys.sign(t, AlgorithmRS256, "pem-key", validClaims())))
+	assert.Equal(t, http.StatusOK, w.Code, "PEM keys should use the file name as key id")
+
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, authenticatedRequest(""))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, UnauthorizedMessageID, messageID)
+}
@@ -0,0 +1,336 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// ForbiddenMessageID is the message id used for requests denied by the authorization policies
+const ForbiddenMessageID = "FORBIDDEN"
+
+// Condition operators supported by AuthorizationCondition
+const (
+	OperatorEquals    = "equals"
+	OperatorNotEquals = "notEquals"
+	OperatorIn        = "in"
+	OperatorNotIn     = "notIn"
+	OperatorPresent   = "present"
+)
+
+// AuthorizationPolicySet is the content of a policy file
+type AuthorizationPolicySet struct {
+	// DefaultAllow allows the requests no policy applies to, they are denied by default
+	DefaultAllow bool `json:"defaultAllow"`
+	// Policies are evaluated for every request, all applicable policies must allow the request
+	Policies []AuthorizationPolicy `json:"policies"`
+}
+
+// AuthorizationPolicy declares the requirements for the requests selected by its route, methods and When
+// conditions, e.g. only role asset-admin may PATCH /api/assets/{type} when param.type equals CAM
+type AuthorizationPolicy struct {
+	RouteMatcher
+	Name string `json:"name"`
+	// When restricts the policy to the requests matching all of the conditions
+	When []AuthorizationCondition `json:"when"`
+	// Roles lists the roles allowed, the caller needs at least one of them
+	Roles []string `json:"roles"`
+	// Scopes lists the scopes required, the caller needs all of them
+	Scopes []string `json:"scopes"`
+	// Conditions must all hold for the request to be allowed
+	Conditions []AuthorizationCondition `json:"conditions"`
+}
+
+// AuthorizationCondition compares a request attribute. Attributes are path params, written param.<name>,
+// or token claims, written claim.<name> with dots selecting nested claims.
+type AuthorizationCondition struct {
+	Attribute string `json:"attribute"`
+	// Operator is one of equals, notEquals, in, notIn and present. Every operator but present fails when the
+	// attribute is missing, so a token without the claim never satisfies notEquals or notIn.
+	Operator string `json:"operator"`
+	// Values are compared with the attribute
+	Values []string `json:"values"`
+	// ValueFrom compares with another attribute instead of Values, e.g. param.tenant equals claim.tenant
+	ValueFrom string `json:"valueFrom"`
+}
+
+// AuthorizationOptions configures the authorization middleware
+type AuthorizationOptions struct {
+	// PolicyFile is the path of a JSON AuthorizationPolicySet
+	PolicyFile string
+	// Policies are used when no policy file is configured
+	Policies *AuthorizationPolicySet
+	// ReloadInterval is how often the policy file is checked for changes, it is only read once when zero
+	ReloadInterval time.Duration
+	// ErrorResponder writes the 403 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the 403 responses, ForbiddenMessageID when empty
+	MessageID string
+}
+
+// Authorizer evaluates the authorization policies against the claims stored by the JWTAuthenticator
+type Authorizer struct {
+	options AuthorizationOptions
+	mu      sync.RWMutex
+	set     AuthorizationPolicySet
+	watcher *fileWatcher
+	logger  log.LoggerType
+}
+
+// NewAuthorizer loads the policies and starts watching the policy file for changes
+func NewAuthorizer(options AuthorizationOptions, logger log.LoggerType) (*Authorizer, error) {
+	if options.MessageID == "" {
+		options.MessageID = ForbiddenMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	a := &Authorizer{options: options, logger: logger}
+
+	if options.PolicyFile == "" {
+		if options.Policies == nil {
+			return nil, errors.New("no authorization policies configured")
+		}
+		if err := validatePolicySet(*options.Policies); err != nil {
+			return nil, err
+		}
+		a.set = *options.Policies
+		a.watcher = watchFiles(nil, 0, nil)
+		return a, nil
+	}
+
+	set, err := LoadAuthorizationPolicies(options.PolicyFile)
+	if err != nil {
+		return nil, err
+	}
+	a.set = set
+	a.watcher = watchFiles([]string{options.PolicyFile}, options.ReloadInterval, a.reload)
+	return a, nil
+}
+
+// LoadAuthorizationPolicies reads and validates a policy file
+func LoadAuthorizationPolicies(file string) (AuthorizationPolicySet, error) {
+	var set AuthorizationPolicySet
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return set, err
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return set, fmt.Errorf("invalid policy file %s: %w", file, err)
+	}
+	return set, validatePolicySet(set)
+}
+
+func validatePolicySet(set AuthorizationPolicySet) error {
+	for _, policy := range set.Policies {
+		for _, condition := range append(append([]AuthorizationCondition{}, policy.When...), policy.Conditions...) {
+			switch condition.Operator {
+			case OperatorEquals, OperatorNotEquals, OperatorIn, OperatorNotIn, OperatorPresent:
+			default:
+				return fmt.Errorf("policy %q has unsupported operator %q", policy.Name, condition.Operator)
+			}
+			if !isAttribute(condition.Attribute) || (condition.ValueFrom != "" && !isAttribute(condition.ValueFrom)) {
+				return fmt.Errorf("policy %q has invalid attribute in condition %q", policy.Name, condition.Attribute)
+			}
+		}
+	}
+	return nil
+}
+
+func isAttribute(attribute string) bool {
+	return strings.HasPrefix(attribute, "param.") || strings.HasPrefix(attribute, "claim.")
+}
+
+func (a *Authorizer) reload() {
+	set, err := LoadAuthorizationPolicies(a.options.PolicyFile)
+	if err != nil {
+		a.logger.Errorf("Failed to reload authorization policies, keeping the current policies: %v", err)
+		return
+	}
+	a.mu.Lock()
+	a.set = set
+	a.mu.Unlock()
+	a.logger.Infof("Reloaded authorization policies")
+}
+
+// Close stops watching the policy file
+func (a *Authorizer) Close() {
+	a.watcher.Stop()
+}
+
+// Middleware returns a gorilla mux middleware authorizing the requests
+func (a *Authorizer) Middleware() func(http.Handler) http.Handler {
+	return a.Wrapper
+}
+
+// Wrapper evaluates the policies before calling the next handler. Every decision is logged for audit and
+// denied requests are rejected with a 403.
+func (a *Authorizer) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, policy, reason := a.evaluate(r)
+
+		decision := "allow"
+		if !allowed {
+			decision = "deny"
+		}
+		subject := ""
+		if claims := GetClaims(r); claims != nil {
+			subject = claims.Subject
+		}
+		decisionLogger := a.logger.WithCustomFields(map[string]interface{}{
+			"authz-decision": decision,
+			"authz-policy":   policy,
+			"authz-reason":   reason,
+			"authz-subject":  subject,
+			"request-id":     GetRequestID(r),
+			"request-method": r.Method,
+			"route":          RouteTemplate(r),
+		})
+
+		if !allowed {
+			decisionLogger.Warnf("Authorization denied for %s %s", r.Method, requestPath(r))
+			a.options.ErrorResponder(w, r, http.StatusForbidden, a.options.MessageID, nil)
+			return
+		}
+		decisionLogger.Infof("Authorization allowed for %s %s", r.Method, requestPath(r))
+
+		// call next
+		next.ServeHTTP(w, r)
+	})
+}
+
+// evaluate returns the decision for the request with the deciding policy and the reason
+func (a *Authorizer) evaluate(r *http.Request) (bool, string, string) {
+	a.mu.RLock()
+	set := a.set
+	a.mu.RUnlock()
+
+	attributes := requestAttributes{params: mux.Vars(r), claims: GetClaims(r)}
+	applied := []string{}
+	for _, policy := range set.Policies {
+		if !policy.Matches(r) || !attributes.holdAll(policy.When) {
+			continue
+		}
+		if reason := attributes.deniedBy(policy); reason != "" {
+			return false, policy.Name, reason
+		}
+		applied = append(applied, policy.Name)
+	}
+
+	if len(applied) == 0 {
+		if set.DefaultAllow {
+			return true, "", "no policy applies"
+		}
+		return false, "", "no policy applies"
+	}
+	return true, strings.Join(applied, ","), "all policies satisfied"
+}
+
+type requestAttributes struct {
+	params map[string]string
+	claims *Claims
+}
+
+// deniedBy returns why the policy denies the request, or an empty string when it is allowed
+func (ra requestAttributes) deniedBy(policy AuthorizationPolicy) string {
+	if (len(policy.Roles) > 0 || len(policy.Scopes) > 0 || len(policy.Conditions) > 0) && ra.claims == nil {
+		return "request is not authenticated"
+	}
+	if len(policy.Roles) > 0 {
+		hasRole := false
+		for _, role := range ra.claims.Roles {
+			if containsString(policy.Roles, role) {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			return "missing role"
+		}
+	}
+	for _, scope := range policy.Scopes {
+		if !containsString(ra.claims.Scopes(), scope) {
+			return "missing scope " + scope
+		}
+	}
+	for _, condition := range policy.Conditions {
+		if !ra.holds(condition) {
+			return "condition on " + condition.Attribute + " failed"
+		}
+	}
+	return ""
+}
+
+func (ra requestAttributes) holdAll(conditions []AuthorizationCondition) bool {
+	for _, condition := range conditions {
+		if !ra.holds(condition) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ra requestAttributes) holds(condition AuthorizationCondition) bool {
+	values, present := ra.lookup(condition.Attribute)
+	expected := condition.Values
+	if condition.ValueFrom != "" {
+		expected, _ = ra.lookup(condition.ValueFrom)
+	}
+
+	switch condition.Operator {
+	case OperatorPresent:
+		return present
+	case OperatorEquals, OperatorIn:
+		return present && intersects(values, expected)
+	case OperatorNotEquals, OperatorNotIn:
+		return present && !intersects(values, expected)
+	default:
+		return false
+	}
+}
+
+// lookup returns the attribute values as strings, list claims return every element
+func (ra requestAttributes) lookup(attribute string) ([]string, bool) {
+	switch {
+	case strings.HasPrefix(attribute, "param."):
+		value, ok := ra.params[strings.TrimPrefix(attribute, "param.")]
+		return []string{value}, ok
+	case strings.HasPrefix(attribute, "claim.") && ra.claims != nil:
+		var current interface{} = ra.claims.Raw
+		for _, name := range strings.Split(strings.TrimPrefix(attribute, "claim."), ".") {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = object[name]; !ok {
+				return nil, false
+			}
+		}
+		if list, ok := current.([]interface{}); ok {
+			values := make([]string, 0, len(list))
+			for _, item := range list {
+				values = append(values, fmt.Sprint(item))
+			}
+			return values, true
+		}
+		return []string{fmt.Sprint(current)}, true
+	default:
+		return nil, false
+	}
+}
+
+func intersects(values []string, expected []string) bool {
+	for _, value := range values {
+		if containsString(expected, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicyFile = `{
+  "policies": [
+    {
+      "name": "patch-cam-assets",
+      "route": "/api/assets/{type}/{id}",
+      "methods": ["PATCH"],
+      "when": [{"attribute": "param.type", "operator": "equals", "values": ["CAM"]}],
+      "roles": ["cam-admin"]
+    },
+    {
+      "name": "patch-assets",
+      "route": "/api/assets/{type}/{id}",
+      "methods": ["PATCH"],
+      "scopes": ["assets:write"],
+      "conditions": [{"attribute": "claim.org.id", "operator": "equals", "valueFrom": "param.id"}]
+    },
+    {
+      "name": "read-assets",
+      "route": "/api/assets/{type}/{id}",
+      "methods": ["GET"]
+    }
+  ]
+}`
+
+func writePolicyFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "policies.json")
+	ioutil.WriteFile(file, []byte(content), 0600)
+	return file
+}
+
+func setupAuthorizationRouter(t *testing.T, options AuthorizationOptions, buffer *bytes.Buffer, claims *Claims) *mux.Router {
+	authorizer, err := NewAuthorizer(options, newBufferedLogger(buffer))
+	if err != nil {
+		t.Fatalf("Not expecting error creating authorizer: %v", err)
+	}
+	t.Cleanup(authorizer.Close)
+
+	appRouter := mux.NewRouter()
+	appRouter.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), ContextClaimsKey, claims))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	appRouter.Use(authorizer.Middleware())
+	appRouter.HandleFunc("/api/assets/{type}/{id}", successHandler).Methods("GET", "PATCH")
+	appRouter.HandleFunc("/api/other", successHandler)
+	return appRouter
+}
+
+func testClaims(roles []string, scope string, orgID string) *Claims {
+	return &Claims{
+		Subject: "user-1",
+		Roles:   roles,
+		Scope:   scope,
+		Raw:     map[string]interface{}{"sub": "user-1", "org": map[string]interface{}{"id": orgID}},
+	}
+}
+
+func authorizationStatus(appRouter *mux.Router, method string, target string) int {
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w.Code
+}
+
+func Test_Authorization_Evaluates_Roles_Scopes_And_Conditions(t *testing.T) {
+	file := writePolicyFile(t, testPolicyFile)
+
+	admin := setupAuthorizationRouter(t, AuthorizationOptions{PolicyFile: file}, &bytes.Buffer{}, testClaims([]string{"cam-admin"}, "assets:write", "42"))
+	assert.Equal(t, http.StatusOK, authorizationStatus(admin, "PATCH", "/api/assets/CAM/42"))
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(admin, "PATCH", "/api/assets/CAM/43"), "Condition on org id should fail")
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(admin, "GET", "/api/other"), "Requests without policy are denied by default")
+
+	writer := setupAuthorizationRouter(t, AuthorizationOptions{PolicyFile: file}, &bytes.Buffer{}, testClaims([]string{"viewer"}, "assets:write", "42"))
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(writer, "PATCH", "/api/assets/CAM/42"), "CAM assets need the cam-admin role")
+	assert.Equal(t, http.StatusOK, authorizationStatus(writer, "PATCH", "/api/assets/SWITCH/42"))
+
+	reader := setupAuthorizationRouter(t, AuthorizationOptions{PolicyFile: file}, &bytes.Buffer{}, testClaims(nil, "assets:read", "42"))
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(reader, "PATCH", "/api/assets/SWITCH/42"), "Missing scope")
+	assert.Equal(t, http.StatusOK, authorizationStatus(reader, "GET", "/api/assets/SWITCH/42"))
+
+	anonymous := setupAuthorizationRouter(t, AuthorizationOptions{PolicyFile: file}, &bytes.Buffer{}, nil)
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(anonymous, "PATCH", "/api/assets/SWITCH/42"))
+}
+
+func Test_Authorization_Negated_Conditions_Fail_On_Missing_Attribute(t *testing.T) {
+	options := AuthorizationOptions{Policies: &AuthorizationPolicySet{Policies: []AuthorizationPolicy{{
+		Name:         "no-guests",
+		RouteMatcher: RouteMatcher{Route: "/api/other"},
+		Conditions: []AuthorizationCondition{
+			{Attribute: "claim.role", Operator: OperatorNotIn, Values: []string{"guest"}},
+			{Attribute: "claim.org.id", Operator: OperatorNotEquals, Values: []string{"0"}},
+		},
+	}}}}
+
+	member := testClaims(nil, "", "42")
+	member.Raw["role"] = "member"
+	assert.Equal(t, http.StatusOK, authorizationStatus(setupAuthorizationRouter(t, options, &bytes.Buffer{}, member), "GET", "/api/other"))
+
+	guest := testClaims(nil, "", "42")
+	guest.Raw["role"] = "guest"
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(setupAuthorizationRouter(t, options, &bytes.Buffer{}, guest), "GET", "/api/other"))
+
+	missing := testClaims(nil, "", "42")
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(setupAuthorizationRouter(t, options, &bytes.Buffer{}, missing), "GET", "/api/other"),
+		"A token without the role claim should not satisfy notIn")
+}
+
+func Test_Authorization_Logs_Every_Decision_And_Uses_Responder(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	var messageID string
+	appRouter := setupAuthorizationRouter(t, AuthorizationOptions{
+		Policies: &AuthorizationPolicySet{DefaultAllow: true, Policies: []AuthorizationPolicy{
+			{Name: "admins-only", RouteMatcher: RouteMatcher{Route: "/api/other"}, Roles: []string{"admin"}},
+		}},
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, templateData map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	}, buffer, testClaims([]string{"viewer"}, "", ""))
+
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(appRouter, "GET", "/api/other"))
+	assert.Equal(t, http.StatusOK, authorizationStatus(appRouter, "GET", "/api/assets/CAM/1"), "Default allow applies without policy")
+	assert.Equal(t, ForbiddenMessageID, messageID)
+
+	entries := readLogEntries(t, buffer)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "deny", entries[0]["authz-decision"])
+	assert.Equal(t, "admins-only", entries[0]["authz-policy"])
+	assert.Equal(t, "missing role", entries[0]["authz-reason"])
+	assert.Equal(t, "user-1", entries[0]["authz-subject"])
+	assert.Equal(t, "allow", entries[1]["authz-decision"])
+}
+
+func Test_Authorization_Reloads_Policy_File(t *testing.T) {
+	file := writePolicyFile(t, `{"policies":[]}`)
+	appRouter := setupAuthorizationRouter(t, AuthorizationOptions{PolicyFile: file, ReloadInterval: 10 * time.Millisecond}, &bytes.Buffer{}, testClaims(nil, "", ""))
+	assert.Equal(t, http.StatusForbidden, authorizationStatus(appRouter, "GET", "/api/other"))
+
+	ioutil.WriteFile(file, []byte(`{"defaultAllow":true}`), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(file, future, future)
+
+	assert.Eventually(t, func() bool {
+		return authorizationStatus(appRouter, "GET", "/api/other") == http.StatusOK
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func Test_Authorization_Rejects_Invalid_Policies(t *testing.T) {
+	_, err := LoadAuthorizationPolicies(writePolicyFile(t, `{"policies":[{"name":"p","conditions":[{"attribute":"param.x","operator":"like"}]}]}`))
+	assert.Error(t, err)
+
+	_, err = LoadAuthorizationPolicies(writePolicyFile(t, `{"policies":[{"name":"p","when":[{"attribute":"header.x","operator":"present"}]}]}`))
+	assert.Error(t, err)
+
+	_, err = NewAuthorizer(AuthorizationOptions{}, newBufferedLogger(&bytes.Buffer{}))
+	assert.Error(t, err)
+}
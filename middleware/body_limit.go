@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+const (
+	// PayloadTooLargeMessageID is the message id used for request bodies over the size limit
+	PayloadTooLargeMessageID = "PAYLOAD_TOO_LARGE"
+	// UnsupportedMediaTypeMessageID is the message id used for request bodies with an unsupported Content-Type
+	UnsupportedMediaTypeMessageID = "UNSUPPORTED_MEDIA_TYPE"
+	// BadRequestMessageID is the message id used for malformed requests
+	BadRequestMessageID = "BAD_REQUEST"
+)
+
+// DefaultMaxBodySize is the default size limit of the request bodies
+const DefaultMaxBodySize int64 = 1024 * 1024
+
+// DefaultAllowedContentTypes are the default media types accepted for the bodies of mutating requests
+var DefaultAllowedContentTypes = []string{"application/json"}
+
+// RouteBodyLimit applies its limits to the requests selected by its RouteMatcher
+type RouteBodyLimit struct {
+	RouteMatcher
+	// MaxBodySize overrides the size limit of the options for the route when not zero
+	MaxBodySize int64
+	// AllowedContentTypes overrides the media types of the options for the route when not empty
+	AllowedContentTypes []string
+}
+
+// BodyLimitOptions configures the body limit middleware
+type BodyLimitOptions struct {
+	// MaxBodySize is the size limit of the request bodies in bytes, DefaultMaxBodySize when zero
+	MaxBodySize int64
+	// AllowedContentTypes are the media types accepted for the bodies of POST, PUT and PATCH requests, either
+	// exact ("application/json") or by type ("text/*"), DefaultAllowedContentTypes when empty
+	AllowedContentTypes []string
+	// Routes are the per-route limits, the first matching one is applied
+	Routes []RouteBodyLimit
+	// ErrorResponder writes the 400, 413 and 415 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// TooLargeMessageID is the message id of the 413 responses, PayloadTooLargeMessageID when empty
+	TooLargeMessageID string
+	// UnsupportedMessageID is the message id of the 415 responses, UnsupportedMediaTypeMessageID when empty
+	UnsupportedMessageID string
+}
+
+// BodyLimitMiddleware is a gorilla mux middleware enforcing the request body size and Content-Type
+func BodyLimitMiddleware(options BodyLimitOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	limiter := newBodyLimiter(options, logger)
+	return func(next http.Handler) http.Handler {
+		return limiter.handler(next)
+	}
+}
+
+// BodyLimitWrapper rejects the requests with a body over the size limit with a 413, and the mutating requests
+// with a body of an unsupported Content-Type with a 415. Bodies of unknown length are read up to the limit
+// before calling the handler, so oversize requests never reach it.
+func BodyLimitWrapper(next http.Handler, options BodyLimitOptions, logger log.LoggerType) http.Handler {
+	return newBodyLimiter(options, logger).handler(next)
+}
+
+type bodyLimiter struct {
+	options BodyLimitOptions
+	logger  log.LoggerType
+}
+
+// newBodyLimiter applies the option defaults
+func newBodyLimiter(options BodyLimitOptions, logger log.LoggerType) *bodyLimiter {
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = DefaultMaxBodySize
+	}
+	if len(options.AllowedContentTypes) == 0 {
+		options.AllowedContentTypes = DefaultAllowedContentTypes
+	}
+	if options.TooLargeMessageID == "" {
+		options.TooLargeMessageID = PayloadTooLargeMessageID
+	}
+	if options.UnsupportedMessageID == "" {
+		options.UnsupportedMessageID = UnsupportedMediaTypeMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	return &bodyLimiter{options: options, logger: logger}
+}
+
+func (l *bodyLimiter) handler(next http.Handler) http.Handler {
+	options := l.options
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		maxBodySize, contentTypes := options.limitsFor(r)
+
+		if isMutatingMethod(r.Method) && !allowedContentType(r.Header.Get(contentTypeHeader), contentTypes) {
+			l.logger.Warnf("Rejected request %s %s with unsupported content type %q", r.Method, requestURI(r), r.Header.Get(contentTypeHeader))
+			options.ErrorResponder(w, r, http.StatusUnsupportedMediaType, options.UnsupportedMessageID,
+				map[string]string{"ContentType": r.Header.Get(contentTypeHeader), "Allowed": strings.Join(contentTypes, ", ")})
+			return
+		}
+
+		tooLarge := func() {
+			l.logger.Warnf("Rejected request %s %s with a body over %d bytes", r.Method, requestURI(r), maxBodySize)
+			options.ErrorResponder(w, r, http.StatusRequestEntityTooLarge, options.TooLargeMessageID,
+				map[string]string{"MaxBodySize": strconv.FormatInt(maxBodySize, 10)})
+		}
+		if r.ContentLength > maxBodySize {
+			tooLarge()
+			return
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxBodySize)
+		if r.ContentLength < 0 {
+			// the length is unknown, read the body now so the handler only sees it when it is within the limit
+			data, err := ioutil.ReadAll(body)
+			body.Close()
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					tooLarge()
+					return
+				}
+				l.logger.Warnf("Failed reading the body of request %s %s: %v", r.Method, requestURI(r), err)
+				options.ErrorResponder(w, r, http.StatusBadRequest, BadRequestMessageID, nil)
+				return
+			}
+			r.ContentLength = int64(len(data))
+			body = ioutil.NopCloser(bytes.NewReader(data))
+		}
+		r.Body = body
+
+		// call next
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitsFor returns the size limit and the allowed media types of the request
+func (o BodyLimitOptions) limitsFor(r *http.Request) (int64, []string) {
+	for i := range o.Routes {
+		route := &o.Routes[i]
+		if route.Matches(r) {
+			maxBodySize, contentTypes := o.MaxBodySize, o.AllowedContentTypes
+			if route.MaxBodySize != 0 {
+				maxBodySize = route.MaxBodySize
+			}
+			if len(route.AllowedContentTypes) > 0 {
+				contentTypes = route.AllowedContentTypes
+			}
+			return maxBodySize, contentTypes
+		}
+	}
+	return o.MaxBodySize, o.AllowedContentTypes
+}
+
+func isMutatingMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// allowedContentType reports whether the media type of the Content-Type header matches one of the allowed types
+func allowedContentType(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range allowed {
+		candidate = strings.ToLower(candidate)
+		if candidate == mediaType || candidate == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(candidate, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(candidate, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupBodyLimitRouter(options BodyLimitOptions) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(BodyLimitMiddleware(options, log.NewLogger("", "")))
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write(body)
+	}
+	appRouter.HandleFunc("/api/assets", echo)
+	appRouter.HandleFunc("/api/uploads", echo)
+	return appRouter
+}
+
+func bodyRequest(appRouter *mux.Router, method string, target string, contentType string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set(contentTypeHeader, contentType)
+	}
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w
+}
+
+func Test_BodyLimit_Rejects_Oversize_Body(t *testing.T) {
+	var messageID string
+	var templateData map[string]string
+	appRouter := setupBodyLimitRouter(BodyLimitOptions{
+		MaxBodySize: 8,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID, templateData = id, data
+			w.WriteHeader(status)
+		},
+	})
+
+	w := bodyRequest(appRouter, "POST", "/api/assets", "application/json", `{"a":1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"a":1}`, w.Body.String())
+
+	w = bodyRequest(appRouter, "POST", "/api/assets", "application/json", `{"a":"too long"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, PayloadTooLargeMessageID, messageID)
+	assert.Equal(t, "8", templateData["MaxBodySize"])
+}
+
+func Test_BodyLimit_Rejects_Oversize_Body_Of_Unknown_Length(t *testing.T) {
+	appRouter := setupBodyLimitRouter(BodyLimitOptions{MaxBodySize: 8})
+
+	req := httptest.NewRequest("PUT", "/api/assets", strings.NewReader(`{"a":"too long"}`))
+	req.Header.Set(contentTypeHeader, "application/json")
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	req = httptest.NewRequest("PUT", "/api/assets", strings.NewReader(`{"a":1}`))
+	req.Header.Set(contentTypeHeader, "application/json")
+	req.ContentLength = -1
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"a":1}`, w.Body.String())
+}
+
+func Test_BodyLimit_Rejects_Unsupported_Content_Type(t *testing.T) {
+	var messageID string
+	appRouter := setupBodyLimitRouter(BodyLimitOptions{
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	})
+
+	assert.Equal(t, http.StatusOK, bodyRequest(appRouter, "POST", "/api/assets", "application/json; charset=utf-8", `{}`).Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, bodyRequest(appRouter, "POST", "/api/assets", "text/plain", `{}`).Code)
+	assert.Equal(t, UnsupportedMediaTypeMessageID, messageID)
+	assert.Equal(t, http.StatusUnsupportedMediaType, bodyRequest(appRouter, "PATCH", "/api/assets", "", `{}`).Code, "A body without Content-Type should be rejected")
+	assert.Equal(t, http.StatusOK, bodyRequest(appRouter, "POST", "/api/assets", "", "").Code, "Requests without body are not checked")
+	assert.Equal(t, http.StatusOK, bodyRequest(appRouter, "DELETE", "/api/assets", "text/plain", "x").Code, "Only mutating methods are checked")
+}
+
+func Test_BodyLimit_Per_Route_Limits(t *testing.T) {
+	appRouter := setupBodyLimitRouter(BodyLimitOptions{
+		MaxBodySize: 8,
+		Routes: []RouteBodyLimit{
+			{RouteMatcher: RouteMatcher{Route: "/api/uploads", Methods: []string{"POST"}}, MaxBodySize: 64, AllowedContentTypes: []string{"text/*"}},
+		},
+	})
+
+	assert.Equal(t, http.StatusOK, bodyRequest(appRouter, "POST", "/api/uploads", "text/csv", "a,b,c\n1,2,3\n").Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, bodyRequest(appRouter, "POST", "/api/uploads", "application/json", `{}`).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyRequest(appRouter, "POST", "/api/assets", "application/json", `{"a":"too long"}`).Code)
+}
@@ -0,0 +1,342 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+const (
+	// ExpiresHeader represents the Expires Header param
+	ExpiresHeader = "Expires"
+	// AgeHeader represents the Age Header param
+	AgeHeader = "Age"
+	// XCacheHeader tells whether the response was served by the response cache, see the CacheStatus values
+	XCacheHeader = "X-Cache"
+	// authorizationHeader represents the Authorization Header param
+	authorizationHeader = "Authorization"
+)
+
+const (
+	// CacheStatusHit is the X-Cache of a fresh response served by the response cache
+	CacheStatusHit = "HIT"
+	// CacheStatusStale is the X-Cache of a stale response served by the response cache while it is revalidated
+	CacheStatusStale = "STALE"
+	// CacheStatusMiss is the X-Cache of a cacheable response served by the handler
+	CacheStatusMiss = "MISS"
+)
+
+// DefaultRevalidationTimeout bounds the background revalidations of the stale responses by default
+const DefaultRevalidationTimeout = 30 * time.Second
+
+// cacheExcludedHeaders are the response headers not stored, they belong to the request that got the response
+var cacheExcludedHeaders = []string{RequestIDHeader, "Date", "Set-Cookie", ServerTimingHeader}
+
+// CachePolicy is the caching policy of a route
+type CachePolicy struct {
+	// MaxAge is how long clients and the response cache keep the response, it sets max-age and Expires
+	MaxAge time.Duration
+	// SharedMaxAge is how long shared caches keep the response, s-maxage is not set when zero
+	SharedMaxAge time.Duration
+	// Public lets shared caches keep the response, and lets the response cache serve the requests with an
+	// Authorization header. The response is private otherwise.
+	Public bool
+	// StaleWhileRevalidate is how long a stale response is served while it is revalidated in the background
+	StaleWhileRevalidate time.Duration
+	// Immutable tells clients the response never changes while fresh
+	Immutable bool
+}
+
+// CacheControl returns the Cache-Control value of the policy
+func (p CachePolicy) CacheControl() string {
+	directives := []string{"private"}
+	if p.Public {
+		directives[0] = "public"
+	}
+	directives = append(directives, "max-age="+seconds(p.MaxAge))
+	if p.SharedMaxAge > 0 {
+		directives = append(directives, "s-maxage="+seconds(p.SharedMaxAge))
+	}
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+seconds(p.StaleWhileRevalidate))
+	}
+	if p.Immutable {
+		directives = append(directives, "immutable")
+	}
+	return strings.Join(directives, ", ")
+}
+
+// RouteCachePolicy applies the policy to the GET and HEAD requests selected by its RouteMatcher
+type RouteCachePolicy struct {
+	RouteMatcher
+	Policy CachePolicy
+}
+
+// CacheOptions configures the cache middleware
+type CacheOptions struct {
+	// Routes are the per-route policies, the first matching one is applied. The responses of the other routes keep
+	// the Cache-Control of the security headers.
+	Routes []RouteCachePolicy
+	// Store enables the response cache for the routes, nil only sets the headers
+	Store *ResponseCache
+	// VaryHeaders are request headers the stored responses always vary on, on top of the locale and the Vary set
+	// by the handler
+	VaryHeaders []string
+	// RevalidationTimeout bounds the background revalidations, DefaultRevalidationTimeout when zero
+	RevalidationTimeout time.Duration
+}
+
+// CacheMiddleware is a gorilla mux middleware applying the route cache policies
+func CacheMiddleware(options CacheOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	cache := newCacheHandler(options, logger)
+	return func(next http.Handler) http.Handler {
+		return cache.handler(next)
+	}
+}
+
+// CacheWrapper replaces the Cache-Control, Pragma and Expires of the GET and HEAD responses of the routes with a
+// cache policy, which must be registered inside the security headers. With a Store, the successful responses are
+// kept for the max-age of their policy, keyed by URL, locale, VaryHeaders and the request headers the handler
+// listed in Vary, and served with an Age and X-Cache header. A stale response is served during the
+// stale-while-revalidate of its policy while a single background request refreshes it. Only the headers set by the
+// handler are stored, the headers of the outer layers are set again for every request. Responses setting a
+// cookie or no-store, responses of a public policy made private, and requests with an Authorization header under a
+// private policy are not stored.
+func CacheWrapper(next http.Handler, options CacheOptions, logger log.LoggerType) http.Handler {
+	return newCacheHandler(options, logger).handler(next)
+}
+
+type cacheHandler struct {
+	options CacheOptions
+	logger  log.LoggerType
+}
+
+// newCacheHandler applies the option defaults
+func newCacheHandler(options CacheOptions, logger log.LoggerType) *cacheHandler {
+	if options.RevalidationTimeout <= 0 {
+		options.RevalidationTimeout = DefaultRevalidationTimeout
+	}
+	return &cacheHandler{options: options, logger: logger}
+}
+
+func (c *cacheHandler) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := c.policy(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Set(CacheControlHeader, policy.CacheControl())
+		header.Del(PragmaHeader)
+
+		store := c.options.Store
+		if store == nil || policy.MaxAge <= 0 || (!policy.Public && r.Header.Get(authorizationHeader) != "") {
+			header.Set(ExpiresHeader, time.Now().Add(policy.MaxAge).UTC().Format(http.TimeFormat))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		base := c.baseKey(r)
+		if !strings.Contains(r.Header.Get(CacheControlHeader), "no-cache") {
+			if entry, ok := store.lookup(store.variantKey(base, r)); ok {
+				c.serveStored(w, r, next, store, base, policy, entry)
+				return
+			}
+		}
+		if r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header.Set(ExpiresHeader, time.Now().Add(policy.MaxAge).UTC().Format(http.TimeFormat))
+		header.Set(XCacheHeader, CacheStatusMiss)
+		recorder := newCacheRecorder(w, store.options.MaxEntrySize)
+		// call next
+		next.ServeHTTP(wrapResponseWriter(recorder, w), r)
+		c.store(store, base, policy, r, recorder)
+	})
+}
+
+// policy returns the cache policy of a GET or HEAD request, false when its route has none
+func (c *cacheHandler) policy(r *http.Request) (CachePolicy, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return CachePolicy{}, false
+	}
+	for i := range c.options.Routes {
+		if c.options.Routes[i].Matches(r) {
+			return c.options.Routes[i].Policy, true
+		}
+	}
+	return CachePolicy{}, false
+}
+
+// baseKey keys the responses by URL, locale and the configured request headers
+func (c *cacheHandler) baseKey(r *http.Request) string {
+	locale, _ := r.Context().Value(ContextLangKey).(string)
+	return varyKey(r.URL.RequestURI()+"\n"+locale, c.options.VaryHeaders, r)
+}
+
+// serveStored writes the stored response, and revalidates it in the background when it is stale
+func (c *cacheHandler) serveStored(w http.ResponseWriter, r *http.Request, next http.Handler, store *ResponseCache, base string, policy CachePolicy, entry *cacheEntry) {
+	now := store.now()
+	status := CacheStatusHit
+	if !now.Before(entry.expires) {
+		status = CacheStatusStale
+		if store.startRevalidation(entry) {
+			go c.revalidate(next, store, base, policy, r, entry)
+		}
+	}
+
+	header := w.Header()
+	for name, values := range entry.header {
+		if name == VaryHeader {
+			header[name] = append(header[name], values...)
+		} else {
+			header[name] = values
+		}
+	}
+	header.Set(ExpiresHeader, entry.expires.UTC().Format(http.TimeFormat))
+	header.Set(AgeHeader, strconv.Itoa(int(now.Sub(entry.stored)/time.Second)))
+	header.Set(XCacheHeader, status)
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
+
+// revalidate refreshes the stale entry with a detached copy of the request
+func (c *cacheHandler) revalidate(next http.Handler, store *ResponseCache, base string, policy CachePolicy, r *http.Request, entry *cacheEntry) {
+	ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, c.options.RevalidationTimeout)
+	defer cancel()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			c.logger.Errorf("Revalidating %s panicked: %v", requestURI(r), recovered)
+			store.endRevalidation(entry)
+		}
+	}()
+
+	req := r.Clone(ctx)
+	req.Method = http.MethodGet
+	recorder := newCacheRecorder(&bufferedResponse{header: http.Header{}}, store.options.MaxEntrySize)
+	next.ServeHTTP(recorder, req)
+	if !c.store(store, base, policy, req, recorder) {
+		c.logger.Warnf("Revalidating %s returned an uncacheable response with status %d, serving the stale response", requestURI(r), recorder.status)
+		store.endRevalidation(entry)
+	}
+}
+
+// store keeps the recorded response when it is cacheable, and reports whether it was kept
+func (c *cacheHandler) store(store *ResponseCache, base string, policy CachePolicy, r *http.Request, recorder *cacheRecorder) bool {
+	header := recorder.Header()
+	cacheControl := header.Get(CacheControlHeader)
+	if recorder.status != http.StatusOK || recorder.overflow || recorder.streaming || header.Get("Set-Cookie") != "" ||
+		strings.Contains(cacheControl, "no-store") || (policy.Public && strings.Contains(cacheControl, "private")) {
+		return false
+	}
+	var vary []string
+	for _, value := range recorder.handlerHeader().Values(VaryHeader) {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name == "*" {
+				return false
+			} else if name != "" && !containsFold(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	now := store.now()
+	store.store(base, vary, r, &cacheEntry{
+		path:       requestPath(r),
+		status:     recorder.status,
+		header:     recorder.handlerHeader(),
+		body:       recorder.body.Bytes(),
+		stored:     now,
+		expires:    now.Add(policy.MaxAge),
+		staleUntil: now.Add(policy.MaxAge + policy.StaleWhileRevalidate),
+	})
+	return true
+}
+
+// cacheRecorder writes through while keeping a copy of the response and of the headers before the handler ran
+type cacheRecorder struct {
+	http.ResponseWriter
+	before    http.Header
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	maxSize   int64
+	overflow  bool
+	streaming bool
+}
+
+func newCacheRecorder(w http.ResponseWriter, maxSize int64) *cacheRecorder {
+	return &cacheRecorder{ResponseWriter: w, before: w.Header().Clone(), maxSize: maxSize}
+}
+
+func (w *cacheRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.maxSize {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheRecorder) Flush() {
+	w.streaming = true
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// handlerHeader returns the response headers set by the handler, the values it added for the headers the outer
+// layers set
+func (w *cacheRecorder) handlerHeader() http.Header {
+	header := http.Header{}
+	for name, values := range w.header {
+		before := w.before[name]
+		switch {
+		case len(values) > len(before) && strings.Join(values[:len(before)], "\n") == strings.Join(before, "\n"):
+			header[name] = append([]string(nil), values[len(before):]...)
+		case strings.Join(values, "\n") != strings.Join(before, "\n"):
+			header[name] = values
+		}
+	}
+	for _, name := range append(cacheExcludedHeaders, CacheControlHeader, ExpiresHeader, XCacheHeader) {
+		header.Del(name)
+	}
+	return header
+}
+
+// detachedContext keeps the values of the request context without its cancellation
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func seconds(duration time.Duration) string {
+	return strconv.FormatInt(int64(duration/time.Second), 10)
+}
@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/language"
+)
+
+var referencePolicy = CachePolicy{MaxAge: time.Minute, Public: true, StaleWhileRevalidate: 30 * time.Second}
+
+func setupCacheRouter(options CacheOptions, handler http.HandlerFunc) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(SecurityPolicyMiddleware(DefaultSecurityPolicy()))
+	cors, _ := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}})
+	appRouter.Use(cors.Middleware())
+	appRouter.Use(CacheMiddleware(options, log.NewLogger("", "")))
+	appRouter.HandleFunc("/api/standards/defaults", handler)
+	appRouter.HandleFunc("/api/assets", handler)
+	return appRouter
+}
+
+func cachedRequest(appRouter *mux.Router, method string, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w
+}
+
+func Test_Cache_Policy_Headers(t *testing.T) {
+	appRouter := setupCacheRouter(CacheOptions{Routes: []RouteCachePolicy{
+		{RouteMatcher: RouteMatcher{Route: "/api/standards/defaults"}, Policy: CachePolicy{MaxAge: time.Hour, SharedMaxAge: 2 * time.Hour, Immutable: true}},
+	}}, successHandler)
+
+	w := cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults", nil)
+	assert.Equal(t, "private, max-age=3600, s-maxage=7200, immutable", w.Header().Get(CacheControlHeader))
+	assert.Empty(t, w.Header().Get(PragmaHeader))
+	expires, err := http.ParseTime(w.Header().Get(ExpiresHeader))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, 2*time.Second)
+	assert.Empty(t, w.Header().Get(XCacheHeader), "no response cache is configured")
+
+	w = cachedRequest(appRouter, http.MethodGet, "/api/assets", nil)
+	assert.Equal(t, "no-store", w.Header().Get(CacheControlHeader), "routes without policy keep the security headers")
+}
+
+func Test_Cache_Serves_Stored_Responses(t *testing.T) {
+	var calls int32
+	store := NewResponseCache(ResponseCacheOptions{})
+	appRouter := setupCacheRouter(CacheOptions{Store: store, Routes: []RouteCachePolicy{
+		{RouteMatcher: RouteMatcher{Route: "/api/standards/defaults"}, Policy: referencePolicy},
+	}}, func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(RequestIDHeader, fmt.Sprint(call))
+		fmt.Fprintf(w, `{"call":%d}`, call)
+	})
+
+	w := cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults", map[string]string{OriginHeader: "https://a.example.com"})
+	assert.Equal(t, CacheStatusMiss, w.Header().Get(XCacheHeader))
+	assert.Equal(t, `{"call":1}`, w.Body.String())
+
+	w = cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults", map[string]string{OriginHeader: "https://b.example.com"})
+	assert.Equal(t, CacheStatusHit, w.Header().Get(XCacheHeader))
+	assert.Equal(t, `{"call":1}`, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "0", w.Header().Get(AgeHeader))
+	assert.Empty(t, w.Header().Get(RequestIDHeader), "the request id of the first request is not replayed")
+	assert.Equal(t, "nosniff", w.Header().Get(OptionsContentTypeHeader), "the outer layers still run")
+	assert.Equal(t, "public, max-age=60, stale-while-revalidate=30", w.Header().Get(CacheControlHeader))
+
+	w = cachedRequest(appRouter, http.MethodHead, "/api/standards/defaults", nil)
+	assert.Equal(t, CacheStatusHit, w.Header().Get(XCacheHeader))
+	assert.Empty(t, w.Body.String())
+
+	w = cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults?type=CAM", nil)
+	assert.Equal(t, CacheStatusMiss, w.Header().Get(XCacheHeader), "the query is part of the key")
+
+	w = cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults", map[string]string{CacheControlHeader: "no-cache"})
+	assert.Equal(t, `{"call":3}`, w.Body.String(), "no-cache refreshes the response")
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	stats := store.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, uint64(2), stats.Hits)
+}
+
+func Test_Cache_Keys_By_Vary_And_Locale(t *testing.T) {
+	var calls int32
+	store := NewResponseCache(ResponseCacheOptions{})
+	appRouter := mux.NewRouter()
+	appRouter.Use(LocaleSelectionMiddleware(i18n.NewBundle(language.English),
+		language.NewMatcher([]language.Tag{language.English, language.German}), log.NewLogger("", "")))
+	appRouter.Use(CacheMiddleware(CacheOptions{Store: store, Routes: []RouteCachePolicy{{Policy: referencePolicy}}}, log.NewLogger("", "")))
+	appRouter.HandleFunc("/api/standards/defaults", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Add(VaryHeader, "X-Tenant")
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Tenant"), r.Context().Value(ContextLangKey))
+	})
+
+	requests := []map[string]string{
+		{"X-Tenant": "a", AcceptLanguageHeader: "en-US"},
+		{"X-Tenant": "b", AcceptLanguageHeader: "en-US"},
+		{"X-Tenant": "a", AcceptLanguageHeader: "de"},
+	}
+	for _, headers := range requests {
+		cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults", headers)
+	}
+	for _, headers := range requests {
+		w := cachedRequest(appRouter, http.MethodGet, "/api/standards/defaults", headers)
+		assert.Equal(t, CacheStatusHit, w.Header().Get(XCacheHeader))
+		assert.Equal(t, []string{AcceptLanguageHeader, "X-Tenant"}, w.Header().Values(VaryHeader))
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func Test_Cache_Skips_Uncacheable_Responses(t *testing.T) {
+	var calls int32
+	store := NewResponseCache(ResponseCacheOptions{MaxEntrySize: 16})
+	appRouter := setupCacheRouter(CacheOptions{Store: store, Routes: []RouteCachePolicy{{Policy: referencePolicy}}},
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			switch r.URL.Query().Get("case") {
+			case "cookie":
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "1"})
+			case "error":
+				w.WriteHeader(http.StatusInternalServerError)
+			case "large":
+				w.Write([]byte("a body larger than the entry size"))
+				return
+			case "no-store":
+				w.Header().Set(CacheControlHeader, "no-store")
+			}
+			w.Write([]byte("ok"))
+		})
+
+	for _, query := range []string{"cookie", "error", "large", "no-store"} {
+		for i := 0; i < 2; i++ {
+			w := cachedRequest(appRouter, http.MethodGet, "/api/assets?case="+query, nil)
+			assert.NotEqual(t, CacheStatusHit, w.Header().Get(XCacheHeader), query)
+		}
+	}
+	cachedRequest(appRouter, http.MethodGet, "/api/assets", map[string]string{"Authorization": "Bearer token"})
+	assert.Equal(t, 1, store.Stats().Entries, "public responses are stored for authenticated requests")
+	assert.Equal(t, int32(9), atomic.LoadInt32(&calls))
+
+	private := setupCacheRouter(CacheOptions{Store: store, Routes: []RouteCachePolicy{{Policy: CachePolicy{MaxAge: time.Minute}}}}, successHandler)
+	store.PurgeAll()
+	cachedRequest(private, http.MethodGet, "/api/assets", map[string]string{"Authorization": "Bearer token"})
+	assert.Equal(t, 0, store.Stats().Entries, "private responses are not stored for authenticated requests")
+}
+
+func Test_Cache_Stale_While_Revalidate(t *testing.T) {
+	var calls int32
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := NewResponseCache(ResponseCacheOptions{})
+	store.now = func() time.Time { return now }
+	revalidated := make(chan struct{}, 1)
+	appRouter := setupCacheRouter(CacheOptions{Store: store, Routes: []RouteCachePolicy{{Policy: referencePolicy}}},
+		func(w http.ResponseWriter, r *http.Request) {
+			call := atomic.AddInt32(&calls, 1)
+			fmt.Fprintf(w, "call %d", call)
+			if call > 1 {
+				revalidated <- struct{}{}
+			}
+		})
+
+	cachedRequest(appRouter, http.MethodGet, "/api/assets", nil)
+	now = now.Add(70 * time.Second)
+	w := cachedRequest(appRouter, http.MethodGet, "/api/assets", nil)
+	assert.Equal(t, CacheStatusStale, w.Header().Get(XCacheHeader))
+	assert.Equal(t, "call 1", w.Body.String())
+	assert.Equal(t, "70", w.Header().Get(AgeHeader))
+
+	select {
+	case <-revalidated:
+	case <-time.After(time.Second):
+		t.Fatal("the stale response was not revalidated")
+	}
+	assert.Eventually(t, func() bool {
+		return cachedRequest(appRouter, http.MethodGet, "/api/assets", nil).Body.String() == "call 2"
+	}, time.Second, 5*time.Millisecond)
+
+	// past the stale window the response is fetched again
+	now = now.Add(2 * time.Minute)
+	w = cachedRequest(appRouter, http.MethodGet, "/api/assets", nil)
+	assert.Equal(t, CacheStatusMiss, w.Header().Get(XCacheHeader))
+	assert.Equal(t, "call 3", w.Body.String())
+}
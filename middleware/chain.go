@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"golang.org/x/text/language"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// ChainOptions configures the layers of the standard middleware chain. Trace propagation, request id, logging and
+// security headers are enabled unless disabled, the other layers are enabled by setting their options.
+type ChainOptions struct {
+	// Logger is used by every layer
+	Logger log.LoggerType
+	// ErrorResponder writes the rejections of the layers without their own responder, e.g. eemi.NewErrorResponder
+	ErrorResponder ErrorResponder
+
+	// DisableTracePropagation disables the trace propagation layer
+	DisableTracePropagation bool
+	// DisableRequestID disables the request id layer
+	DisableRequestID bool
+	// ClientIP enables the client address layer, the layers after it see the resolved address and it logs the
+	// requests denied by its access lists
+	ClientIP *ClientIPResolver
+	// Metrics enables the metrics layer
+	Metrics *HTTPMetrics
+	// DisableLogging disables the logging layer
+	DisableLogging bool
+	// Logging configures the logging layer, the default options when nil
+	Logging *LoggingOptions
+	// ServerTiming enables the Server-Timing layer
+	ServerTiming *ServerTimingOptions
+	// DisableSecurityHeaders disables the security header layer
+	DisableSecurityHeaders bool
+	// Security is the security header policy, DefaultSecurityPolicy when nil
+	Security *SecurityPolicy
+	// CORS enables the CORS layer, preflights are answered before authentication
+	CORS *CORS
+	// Compression enables the compression layer
+	Compression *CompressionOptions
+	// I18nBundle and LanguageMatcher enable the locale selection layer, which runs before the layers rejecting
+	// requests so their rejections are localized
+	I18nBundle      *i18n.Bundle
+	LanguageMatcher language.Matcher
+	// Locale configures the locale selection, its claim source is not available since it runs before
+	// authentication
+	Locale LocaleOptions
+	// Versioning enables the API versioning layer, StripPathPrefix only applies with Chain.Wrapper. It runs before
+	// authentication so the callers of deprecated versions are logged by client address.
+	Versioning *VersioningOptions
+	// Maintenance enables the maintenance mode layer
+	Maintenance *MaintenanceMode
+	// ConcurrencyLimiter enables the concurrency limiting layer
+	ConcurrencyLimiter *ConcurrencyLimiter
+	// BodyLimit enables the body limit layer
+	BodyLimit *BodyLimitOptions
+	// Authenticator enables the bearer token authentication layer
+	Authenticator *JWTAuthenticator
+	// Auditor enables the audit layer, it runs after authentication so the records carry the actor and the
+	// requests denied by the later layers
+	Auditor *Auditor
+	// RateLimit enables the rate limiting layer, its keys can be scoped by the token subject
+	RateLimit *RateLimitOptions
+	// Authorizer enables the authorization layer
+	Authorizer *Authorizer
+	// Conditional enables the conditional request layer
+	Conditional *ConditionalOptions
+	// Cache enables the cache policy and response cache layer, its Cache-Control replaces the one of the security
+	// headers and only authorized requests are served from the response cache
+	Cache *CacheOptions
+	// Timeout enables the timeout layer
+	Timeout *TimeoutOptions
+	// Idempotency enables the idempotency layer, its keys can be scoped by the token subject. It runs inside the
+	// timeout layer so a timed out request keeps its key until its handler returns.
+	Idempotency *IdempotencyOptions
+}
+
+// Chain is the standard middleware chain, its layers are created once and shared by every request
+type Chain struct {
+	layers []func(http.Handler) http.Handler
+}
+
+// NewChain builds the enabled layers in the order:
+//
+//	trace propagation, request id, client address, metrics, logging, server timing, security headers, CORS,
+//	compression, locale selection, API versioning, maintenance mode, concurrency limit, body limit,
+//	authentication, audit, rate limiting, authorization, conditional requests, response cache, timeout,
+//	idempotency
+func NewChain(options ChainOptions) *Chain {
+	logger := options.Logger
+	responder := func(responder ErrorResponder) ErrorResponder {
+		if responder == nil {
+			return options.ErrorResponder
+		}
+		return responder
+	}
+
+	chain := &Chain{}
+	if !options.DisableTracePropagation {
+		chain.add(TracePropagationMiddleware(logger))
+	}
+	if !options.DisableRequestID {
+		chain.add(RequestIDMiddleware(logger))
+	}
+	if options.ClientIP != nil {
+		chain.add(options.ClientIP.Middleware())
+	}
+	if options.Metrics != nil {
+		chain.add(options.Metrics.Middleware())
+	}
+	if !options.DisableLogging {
+		loggingOptions := LoggingOptions{}
+		if options.Logging != nil {
+			loggingOptions = *options.Logging
+		}
+		chain.add(LoggingMiddlewareWithOptions(logger, loggingOptions))
+	}
+	if options.ServerTiming != nil {
+		chain.add(ServerTimingMiddleware(*options.ServerTiming))
+	}
+	if !options.DisableSecurityHeaders {
+		policy := DefaultSecurityPolicy()
+		if options.Security != nil {
+			policy = *options.Security
+		}
+		chain.add(SecurityPolicyMiddleware(policy))
+	}
+	if options.CORS != nil {
+		chain.add(options.CORS.Middleware())
+	}
+	if options.Compression != nil {
+		compressionOptions := *options.Compression
+		compressionOptions.ErrorResponder = responder(compressionOptions.ErrorResponder)
+		chain.add(CompressionMiddleware(compressionOptions, logger))
+	}
+	if options.I18nBundle != nil && options.LanguageMatcher != nil {
+		chain.add(LocaleSelectionMiddlewareWithOptions(options.I18nBundle, options.LanguageMatcher, options.Locale, logger))
+	}
+	if options.Versioning != nil {
+		versioningOptions := *options.Versioning
+		versioningOptions.ErrorResponder = responder(versioningOptions.ErrorResponder)
+		chain.add(VersioningMiddleware(versioningOptions, logger))
+	}
+	if options.Maintenance != nil {
+		chain.add(options.Maintenance.Middleware())
+	}
+	if options.ConcurrencyLimiter != nil {
+		chain.add(options.ConcurrencyLimiter.Middleware())
+	}
+	if options.BodyLimit != nil {
+		bodyLimitOptions := *options.BodyLimit
+		bodyLimitOptions.ErrorResponder = responder(bodyLimitOptions.ErrorResponder)
+		chain.add(BodyLimitMiddleware(bodyLimitOptions, logger))
+	}
+	if options.Authenticator != nil {
+		chain.add(options.Authenticator.Middleware())
+	}
+	if options.Auditor != nil {
+		chain.add(options.Auditor.Middleware())
+	}
+	if options.RateLimit != nil {
+		rateLimitOptions := *options.RateLimit
+		rateLimitOptions.ErrorResponder = responder(rateLimitOptions.ErrorResponder)
+		chain.add(RateLimitMiddleware(rateLimitOptions, logger))
+	}
+	if options.Authorizer != nil {
+		chain.add(options.Authorizer.Middleware())
+	}
+	if options.Conditional != nil {
+		conditionalOptions := *options.Conditional
+		conditionalOptions.ErrorResponder = responder(conditionalOptions.ErrorResponder)
+		chain.add(ConditionalMiddleware(conditionalOptions, logger))
+	}
+	if options.Cache != nil {
+		chain.add(CacheMiddleware(*options.Cache, logger))
+	}
+	if options.Timeout != nil {
+		timeoutOptions := *options.Timeout
+		timeoutOptions.ErrorResponder = responder(timeoutOptions.ErrorResponder)
+		chain.add(TimeoutMiddleware(timeoutOptions, logger))
+	}
+	if options.Idempotency != nil {
+		idempotencyOptions := *options.Idempotency
+		idempotencyOptions.ErrorResponder = responder(idempotencyOptions.ErrorResponder)
+		chain.add(IdempotencyMiddleware(idempotencyOptions, logger))
+	}
+	return chain
+}
+
+func (c *Chain) add(layer func(http.Handler) http.Handler) {
+	c.layers = append(c.layers, layer)
+}
+
+// Middlewares returns the layers in order, to be registered with Router.Use
+func (c *Chain) Middlewares() []mux.MiddlewareFunc {
+	middlewares := make([]mux.MiddlewareFunc, 0, len(c.layers))
+	for _, layer := range c.layers {
+		middlewares = append(middlewares, layer)
+	}
+	return middlewares
+}
+
+// Wrapper wraps the handler with the layers, the first layer being the outermost
+func (c *Chain) Wrapper(next http.Handler) http.Handler {
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		next = c.layers[i](next)
+	}
+	return next
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Chain_Default_Layers_In_Order(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	var traceID string
+	chain := NewChain(ChainOptions{Logger: newBufferedLogger(buffer)})
+
+	appRouter := mux.NewRouter()
+	appRouter.Use(chain.Middlewares()...)
+	appRouter.HandleFunc("/api/assets", func(w http.ResponseWriter, r *http.Request) {
+		traceID, _ = r.Context().Value("x-b3-traceid").(string)
+		w.Write([]byte("response value"))
+	})
+
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	req.Header.Set("x-b3-traceid", "trace-1")
+	req.Header.Set(RequestIDHeader, "request-1")
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "trace-1", traceID)
+	assert.Equal(t, "request-1", w.Header().Get(RequestIDHeader))
+	assert.Equal(t, "nosniff", w.Header().Get(OptionsContentTypeHeader))
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, "request-1", entries[0]["request-id"], "Logging should run after the request id layer")
+}
+
+func Test_Chain_Wrapper_Matches_Middlewares(t *testing.T) {
+	chain := NewChain(ChainOptions{
+		Logger:                 newBufferedLogger(&bytes.Buffer{}),
+		DisableLogging:         true,
+		DisableSecurityHeaders: true,
+	})
+
+	w := httptest.NewRecorder()
+	chain.Wrapper(http.HandlerFunc(successHandler)).ServeHTTP(w, httptest.NewRequest("GET", "/api/assets", nil))
+
+	assert.Len(t, chain.Middlewares(), 2)
+	assert.Equal(t, "response value", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get(RequestIDHeader))
+	assert.Empty(t, w.Header().Get(OptionsContentTypeHeader))
+}
+
+func Test_Chain_Applies_Error_Responder_And_Keeps_Layer_State(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	var messageIDs []string
+	chain := NewChain(ChainOptions{
+		Logger: newBufferedLogger(buffer),
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, messageID string, data map[string]string) {
+			messageIDs = append(messageIDs, messageID)
+			w.WriteHeader(status)
+		},
+		RateLimit: &RateLimitOptions{Default: &RateLimit{Requests: 1, Period: time.Minute}},
+	})
+
+	appRouter := mux.NewRouter()
+	appRouter.Use(chain.Middlewares()...)
+	appRouter.HandleFunc("/api/assets", successHandler)
+
+	for i := 0; i < 2; i++ {
+		appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/assets", nil))
+	}
+
+	assert.Equal(t, []string{TooManyRequestsMessageID}, messageIDs)
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, float64(http.StatusTooManyRequests), entries[len(entries)-1]["response-code"], "Rejections should be logged")
+}
+
+func Test_Chain_Keeps_Idempotency_Key_Of_Timed_Out_Request(t *testing.T) {
+	var calls int32
+	done := make(chan struct{})
+	chain := NewChain(ChainOptions{
+		Logger:      newBufferedLogger(&bytes.Buffer{}),
+		Timeout:     &TimeoutOptions{Default: 20 * time.Millisecond},
+		Idempotency: &IdempotencyOptions{},
+	})
+
+	appRouter := mux.NewRouter()
+	appRouter.Use(chain.Middlewares()...)
+	appRouter.HandleFunc("/api/assets", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/assets", strings.NewReader(`{"name":"asset"}`))
+		req.Header.Set(IdempotencyKeyHeader, "key-1")
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, send().Code)
+	assert.Equal(t, http.StatusConflict, send().Code, "The key should stay in use while the timed out handler runs")
+
+	<-done
+	assert.Eventually(t, func() bool {
+		w := send()
+		return w.Code == http.StatusCreated && w.Header().Get(IdempotentReplayedHeader) == "true"
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
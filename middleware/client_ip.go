@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// ContextClientIPKey is of type contextKey to save the resolved client address
+const ContextClientIPKey contextKey = "clientIPKey"
+
+const (
+	// ForwardedHeader represents the Forwarded Header param
+	ForwardedHeader = "Forwarded"
+	// XForwardedForHeader represents the X-Forwarded-For Header param
+	XForwardedForHeader = "X-Forwarded-For"
+	// XRealIPHeader represents the X-Real-IP Header param
+	XRealIPHeader = "X-Real-IP"
+)
+
+// RouteAccess restricts the requests selected by its RouteMatcher by client address. Addresses are CIDRs such as
+// 10.0.0.0/8 or single addresses.
+type RouteAccess struct {
+	RouteMatcher
+	// Allow lists the networks allowed, any address is allowed when empty
+	Allow []string
+	// Deny lists the networks denied, it is checked before Allow
+	Deny []string
+}
+
+// ClientIPOptions configures the client address resolution and access control
+type ClientIPOptions struct {
+	// TrustedProxies are the networks of the proxies whose forwarding headers are trusted, e.g. the ingress
+	TrustedProxies []string
+	// Header is the forwarding header set by the trusted proxies, XForwardedForHeader when empty. The other
+	// forwarding headers are ignored since a client can send them through the proxies.
+	Header string
+	// Routes are the per-route access lists, the first matching one is applied
+	Routes []RouteAccess
+	// ErrorResponder writes the 403 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the 403 responses, ForbiddenMessageID when empty
+	MessageID string
+}
+
+// ClientIPResolver resolves the client address behind the trusted proxies and enforces the per-route access lists
+type ClientIPResolver struct {
+	options ClientIPOptions
+	logger  log.LoggerType
+	trusted []*net.IPNet
+	routes  []routeAccess
+}
+
+type routeAccess struct {
+	matcher RouteMatcher
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+}
+
+// NewClientIPResolver parses the networks of the options
+func NewClientIPResolver(options ClientIPOptions, logger log.LoggerType) (*ClientIPResolver, error) {
+	if options.Header == "" {
+		options.Header = XForwardedForHeader
+	}
+	if options.MessageID == "" {
+		options.MessageID = ForbiddenMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+
+	trusted, err := ParseNetworks(options.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &ClientIPResolver{options: options, logger: logger, trusted: trusted}
+	for _, route := range options.Routes {
+		allow, err := ParseNetworks(route.Allow)
+		if err != nil {
+			return nil, err
+		}
+		deny, err := ParseNetworks(route.Deny)
+		if err != nil {
+			return nil, err
+		}
+		resolver.routes = append(resolver.routes, routeAccess{matcher: route.RouteMatcher, allow: allow, deny: deny})
+	}
+	return resolver, nil
+}
+
+// ParseNetworks parses CIDRs and single addresses
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// GetClientIP returns the client address resolved for the request, or the address of the connecting peer when
+// the ClientIPResolver is not registered
+func GetClientIP(r *http.Request) string {
+	return remoteIP(r)
+}
+
+// Middleware returns a gorilla mux middleware resolving the client address
+func (c *ClientIPResolver) Middleware() func(http.Handler) http.Handler {
+	return c.Wrapper
+}
+
+// Wrapper stores the client address in the request context, see GetClientIP, and rejects the requests denied by
+// the access list of their route with a 403. The forwarding header is only read when the connecting peer is a
+// trusted proxy, and its hops are walked from the right so a client cannot spoof its address.
+func (c *ClientIPResolver) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := c.resolve(r)
+		r = r.WithContext(context.WithValue(r.Context(), ContextClientIPKey, clientIP))
+
+		if access := c.routeAccess(r); access != nil && !access.allows(net.ParseIP(clientIP)) {
+			c.logger.Warnf("Access denied to %s for request %s %s", clientIP, r.Method, requestPath(r))
+			c.options.ErrorResponder(w, r, http.StatusForbidden, c.options.MessageID, nil)
+			return
+		}
+
+		// call next
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resolve returns the first untrusted hop from the right of the forwarding header, or the peer address
+func (c *ClientIPResolver) resolve(r *http.Request) string {
+	peer := peerIP(r)
+	ip := net.ParseIP(peer)
+	if ip == nil || !containsIP(c.trusted, ip) {
+		return peer
+	}
+
+	hops := forwardedHops(r.Header, c.options.Header)
+	client := ip
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// an obfuscated or invalid hop ends what the trusted proxies vouch for
+			break
+		}
+		client = hop
+		if !containsIP(c.trusted, hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// routeAccess returns the access list of the first matching route, nil when none matches
+func (c *ClientIPResolver) routeAccess(r *http.Request) *routeAccess {
+	for i := range c.routes {
+		if c.routes[i].matcher.Matches(r) {
+			return &c.routes[i]
+		}
+	}
+	return nil
+}
+
+func (ra *routeAccess) allows(ip net.IP) bool {
+	if ip == nil || containsIP(ra.deny, ip) {
+		return false
+	}
+	return len(ra.allow) == 0 || containsIP(ra.allow, ip)
+}
+
+// forwardedHops returns the addresses listed by the forwarding header, from the client to the last proxy
+func forwardedHops(header http.Header, name string) []string {
+	values := header.Values(name)
+	if len(values) == 0 {
+		return nil
+	}
+	var hops []string
+	for _, element := range strings.Split(strings.Join(values, ","), ",") {
+		element = strings.TrimSpace(element)
+		if !strings.EqualFold(name, ForwardedHeader) {
+			if element != "" {
+				hops = append(hops, element)
+			}
+			continue
+		}
+		// Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43
+		hop := "unknown"
+		for _, pair := range strings.Split(element, ";") {
+			if key, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && strings.EqualFold(key, "for") {
+				hop = value
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseHop parses a forwarded address, which may be quoted, bracketed or hold a port
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if strings.HasPrefix(hop, "[") {
+		if end := strings.Index(hop, "]"); end > 0 {
+			hop = hop[1:end]
+		}
+	} else if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(hop)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
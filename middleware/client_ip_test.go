@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Client_IP_Resolution(t *testing.T) {
+	tests := []struct {
+		name   string
+		option string
+		peer   string
+		header string
+		value  string
+		client string
+	}{
+		{name: "untrusted peer ignores the headers", peer: "192.0.2.1:1234", header: XForwardedForHeader, value: "198.51.100.7", client: "192.0.2.1"},
+		{name: "trusted peer without header", peer: "10.0.0.1:1234", client: "10.0.0.1"},
+		{name: "x-forwarded-for", peer: "10.0.0.1:1234", header: XForwardedForHeader, value: "198.51.100.7, 10.0.0.2", client: "198.51.100.7"},
+		{name: "spoofed x-forwarded-for entries", peer: "10.0.0.1:1234", header: XForwardedForHeader, value: "1.1.1.1, 198.51.100.7", client: "198.51.100.7"},
+		{name: "all hops trusted", peer: "10.0.0.1:1234", header: XForwardedForHeader, value: "10.0.0.3, 10.0.0.2", client: "10.0.0.3"},
+		{name: "ignores other headers", peer: "10.0.0.1:1234", header: XRealIPHeader, value: "198.51.100.7", client: "10.0.0.1"},
+		{name: "forwarded", option: ForwardedHeader, peer: "10.0.0.1:1234", header: ForwardedHeader, value: `for="[2001:db8::7]:443";proto=https, for=10.0.0.2`, client: "2001:db8::7"},
+		{name: "forwarded obfuscated hop", option: ForwardedHeader, peer: "10.0.0.1:1234", header: ForwardedHeader, value: "for=_hidden, for=10.0.0.2", client: "10.0.0.2"},
+		{name: "x-real-ip", option: XRealIPHeader, peer: "[2001:db8::1]:1234", header: XRealIPHeader, value: "198.51.100.7", client: "198.51.100.7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver, err := NewClientIPResolver(ClientIPOptions{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}, Header: test.option}, log.NewLogger("", ""))
+			assert.NoError(t, err)
+			var clientIP string
+			handler := resolver.Wrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				clientIP = GetClientIP(r)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+			req.RemoteAddr = test.peer
+			if test.header != "" {
+				req.Header.Set(test.header, test.value)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, test.client, clientIP)
+		})
+	}
+}
+
+func Test_Client_IP_Route_Access(t *testing.T) {
+	var messageID string
+	resolver, err := NewClientIPResolver(ClientIPOptions{
+		TrustedProxies: []string{"10.0.0.1"},
+		Routes: []RouteAccess{
+			{RouteMatcher: RouteMatcher{Route: "/admin/**"}, Allow: []string{"192.168.0.0/16"}, Deny: []string{"192.168.1.0/24"}},
+		},
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	}, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	appRouter := mux.NewRouter()
+	appRouter.Use(resolver.Middleware())
+	appRouter.HandleFunc("/admin/maintenance", successHandler)
+	appRouter.HandleFunc("/api/assets", successHandler)
+
+	for client, status := range map[string]int{"192.168.2.3": http.StatusOK, "192.168.1.3": http.StatusForbidden, "198.51.100.7": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/maintenance", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(XForwardedForHeader, client)
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Code, client)
+	}
+	assert.Equal(t, ForbiddenMessageID, messageID)
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_Client_IP_Ignores_Spoofed_Forwarded_Header(t *testing.T) {
+	resolver, err := NewClientIPResolver(ClientIPOptions{
+		TrustedProxies: []string{"10.0.0.0/8"},
+		Routes:         []RouteAccess{{RouteMatcher: RouteMatcher{Route: "/admin/**"}, Allow: []string{"192.168.0.0/16"}}},
+	}, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	handler := resolver.Wrapper(http.HandlerFunc(successHandler))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/maintenance", nil)
+	req.RemoteAddr = "10.0.0.5:1234"
+	req.Header.Set(XForwardedForHeader, "203.0.113.9")
+	req.Header.Set(ForwardedHeader, "for=192.168.1.1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code, "the client sent Forwarded header should not be trusted")
+}
+
+func Test_Client_IP_Feeds_Rate_Limit_Key(t *testing.T) {
+	resolver, err := NewClientIPResolver(ClientIPOptions{TrustedProxies: []string{"10.0.0.0/8"}}, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	var key string
+	handler := resolver.Wrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = KeyByClientIP(r)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(XForwardedForHeader, "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "198.51.100.7", key)
+}
+
+func Test_Parse_Networks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/32", networks[1].String())
+	_, err = ParseNetworks([]string{"not-an-address"})
+	assert.Error(t, err)
+	_, err = NewClientIPResolver(ClientIPOptions{Routes: []RouteAccess{{Allow: []string{"10.0.0.0/33"}}}}, log.NewLogger("", ""))
+	assert.Error(t, err)
+}
@@ -0,0 +1,424 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+const (
+	// AcceptEncodingHeader represents the Accept-Encoding Header param
+	AcceptEncodingHeader = "Accept-Encoding"
+	// ContentEncodingHeader represents the Content-Encoding Header param
+	ContentEncodingHeader = "Content-Encoding"
+	// ETagHeader represents the ETag Header param
+	ETagHeader = "ETag"
+	// contentLengthHeader represents the Content-Length Header param
+	contentLengthHeader = "Content-Length"
+)
+
+const (
+	// EncodingGzip is the gzip content coding
+	EncodingGzip = "gzip"
+	// EncodingDeflate is the deflate (zlib) content coding
+	EncodingDeflate = "deflate"
+)
+
+// DefaultCompressionMinSize is the default size under which responses are sent uncompressed
+const DefaultCompressionMinSize = 1024
+
+// DefaultMaxDecompressedSize is the default size limit of the decompressed request bodies
+const DefaultMaxDecompressedSize int64 = 10 * 1024 * 1024
+
+// DefaultCompressibleContentTypes are the default media types of the compressed responses
+var DefaultCompressibleContentTypes = []string{
+	"application/json",
+	"application/problem+json",
+	"application/xml",
+	"application/javascript",
+	"image/svg+xml",
+	"text/*",
+}
+
+// CompressionOptions configures the compression middleware
+type CompressionOptions struct {
+	// MinSize is the size in bytes under which responses are sent uncompressed, DefaultCompressionMinSize when zero
+	MinSize int
+	// ContentTypes are the media types of the compressed responses, either exact ("application/json") or by
+	// type ("text/*"), DefaultCompressibleContentTypes when empty
+	ContentTypes []string
+	// Level is the compression level, gzip.DefaultCompression when zero
+	Level int
+	// MaxDecompressedSize is the size limit of the decompressed request bodies, DefaultMaxDecompressedSize when zero
+	MaxDecompressedSize int64
+	// ErrorResponder writes the 400, 413 and 415 responses to compressed requests, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+}
+
+// CompressionMiddleware is a gorilla mux middleware compressing the responses and decompressing the requests
+func CompressionMiddleware(options CompressionOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	compressor := newCompressor(options, logger)
+	return func(next http.Handler) http.Handler {
+		return compressor.handler(next)
+	}
+}
+
+// CompressionWrapper compresses the responses with the coding preferred in the Accept-Encoding of the request
+// when their media type is compressible and they reach the minimum size, and decompresses the gzip and deflate
+// request bodies before calling the handler. Decompressed bodies over the limit are rejected with a 413.
+func CompressionWrapper(next http.Handler, options CompressionOptions, logger log.LoggerType) http.Handler {
+	return newCompressor(options, logger).handler(next)
+}
+
+type compressor struct {
+	options CompressionOptions
+	logger  log.LoggerType
+	gzip    sync.Pool
+	zlib    sync.Pool
+}
+
+// newCompressor applies the option defaults, the writer pools are shared by every request
+func newCompressor(options CompressionOptions, logger log.LoggerType) *compressor {
+	if options.MinSize == 0 {
+		options.MinSize = DefaultCompressionMinSize
+	}
+	if len(options.ContentTypes) == 0 {
+		options.ContentTypes = DefaultCompressibleContentTypes
+	}
+	if options.Level == 0 {
+		options.Level = gzip.DefaultCompression
+	}
+	if options.MaxDecompressedSize == 0 {
+		options.MaxDecompressedSize = DefaultMaxDecompressedSize
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	return &compressor{options: options, logger: logger}
+}
+
+func (c *compressor) handler(next http.Handler) http.Handler {
+	options := c.options
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.decompressRequest(w, r) {
+			return
+		}
+		ifNoneMatch := r.Header.Get(IfNoneMatchHeader)
+		for _, name := range []string{IfMatchHeader, IfNoneMatchHeader} {
+			if value := r.Header.Get(name); value != "" {
+				r.Header.Set(name, identityETags(value))
+			}
+		}
+
+		w.Header().Add(VaryHeader, AcceptEncodingHeader)
+		encoding := negotiateEncoding(r.Header.Get(AcceptEncodingHeader))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, compressor: c, encoding: encoding, minSize: options.MinSize,
+			encodedTags: strings.Contains(ifNoneMatch, "-"+encoding+`"`)}
+		defer cw.close()
+
+		// call next
+		next.ServeHTTP(wrapResponseWriter(cw, w), r)
+	})
+}
+
+// encodedETag returns the tag of the representation compressed with the coding, e.g. "v1" becomes "v1-gzip"
+func encodedETag(etag string, encoding string) string {
+	if len(etag) < 2 || !strings.HasSuffix(etag, `"`) {
+		return etag
+	}
+	return etag[:len(etag)-1] + "-" + encoding + `"`
+}
+
+// identityETags replaces the tags of the compressed representations in an If-Match or If-None-Match list with the
+// tags of the identity representation, so the inner layers compare them with their own tags
+func identityETags(list string) string {
+	tags := strings.Split(list, ",")
+	for i, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		for _, encoding := range []string{EncodingGzip, EncodingDeflate} {
+			if suffix := "-" + encoding + `"`; strings.HasSuffix(tag, suffix) {
+				tag = strings.TrimSuffix(tag, suffix) + `"`
+				break
+			}
+		}
+		tags[i] = tag
+	}
+	return strings.Join(tags, ", ")
+}
+
+// decompressRequest replaces a compressed request body with its decompressed content, it returns false when the
+// request was rejected
+func (c *compressor) decompressRequest(w http.ResponseWriter, r *http.Request) bool {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get(ContentEncodingHeader)))
+	if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case EncodingGzip:
+		reader, err = gzip.NewReader(r.Body)
+	case EncodingDeflate:
+		reader, err = zlib.NewReader(r.Body)
+	default:
+		c.logger.Warnf("Rejected request %s %s with unsupported content encoding %q", r.Method, requestURI(r), encoding)
+		c.options.ErrorResponder(w, r, http.StatusUnsupportedMediaType, UnsupportedMediaTypeMessageID, map[string]string{"ContentEncoding": encoding})
+		return false
+	}
+
+	var data []byte
+	if err == nil {
+		// read one byte over the limit to tell a body at the limit from a larger one
+		data, err = ioutil.ReadAll(io.LimitReader(reader, c.options.MaxDecompressedSize+1))
+		reader.Close()
+	}
+	if err != nil {
+		c.logger.Warnf("Failed decompressing the body of request %s %s: %v", r.Method, requestURI(r), err)
+		c.options.ErrorResponder(w, r, http.StatusBadRequest, BadRequestMessageID, nil)
+		return false
+	}
+	if int64(len(data)) > c.options.MaxDecompressedSize {
+		c.logger.Warnf("Rejected request %s %s with a body decompressing over %d bytes", r.Method, requestURI(r), c.options.MaxDecompressedSize)
+		c.options.ErrorResponder(w, r, http.StatusRequestEntityTooLarge, PayloadTooLargeMessageID, map[string]string{"MaxBodySize": strconv.FormatInt(c.options.MaxDecompressedSize, 10)})
+		return false
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.Header.Del(ContentEncodingHeader)
+	r.Header.Del(contentLengthHeader)
+	return true
+}
+
+// newEncoder returns a pooled encoder of the coding writing to w
+func (c *compressor) newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == EncodingGzip {
+		if pooled, ok := c.gzip.Get().(*gzip.Writer); ok {
+			pooled.Reset(w)
+			return pooled
+		}
+		encoder, err := gzip.NewWriterLevel(w, c.options.Level)
+		if err != nil {
+			encoder = gzip.NewWriter(w)
+		}
+		return encoder
+	}
+	if pooled, ok := c.zlib.Get().(*zlib.Writer); ok {
+		pooled.Reset(w)
+		return pooled
+	}
+	encoder, err := zlib.NewWriterLevel(w, c.options.Level)
+	if err != nil {
+		encoder = zlib.NewWriter(w)
+	}
+	return encoder
+}
+
+// releaseEncoder returns the encoder to its pool
+func (c *compressor) releaseEncoder(encoder io.WriteCloser) {
+	switch pooled := encoder.(type) {
+	case *gzip.Writer:
+		c.gzip.Put(pooled)
+	case *zlib.Writer:
+		c.zlib.Put(pooled)
+	}
+}
+
+// negotiateEncoding returns the supported coding with the highest quality in the Accept-Encoding header, gzip
+// being preferred on ties, or an empty string when the response should not be compressed
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = parsed
+			}
+		}
+		qualities[strings.ToLower(strings.TrimSpace(coding))] = quality
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range []string{EncodingGzip, EncodingDeflate} {
+		quality, ok := qualities[coding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the response until it reaches the minimum size, then decides from the status and
+// headers whether it is compressed
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *compressor
+	encoding   string
+	minSize    int
+	// encodedTags is set when the If-None-Match held tags of the compressed representation
+	encodedTags bool
+
+	status  int
+	buffer  []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+	if status < http.StatusOK && status != http.StatusSwitchingProtocols {
+		// informational responses go out immediately, the final status follows
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if !bodyAllowedForStatus(status) {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buffer = append(cw.buffer, b...)
+		if len(cw.buffer) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decideAndFlushBuffer(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		// a streamed response is compressed regardless of its size so far
+		cw.decideAndFlushBuffer(true)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close writes the buffered response and finishes the compressed stream once the handler returned
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buffer) == 0 {
+			// the handler wrote nothing, leave the default response to the server
+			return
+		}
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decideAndFlushBuffer(len(cw.buffer) >= cw.minSize)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+		cw.compressor.releaseEncoder(cw.encoder)
+		cw.encoder = nil
+	}
+}
+
+// decideAndFlushBuffer decides on the compression and writes the buffered content
+func (cw *compressWriter) decideAndFlushBuffer(compress bool) error {
+	cw.decide(compress)
+	buffered := cw.buffer
+	cw.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buffered)
+	} else {
+		_, err = cw.ResponseWriter.Write(buffered)
+	}
+	return err
+}
+
+// decide writes the status and headers, compressing when wanted and the response allows it
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	header := cw.Header()
+	if compress && cw.compressible(header) {
+		header.Set(ContentEncodingHeader, cw.encoding)
+		header.Del(contentLengthHeader)
+		// the compressed representation differs from the identity one
+		if etag := header.Get(ETagHeader); etag != "" {
+			header.Set(ETagHeader, encodedETag(etag, cw.encoding))
+		}
+		cw.encoder = cw.compressor.newEncoder(cw.encoding, cw.ResponseWriter)
+	} else if cw.status == http.StatusNotModified && cw.encodedTags {
+		// the 304 carries the tag of the representation the client holds
+		if etag := header.Get(ETagHeader); etag != "" {
+			header.Set(ETagHeader, encodedETag(etag, cw.encoding))
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// compressible reports whether the response can be compressed
+func (cw *compressWriter) compressible(header http.Header) bool {
+	if !bodyAllowedForStatus(cw.status) || cw.status == http.StatusPartialContent {
+		return false
+	}
+	if header.Get(ContentEncodingHeader) != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := header.Get(contentTypeHeader)
+	if contentType == "" {
+		contentType = http.DetectContentType(cw.buffer)
+		header.Set(contentTypeHeader, contentType)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return allowedContentType(mediaType, cw.compressor.options.ContentTypes)
+}
+
+// bodyAllowedForStatus reports whether a response with the status can have a body
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var largeJSON = `{"assets":[` + strings.Repeat(`{"id":"asset","name":"compressible"},`, 100) + `{}]}`
+
+func setupCompressionRouter(options CompressionOptions) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(CompressionMiddleware(options, log.NewLogger("", "")))
+	appRouter.HandleFunc("/api/assets", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "application/json")
+		w.Header().Set(ETagHeader, `"v1"`)
+		w.Write([]byte(largeJSON))
+	})
+	appRouter.HandleFunc("/api/small", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "application/json")
+		w.Write([]byte(`{}`))
+	})
+	appRouter.HandleFunc("/api/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "image/png")
+		w.Write([]byte(largeJSON))
+	})
+	appRouter.HandleFunc("/api/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+	return appRouter
+}
+
+func compressedRequest(appRouter *mux.Router, target string, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set(AcceptEncodingHeader, acceptEncoding)
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	_, err := writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func Test_Compression_Gzips_Large_Responses(t *testing.T) {
+	appRouter := setupCompressionRouter(CompressionOptions{})
+
+	w := compressedRequest(appRouter, "/api/assets", "gzip, deflate")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, EncodingGzip, w.Header().Get(ContentEncodingHeader))
+	assert.Equal(t, AcceptEncodingHeader, w.Header().Get(VaryHeader))
+	assert.Equal(t, `"v1-gzip"`, w.Header().Get(ETagHeader))
+	reader, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, largeJSON, string(body))
+}
+
+func Test_Compression_Negotiates_Deflate(t *testing.T) {
+	appRouter := setupCompressionRouter(CompressionOptions{})
+
+	w := compressedRequest(appRouter, "/api/assets", "gzip;q=0.5, deflate")
+	assert.Equal(t, EncodingDeflate, w.Header().Get(ContentEncodingHeader))
+	reader, err := zlib.NewReader(w.Body)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, largeJSON, string(body))
+
+	w = compressedRequest(appRouter, "/api/assets", "gzip;q=0, br")
+	assert.Empty(t, w.Header().Get(ContentEncodingHeader))
+	assert.Equal(t, largeJSON, w.Body.String())
+}
+
+func Test_Compression_Skips_Small_And_Incompressible_Responses(t *testing.T) {
+	appRouter := setupCompressionRouter(CompressionOptions{})
+
+	w := compressedRequest(appRouter, "/api/small", "gzip")
+	assert.Empty(t, w.Header().Get(ContentEncodingHeader))
+	assert.Equal(t, `{}`, w.Body.String())
+
+	w = compressedRequest(appRouter, "/api/image", "gzip")
+	assert.Empty(t, w.Header().Get(ContentEncodingHeader))
+	assert.Equal(t, largeJSON, w.Body.String())
+
+	w = compressedRequest(appRouter, "/api/assets", "")
+	assert.Empty(t, w.Header().Get(ContentEncodingHeader))
+	assert.Equal(t, AcceptEncodingHeader, w.Header().Get(VaryHeader))
+}
+
+func Test_Compression_Preserves_Flusher(t *testing.T) {
+	handler := CompressionWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "text/event-stream")
+		w.Write([]byte("data: event\n\n"))
+		flusher, ok := w.(http.Flusher)
+		assert.True(t, ok)
+		flusher.Flush()
+	}), CompressionOptions{}, log.NewLogger("", ""))
+
+	req := httptest.NewRequest("GET", "/api/events", nil)
+	req.Header.Set(AcceptEncodingHeader, "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.True(t, w.Flushed)
+	assert.Equal(t, EncodingGzip, w.Header().Get(ContentEncodingHeader))
+	reader, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, "data: event\n\n", string(body))
+}
+
+func Test_Compression_Decompresses_Request_Bodies(t *testing.T) {
+	appRouter := setupCompressionRouter(CompressionOptions{})
+
+	req := httptest.NewRequest("POST", "/api/echo", bytes.NewReader(gzipBytes(t, []byte(`{"a":1}`))))
+	req.Header.Set(ContentEncodingHeader, EncodingGzip)
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"a":1}`, w.Body.String())
+
+	req = httptest.NewRequest("POST", "/api/echo", strings.NewReader("not gzip"))
+	req.Header.Set(ContentEncodingHeader, EncodingGzip)
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("POST", "/api/echo", strings.NewReader("data"))
+	req.Header.Set(ContentEncodingHeader, "br")
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func Test_Compression_Rejects_Zip_Bombs(t *testing.T) {
+	var messageID string
+	appRouter := setupCompressionRouter(CompressionOptions{
+		MaxDecompressedSize: 1024,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	})
+
+	bomb := gzipBytes(t, make([]byte, 1024*1024))
+	assert.True(t, len(bomb) < 16*1024)
+	req := httptest.NewRequest("POST", "/api/echo", bytes.NewReader(bomb))
+	req.Header.Set(ContentEncodingHeader, EncodingGzip)
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, PayloadTooLargeMessageID, messageID)
+}
@@ -0,0 +1,313 @@
+package middleware
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// ServiceUnavailableMessageID is the message id used for requests shed under load
+const ServiceUnavailableMessageID = "SERVICE_UNAVAILABLE"
+
+// ConcurrencyAlgorithm selects how the concurrency limit evolves
+type ConcurrencyAlgorithm int
+
+const (
+	// FixedConcurrency keeps the limit at its configured value
+	FixedConcurrency ConcurrencyAlgorithm = iota
+	// AIMDConcurrency increases the limit by one per limit of fast requests, and multiplies it by the backoff
+	// ratio on each slow or overloaded request
+	AIMDConcurrency
+	// GradientConcurrency scales the limit by the gradient of the long term average latency over the latency of
+	// each request, plus the square root of the limit as headroom, and multiplies it by the backoff ratio on each
+	// overloaded request
+	GradientConcurrency
+)
+
+const (
+	// DefaultConcurrencyLimit is the default fixed or initial concurrency limit
+	DefaultConcurrencyLimit = 100
+	// DefaultConcurrencyQueueTimeout is how long a request waits in the queue by default
+	DefaultConcurrencyQueueTimeout = time.Second
+	// DefaultConcurrencyBackoffRatio is the default multiplicative decrease of the adaptive limit
+	DefaultConcurrencyBackoffRatio = 0.9
+	// DefaultConcurrencyTolerance is the default latency increase tolerated by the gradient limit
+	DefaultConcurrencyTolerance = 1.5
+	// DefaultConcurrencyLatencyThreshold is the default latency over which a request signals overload
+	DefaultConcurrencyLatencyThreshold = time.Second
+)
+
+const (
+	// gradientWindow is the number of requests averaged by the long term latency of the gradient limit
+	gradientWindow = 600
+	// gradientSmoothing is the weight of each new gradient limit
+	gradientSmoothing = 0.2
+)
+
+// ConcurrencyLimitOptions configures the concurrency limiter
+type ConcurrencyLimitOptions struct {
+	Algorithm ConcurrencyAlgorithm
+	// Limit is the fixed limit, or the initial adaptive limit, DefaultConcurrencyLimit when zero
+	Limit int
+	// MinLimit and MaxLimit bound the adaptive limit, 1 and ten times the initial limit when zero
+	MinLimit int
+	MaxLimit int
+	// BackoffRatio multiplies the adaptive limit on overload, DefaultConcurrencyBackoffRatio when zero
+	BackoffRatio float64
+	// LatencyThreshold is the latency over which a request signals overload to the AIMD limit,
+	// DefaultConcurrencyLatencyThreshold when zero. A 503 or 504 response signals overload to both adaptive limits.
+	LatencyThreshold time.Duration
+	// Tolerance is how many times the long term average latency a request may take before the gradient limit
+	// decreases, DefaultConcurrencyTolerance when lower than one
+	Tolerance float64
+	// QueueSize is how many requests wait for a slot when the limit is reached, requests are shed at once when zero
+	QueueSize int
+	// QueueTimeout is how long a request waits for a slot, DefaultConcurrencyQueueTimeout when zero
+	QueueTimeout time.Duration
+	// Bypass select the requests never limited, e.g. the health and admin routes
+	Bypass []RouteMatcher
+	// Priority select the requests served from the queue before the others
+	Priority []RouteMatcher
+	// RetryAfter is the Retry-After of the shed requests, one second when zero
+	RetryAfter time.Duration
+	// ErrorResponder writes the 503 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the 503 responses, ServiceUnavailableMessageID when empty
+	MessageID string
+}
+
+// ConcurrencyStats is a snapshot of the limiter state
+type ConcurrencyStats struct {
+	Limit    int
+	InFlight int
+	Queued   int
+}
+
+// ConcurrencyLimiter limits the requests served concurrently with a fixed, AIMD or gradient limit, queueing the
+// requests over the limit and shedding them with a 503 and Retry-After when the queue is full or their wait times out
+type ConcurrencyLimiter struct {
+	options ConcurrencyLimitOptions
+	logger  log.LoggerType
+
+	mu       sync.Mutex
+	limit    float64
+	latency  float64
+	inFlight int
+	priority *list.List
+	normal   *list.List
+}
+
+// concurrencyWaiter is a queued request, ready is closed when it is granted a slot
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// NewConcurrencyLimiter creates the limiter, see ConcurrencyLimiter.Stats and ConcurrencyLimiter.RegisterMetrics
+// for its state
+func NewConcurrencyLimiter(options ConcurrencyLimitOptions, logger log.LoggerType) *ConcurrencyLimiter {
+	if options.Limit <= 0 {
+		options.Limit = DefaultConcurrencyLimit
+	}
+	if options.MinLimit <= 0 {
+		options.MinLimit = 1
+	}
+	if options.MaxLimit <= 0 {
+		options.MaxLimit = 10 * options.Limit
+	}
+	if options.BackoffRatio <= 0 || options.BackoffRatio >= 1 {
+		options.BackoffRatio = DefaultConcurrencyBackoffRatio
+	}
+	if options.LatencyThreshold <= 0 {
+		options.LatencyThreshold = DefaultConcurrencyLatencyThreshold
+	}
+	if options.Tolerance < 1 {
+		options.Tolerance = DefaultConcurrencyTolerance
+	}
+	if options.QueueTimeout <= 0 {
+		options.QueueTimeout = DefaultConcurrencyQueueTimeout
+	}
+	if options.RetryAfter <= 0 {
+		options.RetryAfter = time.Second
+	}
+	if options.MessageID == "" {
+		options.MessageID = ServiceUnavailableMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	return &ConcurrencyLimiter{
+		options:  options,
+		logger:   logger,
+		limit:    float64(options.Limit),
+		priority: list.New(),
+		normal:   list.New(),
+	}
+}
+
+// Middleware is a gorilla mux middleware limiting the concurrent requests
+func (l *ConcurrencyLimiter) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return l.Wrapper(next)
+	}
+}
+
+// Wrapper limits the concurrent requests served by the next handler
+func (l *ConcurrencyLimiter) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if matchesAny(l.options.Bypass, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire(r, matchesAny(l.options.Priority, r)) {
+			retryAfter := strconv.Itoa(int(math.Ceil(l.options.RetryAfter.Seconds())))
+			w.Header().Set(RetryAfterHeader, retryAfter)
+			l.options.ErrorResponder(w, r, http.StatusServiceUnavailable, l.options.MessageID, map[string]string{"RetryAfter": retryAfter})
+			return
+		}
+
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w}
+		defer func() {
+			l.release(time.Since(start), sw.status == http.StatusServiceUnavailable || sw.status == http.StatusGatewayTimeout)
+		}()
+
+		// call next
+		next.ServeHTTP(wrapResponseWriter(sw, w), r)
+	})
+}
+
+// Stats returns the current limit, the requests in flight and the queue depth
+func (l *ConcurrencyLimiter) Stats() ConcurrencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ConcurrencyStats{Limit: int(l.limit), InFlight: l.inFlight, Queued: l.priority.Len() + l.normal.Len()}
+}
+
+// RegisterMetrics exposes the limit, the requests in flight and the queue depth as gauges of the metrics
+func (l *ConcurrencyLimiter) RegisterMetrics(metrics *HTTPMetrics) {
+	metrics.AddGauge("concurrency_limit", "Current concurrency limit.", func() float64 {
+		return float64(l.Stats().Limit)
+	})
+	metrics.AddGauge("concurrency_in_flight", "Number of requests holding a concurrency slot.", func() float64 {
+		return float64(l.Stats().InFlight)
+	})
+	metrics.AddGauge("concurrency_queue_depth", "Number of requests waiting for a concurrency slot.", func() float64 {
+		return float64(l.Stats().Queued)
+	})
+}
+
+// acquire takes a slot, waiting in the queue when the limit is reached, it returns false when the request is shed
+func (l *ConcurrencyLimiter) acquire(r *http.Request, priority bool) bool {
+	l.mu.Lock()
+	queue := l.normal
+	if priority {
+		queue = l.priority
+	}
+	// a priority request only waits behind the other priority requests
+	ahead := l.priority.Len()
+	if !priority {
+		ahead += l.normal.Len()
+	}
+	if l.inFlight < int(l.limit) && ahead == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	if l.priority.Len()+l.normal.Len() >= l.options.QueueSize {
+		inFlight := l.inFlight
+		l.mu.Unlock()
+		l.logger.Warnf("Shedding request %s %s, %d requests in flight and the queue is full", r.Method, requestURI(r), inFlight)
+		return false
+	}
+	waiter := &concurrencyWaiter{ready: make(chan struct{})}
+	element := queue.PushBack(waiter)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.options.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-waiter.ready:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if waiter.granted {
+		// the slot was granted while timing out, the request is served
+		return true
+	}
+	queue.Remove(element)
+	l.logger.Warnf("Shedding request %s %s after waiting %v for a slot", r.Method, requestURI(r), l.options.QueueTimeout)
+	return false
+}
+
+// release frees the slot of a served request, adapts the limit and grants the freed slots to the queue
+func (l *ConcurrencyLimiter) release(latency time.Duration, overloaded bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	switch {
+	case l.options.Algorithm == FixedConcurrency:
+	case overloaded || l.options.Algorithm == AIMDConcurrency && latency > l.options.LatencyThreshold:
+		l.limit = math.Max(float64(l.options.MinLimit), l.limit*l.options.BackoffRatio)
+	case l.options.Algorithm == AIMDConcurrency:
+		l.limit = math.Min(float64(l.options.MaxLimit), l.limit+1/l.limit)
+	case l.options.Algorithm == GradientConcurrency:
+		l.adaptGradient(float64(latency))
+	}
+
+	for l.inFlight < int(l.limit) {
+		queue := l.priority
+		if queue.Len() == 0 {
+			queue = l.normal
+		}
+		front := queue.Front()
+		if front == nil {
+			return
+		}
+		waiter := queue.Remove(front).(*concurrencyWaiter)
+		waiter.granted = true
+		l.inFlight++
+		close(waiter.ready)
+	}
+}
+
+// adaptGradient moves the limit towards the limit scaled by the gradient of the long term average latency over the
+// latency of the request, the limit is kept while less than half of it is in use
+func (l *ConcurrencyLimiter) adaptGradient(latency float64) {
+	latency = math.Max(latency, 1)
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency += (latency - l.latency) * 2 / (gradientWindow + 1)
+	}
+	// the average recovers from a sustained latency change instead of pinning the gradient
+	if l.latency > 2*latency {
+		l.latency *= 0.95
+	}
+	if float64(l.inFlight+1) < l.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.options.Tolerance*l.latency/latency))
+	target := l.limit*gradient + math.Sqrt(l.limit)
+	limit := l.limit*(1-gradientSmoothing) + target*gradientSmoothing
+	l.limit = math.Max(float64(l.options.MinLimit), math.Min(float64(l.options.MaxLimit), limit))
+}
+
+// matchesAny reports whether one of the matchers selects the request
+func matchesAny(matchers []RouteMatcher, r *http.Request) bool {
+	for i := range matchers {
+		if matchers[i].Matches(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingRouter serves /api/slow until release is closed, signalling each started request on started
+func blockingRouter(limiter *ConcurrencyLimiter, started chan<- string, release <-chan struct{}) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(limiter.Middleware())
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		<-release
+	}
+	appRouter.HandleFunc("/api/slow", handler)
+	appRouter.HandleFunc("/api/priority", handler)
+	appRouter.HandleFunc("/health", successHandler)
+	return appRouter
+}
+
+func serveAsync(wg *sync.WaitGroup, appRouter *mux.Router, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		appRouter.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	}()
+	return w
+}
+
+func waitQueued(t *testing.T, limiter *ConcurrencyLimiter, queued int) {
+	assert.Eventually(t, func() bool { return limiter.Stats().Queued == queued }, time.Second, time.Millisecond)
+}
+
+func Test_ConcurrencyLimit_Sheds_When_Queue_Is_Full(t *testing.T) {
+	var messageID string
+	limiter := NewConcurrencyLimiter(ConcurrencyLimitOptions{
+		Limit:      1,
+		Bypass:     []RouteMatcher{{Route: "/health"}},
+		RetryAfter: 2 * time.Second,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	}, log.NewLogger("", ""))
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	appRouter := blockingRouter(limiter, started, release)
+
+	var wg sync.WaitGroup
+	first := serveAsync(&wg, appRouter, "/api/slow")
+	<-started
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest("GET", "/api/slow", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get(RetryAfterHeader))
+	assert.Equal(t, ServiceUnavailableMessageID, messageID)
+
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "Bypassed routes are not limited")
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, ConcurrencyStats{Limit: 1}, limiter.Stats())
+}
+
+func Test_ConcurrencyLimit_Queues_With_Priority_And_Timeout(t *testing.T) {
+	limiter := NewConcurrencyLimiter(ConcurrencyLimitOptions{
+		Limit:        1,
+		QueueSize:    2,
+		QueueTimeout: time.Second,
+		Priority:     []RouteMatcher{{Route: "/api/priority"}},
+	}, log.NewLogger("", ""))
+	started := make(chan string, 3)
+	release := make(chan struct{}, 3)
+	appRouter := blockingRouter(limiter, started, release)
+
+	var wg sync.WaitGroup
+	serveAsync(&wg, appRouter, "/api/slow")
+	<-started
+	serveAsync(&wg, appRouter, "/api/slow")
+	waitQueued(t, limiter, 1)
+	serveAsync(&wg, appRouter, "/api/priority")
+	waitQueued(t, limiter, 2)
+	assert.Equal(t, ConcurrencyStats{Limit: 1, InFlight: 1, Queued: 2}, limiter.Stats())
+
+	release <- struct{}{}
+	assert.Equal(t, "/api/priority", <-started, "Priority requests should be served first")
+	release <- struct{}{}
+	assert.Equal(t, "/api/slow", <-started)
+	release <- struct{}{}
+	wg.Wait()
+
+	timedOut := NewConcurrencyLimiter(ConcurrencyLimitOptions{Limit: 1, QueueSize: 1, QueueTimeout: 10 * time.Millisecond}, log.NewLogger("", ""))
+	block := make(chan struct{})
+	appRouter = blockingRouter(timedOut, started, block)
+	serveAsync(&wg, appRouter, "/api/slow")
+	<-started
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest("GET", "/api/slow", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "Requests waiting over the timeout should be shed")
+	assert.Equal(t, 0, timedOut.Stats().Queued)
+	close(block)
+	wg.Wait()
+}
+
+func Test_ConcurrencyLimit_AIMD_Adapts_Limit(t *testing.T) {
+	limiter := NewConcurrencyLimiter(ConcurrencyLimitOptions{Algorithm: AIMDConcurrency, Limit: 10, MaxLimit: 11}, log.NewLogger("", ""))
+	handler := limiter.Wrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/overloaded" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	for i := 0; i < 30; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	}
+	assert.Equal(t, 11, limiter.Stats().Limit, "The limit should grow up to the maximum")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/overloaded", nil))
+	assert.Equal(t, 9, limiter.Stats().Limit, "The limit should back off on overload")
+
+	metrics := NewHTTPMetrics(MetricsOptions{})
+	limiter.RegisterMetrics(metrics)
+	assert.Contains(t, scrapeMetrics(t, metrics), "http_server_concurrency_limit 9\n")
+}
+
+func Test_ConcurrencyLimit_Gradient_Adapts_Limit(t *testing.T) {
+	limiter := NewConcurrencyLimiter(ConcurrencyLimitOptions{Algorithm: GradientConcurrency, Limit: 20, MaxLimit: 40}, log.NewLogger("", ""))
+	serve := func(latency time.Duration, overloaded bool) int {
+		limiter.mu.Lock()
+		limiter.inFlight = int(limiter.limit)
+		limiter.mu.Unlock()
+		limiter.release(latency, overloaded)
+		return limiter.Stats().Limit
+	}
+
+	for i := 0; i < 50; i++ {
+		serve(10*time.Millisecond, false)
+	}
+	assert.Equal(t, 40, limiter.Stats().Limit, "The limit should grow up to the maximum while the latency is steady")
+
+	previous := limiter.Stats().Limit
+	for i := 0; i < 5; i++ {
+		limit := serve(100*time.Millisecond, false)
+		assert.Less(t, limit, previous, "The limit should decrease while the latency rises")
+		previous = limit
+	}
+
+	assert.Equal(t, int(float64(previous)*DefaultConcurrencyBackoffRatio), serve(10*time.Millisecond, true), "The limit should back off on overload")
+
+	limiter.mu.Lock()
+	limiter.inFlight = 1
+	limiter.mu.Unlock()
+	before := limiter.Stats().Limit
+	limiter.release(time.Millisecond, false)
+	assert.Equal(t, before, limiter.Stats().Limit, "The limit should not grow while it is mostly unused")
+}
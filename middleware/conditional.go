@@ -0,0 +1,371 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+const (
+	// IfMatchHeader represents the If-Match Header param
+	IfMatchHeader = "If-Match"
+	// IfNoneMatchHeader represents the If-None-Match Header param
+	IfNoneMatchHeader = "If-None-Match"
+	// IfModifiedSinceHeader represents the If-Modified-Since Header param
+	IfModifiedSinceHeader = "If-Modified-Since"
+	// IfUnmodifiedSinceHeader represents the If-Unmodified-Since Header param
+	IfUnmodifiedSinceHeader = "If-Unmodified-Since"
+	// LastModifiedHeader represents the Last-Modified Header param
+	LastModifiedHeader = "Last-Modified"
+)
+
+const (
+	// PreconditionFailedMessageID is the message id used for requests whose precondition does not hold
+	PreconditionFailedMessageID = "PRECONDITION_FAILED"
+	// PreconditionRequiredMessageID is the message id used for mutating requests without precondition
+	PreconditionRequiredMessageID = "PRECONDITION_REQUIRED"
+)
+
+// ResourceValidators are the validators of the current representation of a resource
+type ResourceValidators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+// ValidatorsFunc returns the validators of the resource targeted by a mutating request, nil when it does not exist
+type ValidatorsFunc func(r *http.Request) (*ResourceValidators, error)
+
+// ConditionalOptions configures the conditional request middleware
+type ConditionalOptions struct {
+	// WeakETags makes the computed ETags weak, for representations that are equivalent rather than byte identical.
+	// Weak tags never satisfy If-Match.
+	WeakETags bool
+	// MaxBufferedSize is the largest body buffered to compute its ETag, DefaultCacheMaxEntrySize when zero. A larger
+	// response is streamed without computed ETag.
+	MaxBufferedSize int64
+	// Validators returns the validators of the resource targeted by a mutating request, see HandlerValidators.
+	// The preconditions of the mutating requests are not evaluated when nil.
+	Validators ValidatorsFunc
+	// PreconditionRoutes select the mutating requests whose preconditions are evaluated, every PUT, PATCH and
+	// DELETE request when empty
+	PreconditionRoutes []RouteMatcher
+	// RequirePrecondition rejects the selected mutating requests without If-Match or If-Unmodified-Since with a 428
+	RequirePrecondition bool
+	// ErrorResponder writes the 412 and 428 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+}
+
+// ConditionalMiddleware is a gorilla mux middleware answering conditional requests
+func ConditionalMiddleware(options ConditionalOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	conditional := newConditionalHandler(options, logger)
+	return func(next http.Handler) http.Handler {
+		return conditional.handler(next)
+	}
+}
+
+// ConditionalWrapper sets an ETag on the successful GET responses, computed from the body unless the handler set
+// one, and answers a matching If-None-Match or If-Modified-Since with a 304. The 304 keeps the other headers of the
+// response, so the Cache-Control: no-store of the security headers still applies. The If-Match, If-None-Match and
+// If-Unmodified-Since of the mutating requests are evaluated against the current validators, a failed
+// precondition is rejected with a 412 before the handler runs.
+func ConditionalWrapper(next http.Handler, options ConditionalOptions, logger log.LoggerType) http.Handler {
+	return newConditionalHandler(options, logger).handler(next)
+}
+
+// HandlerValidators returns a ValidatorsFunc reading the validators of the GET response of the handler, usually
+// the application router, computing the ETag like the conditional middleware when the handler sets none
+func HandlerValidators(handler http.Handler, weakETags bool) ValidatorsFunc {
+	return func(r *http.Request) (*ResourceValidators, error) {
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		get.Body = http.NoBody
+		get.ContentLength = 0
+		for _, name := range []string{IfMatchHeader, IfNoneMatchHeader, IfModifiedSinceHeader, IfUnmodifiedSinceHeader} {
+			get.Header.Del(name)
+		}
+
+		response := &bufferedResponse{header: http.Header{}}
+		handler.ServeHTTP(response, get)
+		if response.status == 0 {
+			response.status = http.StatusOK
+		}
+		if response.status == http.StatusNotFound || response.status == http.StatusGone {
+			return nil, nil
+		}
+		if response.status != http.StatusOK {
+			return nil, fmt.Errorf("reading the current resource returned status %d", response.status)
+		}
+		validators := &ResourceValidators{ETag: response.header.Get(ETagHeader)}
+		if validators.ETag == "" {
+			validators.ETag = computeETag(response.body.Bytes(), weakETags)
+		}
+		validators.LastModified, _ = http.ParseTime(response.header.Get(LastModifiedHeader))
+		return validators, nil
+	}
+}
+
+type conditionalHandler struct {
+	options ConditionalOptions
+	logger  log.LoggerType
+}
+
+// newConditionalHandler applies the option defaults
+func newConditionalHandler(options ConditionalOptions, logger log.LoggerType) *conditionalHandler {
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	if options.MaxBufferedSize <= 0 {
+		options.MaxBufferedSize = DefaultCacheMaxEntrySize
+	}
+	return &conditionalHandler{options: options, logger: logger}
+}
+
+func (c *conditionalHandler) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			c.serveRead(w, r, next)
+		case c.options.selectsPrecondition(r):
+			if c.preconditionsHold(w, r) {
+				next.ServeHTTP(w, r)
+			}
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveRead buffers the response to set its ETag and answer the conditional GET, a flushed, hijacked or oversized
+// response is streamed as is
+func (c *conditionalHandler) serveRead(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.Header.Get(IfNoneMatchHeader) == "" && r.Header.Get(IfModifiedSinceHeader) == "" && r.Method == http.MethodHead {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	ew := &etagWriter{ResponseWriter: w, limit: c.options.MaxBufferedSize}
+	next.ServeHTTP(wrapResponseWriter(ew, w), r)
+	if ew.streaming {
+		return
+	}
+	if ew.status == 0 {
+		ew.status = http.StatusOK
+	}
+
+	header := w.Header()
+	if ew.status == http.StatusOK {
+		etag := header.Get(ETagHeader)
+		if etag == "" && r.Method == http.MethodGet {
+			etag = computeETag(ew.body.Bytes(), c.options.WeakETags)
+			header.Set(ETagHeader, etag)
+		}
+		if notModified(r, etag, header.Get(LastModifiedHeader)) {
+			for _, name := range []string{contentTypeHeader, contentLengthHeader} {
+				header.Del(name)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.WriteHeader(ew.status)
+	w.Write(ew.body.Bytes())
+}
+
+// preconditionsHold evaluates the preconditions of a mutating request, rejecting it when they do not hold
+func (c *conditionalHandler) preconditionsHold(w http.ResponseWriter, r *http.Request) bool {
+	ifMatch := r.Header.Get(IfMatchHeader)
+	ifNoneMatch := r.Header.Get(IfNoneMatchHeader)
+	ifUnmodifiedSince := r.Header.Get(IfUnmodifiedSinceHeader)
+	if ifMatch == "" && ifUnmodifiedSince == "" {
+		if c.options.RequirePrecondition {
+			c.options.ErrorResponder(w, r, http.StatusPreconditionRequired, PreconditionRequiredMessageID, map[string]string{"Header": IfMatchHeader})
+			return false
+		}
+		if ifNoneMatch == "" {
+			return true
+		}
+	}
+	if c.options.Validators == nil {
+		return true
+	}
+
+	validators, err := c.options.Validators(r)
+	if err != nil {
+		c.logger.Errorf("Failed reading the validators of request %s %s, evaluating the preconditions as failed: %v", r.Method, requestURI(r), err)
+	}
+
+	holds := err == nil
+	switch {
+	case !holds:
+	case ifMatch != "":
+		holds = validators != nil && matchesStrongETag(ifMatch, validators.ETag)
+	case ifUnmodifiedSince != "":
+		since, parseErr := http.ParseTime(ifUnmodifiedSince)
+		holds = parseErr != nil || validators != nil && !validators.LastModified.IsZero() && !validators.LastModified.Truncate(time.Second).After(since)
+	}
+	if holds && ifNoneMatch != "" && validators != nil {
+		holds = !matchesETag(ifNoneMatch, validators.ETag)
+	}
+	if !holds {
+		c.options.ErrorResponder(w, r, http.StatusPreconditionFailed, PreconditionFailedMessageID, nil)
+	}
+	return holds
+}
+
+// selectsPrecondition reports whether the preconditions of the mutating request are evaluated
+func (o ConditionalOptions) selectsPrecondition(r *http.Request) bool {
+	if len(o.PreconditionRoutes) == 0 {
+		return r.Method == http.MethodPut || r.Method == http.MethodPatch || r.Method == http.MethodDelete
+	}
+	for i := range o.PreconditionRoutes {
+		if o.PreconditionRoutes[i].Matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there is no If-None-Match
+func notModified(r *http.Request, etag string, lastModified string) bool {
+	if ifNoneMatch := r.Header.Get(IfNoneMatchHeader); ifNoneMatch != "" {
+		return etag != "" && matchesETag(ifNoneMatch, etag)
+	}
+	since, err := http.ParseTime(r.Header.Get(IfModifiedSinceHeader))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	return err == nil && !modified.After(since)
+}
+
+// matchesETag reports whether the list of entity tags holds "*" or the tag, ignoring the weak indicator
+func matchesETag(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesStrongETag reports whether the If-Match list matches the tag, weak tags never match
+func matchesStrongETag(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate == etag && !strings.HasPrefix(etag, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// computeETag returns an entity tag derived from the body
+func computeETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// etagWriter buffers the response until the handler returns or its body exceeds the limit, a flushed, hijacked or
+// oversized response is streamed without ETag
+type etagWriter struct {
+	http.ResponseWriter
+	limit     int64
+	status    int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (w *etagWriter) WriteHeader(code int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *etagWriter) Write(b []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if int64(w.body.Len()+len(b)) > w.limit {
+		w.stream()
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+func (w *etagWriter) Flush() {
+	w.stream()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, nothing is written to the response once it returns
+func (w *etagWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.streaming = true
+	return hijacker.Hijack()
+}
+
+// stream writes the buffered response, the later writes go through
+func (w *etagWriter) stream() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.body.Bytes())
+	w.body.Reset()
+}
+
+// bufferedResponse is a standalone response writer keeping the response in memory
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
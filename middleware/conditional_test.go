@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type testResource struct {
+	body         string
+	lastModified time.Time
+}
+
+func setupConditionalRouter(resource *testResource, options ConditionalOptions) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.HandleFunc("/api/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		if resource.body == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(contentTypeHeader, "application/json")
+		w.Header().Set(LastModifiedHeader, resource.lastModified.UTC().Format(http.TimeFormat))
+		w.Write([]byte(resource.body))
+	}).Methods("GET")
+	appRouter.HandleFunc("/api/assets/1", func(w http.ResponseWriter, r *http.Request) {
+		resource.body = `{"id":1,"name":"updated"}`
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PATCH", "PUT")
+	appRouter.HandleFunc("/api/assets/2", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ETagHeader, `"handler-tag"`)
+		w.Write([]byte(`{"id":2}`))
+	}).Methods("GET")
+
+	if options.Validators == nil {
+		options.Validators = HandlerValidators(appRouter, options.WeakETags)
+	}
+	appRouter.Use(SecurityPolicyMiddleware(DefaultSecurityPolicy()))
+	appRouter.Use(ConditionalMiddleware(options, log.NewLogger("", "")))
+	return appRouter
+}
+
+func conditionalRequest(appRouter *mux.Router, method string, target string, header string, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(`{"name":"updated"}`))
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w
+}
+
+func Test_Conditional_Answers_If_None_Match_With_304(t *testing.T) {
+	resource := &testResource{body: `{"id":1}`, lastModified: time.Now()}
+	appRouter := setupConditionalRouter(resource, ConditionalOptions{})
+
+	w := conditionalRequest(appRouter, "GET", "/api/assets/1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get(ETagHeader)
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, etag)
+	assert.Equal(t, `{"id":1}`, w.Body.String())
+
+	w = conditionalRequest(appRouter, "GET", "/api/assets/1", IfNoneMatchHeader, `"other", `+etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get(ETagHeader))
+	assert.Equal(t, "no-store", w.Header().Get(CacheControlHeader), "The 304 should keep the security headers")
+	assert.Empty(t, w.Header().Get(contentTypeHeader))
+
+	w = conditionalRequest(appRouter, "GET", "/api/assets/1", IfNoneMatchHeader, `"other"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = conditionalRequest(appRouter, "GET", "/api/assets/2", IfNoneMatchHeader, `W/"handler-tag"`)
+	assert.Equal(t, http.StatusNotModified, w.Code, "Handler ETags should be used")
+}
+
+func Test_Conditional_Answers_If_Modified_Since(t *testing.T) {
+	lastModified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	appRouter := setupConditionalRouter(&testResource{body: `{"id":1}`, lastModified: lastModified}, ConditionalOptions{WeakETags: true})
+
+	w := conditionalRequest(appRouter, "GET", "/api/assets/1", IfModifiedSinceHeader, lastModified.Format(http.TimeFormat))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get(ETagHeader), `W/"`))
+
+	w = conditionalRequest(appRouter, "GET", "/api/assets/1", IfModifiedSinceHeader, lastModified.Add(-time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_Conditional_Evaluates_If_Match_On_Mutating_Requests(t *testing.T) {
+	var messageIDs []string
+	resource := &testResource{body: `{"id":1}`, lastModified: time.Now()}
+	appRouter := setupConditionalRouter(resource, ConditionalOptions{
+		RequirePrecondition: true,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, messageID string, data map[string]string) {
+			messageIDs = append(messageIDs, messageID)
+			w.WriteHeader(status)
+		},
+	})
+	etag := conditionalRequest(appRouter, "GET", "/api/assets/1", "", "").Header().Get(ETagHeader)
+
+	assert.Equal(t, http.StatusPreconditionRequired, conditionalRequest(appRouter, "PATCH", "/api/assets/1", "", "").Code)
+	assert.Equal(t, http.StatusNoContent, conditionalRequest(appRouter, "PATCH", "/api/assets/1", IfMatchHeader, etag).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, conditionalRequest(appRouter, "PATCH", "/api/assets/1", IfMatchHeader, etag).Code,
+		"The lost update should be rejected")
+	assert.Equal(t, []string{PreconditionRequiredMessageID, PreconditionFailedMessageID}, messageIDs)
+
+	resource.body = ""
+	assert.Equal(t, http.StatusPreconditionFailed, conditionalRequest(appRouter, "PUT", "/api/assets/1", IfMatchHeader, "*").Code,
+		"If-Match * should fail for a missing resource")
+}
+
+func Test_Conditional_If_Match_Uses_Strong_Comparison(t *testing.T) {
+	resource := &testResource{body: `{"id":1}`, lastModified: time.Now()}
+	appRouter := setupConditionalRouter(resource, ConditionalOptions{})
+	etag := conditionalRequest(appRouter, "GET", "/api/assets/1", "", "").Header().Get(ETagHeader)
+
+	assert.Equal(t, http.StatusPreconditionFailed, conditionalRequest(appRouter, "PATCH", "/api/assets/1", IfMatchHeader, "W/"+etag).Code,
+		"A weak tag should not satisfy If-Match")
+	assert.Equal(t, http.StatusNotModified, conditionalRequest(appRouter, "GET", "/api/assets/1", IfNoneMatchHeader, "W/"+etag).Code,
+		"If-None-Match should keep the weak comparison")
+
+	weak := setupConditionalRouter(resource, ConditionalOptions{WeakETags: true})
+	weakETag := conditionalRequest(weak, "GET", "/api/assets/1", "", "").Header().Get(ETagHeader)
+	assert.Equal(t, http.StatusPreconditionFailed, conditionalRequest(weak, "PATCH", "/api/assets/1", IfMatchHeader, weakETag).Code)
+}
+
+func Test_Conditional_Matches_Tags_Of_Compressed_Representations(t *testing.T) {
+	resource := &testResource{body: `{"id":1}`, lastModified: time.Now()}
+	handler := CompressionMiddleware(CompressionOptions{MinSize: 1}, log.NewLogger("", ""))(setupConditionalRouter(resource, ConditionalOptions{}))
+	send := func(method string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/assets/1", strings.NewReader(`{"name":"updated"}`))
+		req.Header.Set(AcceptEncodingHeader, EncodingGzip)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	etag := send("GET", "", "").Header().Get(ETagHeader)
+	assert.Regexp(t, `^"[0-9a-f]{32}-gzip"$`, etag, "The compressed representation should have its own strong tag")
+	w := send("GET", IfNoneMatchHeader, etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, etag, w.Header().Get(ETagHeader))
+	assert.Equal(t, http.StatusNoContent, send("PATCH", IfMatchHeader, etag).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, send("PATCH", IfMatchHeader, etag).Code, "The lost update should be rejected")
+}
+
+func Test_Conditional_Streams_Oversized_Responses_Without_ETag(t *testing.T) {
+	body := strings.Repeat("a", 64)
+	handler := ConditionalWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body[:32]))
+		w.Write([]byte(body[32:]))
+	}), ConditionalOptions{MaxBufferedSize: 48}, log.NewLogger("", ""))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/assets/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, body, w.Body.String())
+	assert.Empty(t, w.Header().Get(ETagHeader), "An oversized response should not get a computed ETag")
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func Test_Conditional_Does_Not_Write_To_Hijacked_Connections(t *testing.T) {
+	handler := ConditionalWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Hijacker).Hijack()
+	}), ConditionalOptions{}, log.NewLogger("", ""))
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ws", nil))
+	assert.True(t, w.hijacked)
+	assert.False(t, w.Flushed)
+	assert.Empty(t, w.Header().Get(ETagHeader), "Nothing should be written once the connection is hijacked")
+	assert.Empty(t, w.Body.String())
+}
+
+func Test_Conditional_Evaluates_If_Unmodified_Since_And_If_None_Match(t *testing.T) {
+	lastModified := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	resource := &testResource{body: `{"id":1}`, lastModified: lastModified}
+	appRouter := setupConditionalRouter(resource, ConditionalOptions{})
+
+	assert.Equal(t, http.StatusPreconditionFailed,
+		conditionalRequest(appRouter, "PATCH", "/api/assets/1", IfUnmodifiedSinceHeader, lastModified.Add(-time.Hour).Format(http.TimeFormat)).Code)
+	assert.Equal(t, http.StatusNoContent,
+		conditionalRequest(appRouter, "PATCH", "/api/assets/1", IfUnmodifiedSinceHeader, lastModified.Format(http.TimeFormat)).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, conditionalRequest(appRouter, "PUT", "/api/assets/1", IfNoneMatchHeader, "*").Code,
+		"If-None-Match * should fail for an existing resource")
+	assert.Equal(t, http.StatusNoContent, conditionalRequest(appRouter, "PUT", "/api/assets/1", "", "").Code)
+}
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OriginHeader represents the Origin Header param
+const OriginHeader = "Origin"
+
+// VaryHeader represents the Vary Header param
+const VaryHeader = "Vary"
+
+const (
+	accessControlAllowOrigin      = "Access-Control-Allow-Origin"
+	accessControlAllowMethods     = "Access-Control-Allow-Methods"
+	accessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	accessControlAllowCredentials = "Access-Control-Allow-Credentials"
+	accessControlExposeHeaders    = "Access-Control-Expose-Headers"
+	accessControlMaxAge           = "Access-Control-Max-Age"
+	accessControlRequestMethod    = "Access-Control-Request-Method"
+	accessControlRequestHeaders   = "Access-Control-Request-Headers"
+)
+
+// DefaultCORSAllowedMethods are the methods allowed when CORSOptions.AllowedMethods is empty
+var DefaultCORSAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// DefaultCORSAllowedHeaders are the request headers allowed when CORSOptions.AllowedHeaders is empty
+var DefaultCORSAllowedHeaders = []string{"Accept", "Accept-Language", "Content-Type", "Authorization", RequestIDHeader}
+
+// DefaultCORSExposedHeaders are the response headers exposed when CORSOptions.ExposedHeaders is nil
+var DefaultCORSExposedHeaders = []string{RequestIDHeader}
+
+// CORSOptions configures the CORS middleware
+type CORSOptions struct {
+	// AllowedOrigins lists the exact origins, or wildcard origins such as https://*.example.com.
+	// A single "*" allows any origin, it cannot be combined with AllowCredentials.
+	AllowedOrigins []string
+	// AllowedOriginPatterns are regular expressions the whole origin must match
+	AllowedOriginPatterns []string
+	// AllowedMethods are the methods allowed for cross-origin requests, DefaultCORSAllowedMethods when empty
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed for cross-origin requests, DefaultCORSAllowedHeaders
+	// when empty. A single "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers readable by the browser, DefaultCORSExposedHeaders when nil
+	ExposedHeaders []string
+	// AllowCredentials allows cookies and authorization headers on cross-origin requests
+	AllowCredentials bool
+	// MaxAge is how long the browser may cache the preflight response, not sent when zero
+	MaxAge time.Duration
+}
+
+// CORS handles the cross-origin requests
+type CORS struct {
+	options        CORSOptions
+	allowAll       bool
+	origins        []*regexp.Regexp
+	allowedMethods []string
+	allowedHeaders []string
+	allowAnyHeader bool
+}
+
+// NewCORS compiles the allowed origins, rejecting invalid origin patterns and the "*" origin with credentials
+func NewCORS(options CORSOptions) (*CORS, error) {
+	c := &CORS{options: options, allowedMethods: options.AllowedMethods, allowedHeaders: options.AllowedHeaders}
+	for _, origin := range options.AllowedOrigins {
+		if origin == "*" {
+			if options.AllowCredentials {
+				return nil, errors.New(`the "*" origin cannot be allowed with credentials`)
+			}
+			c.allowAll = true
+			continue
+		}
+		expr := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(origin)), `\*`, `[a-z0-9.-]+`)
+		c.origins = append(c.origins, regexp.MustCompile("^"+expr+"$"))
+	}
+	for _, pattern := range options.AllowedOriginPatterns {
+		origin, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin pattern %q: %w", pattern, err)
+		}
+		c.origins = append(c.origins, origin)
+	}
+	if len(c.allowedMethods) == 0 {
+		c.allowedMethods = DefaultCORSAllowedMethods
+	}
+	if len(c.allowedHeaders) == 0 {
+		c.allowedHeaders = DefaultCORSAllowedHeaders
+	}
+	c.allowAnyHeader = len(c.allowedHeaders) == 1 && c.allowedHeaders[0] == "*"
+	if c.options.ExposedHeaders == nil {
+		c.options.ExposedHeaders = DefaultCORSExposedHeaders
+	}
+	return c, nil
+}
+
+// Middleware returns a gorilla mux middleware handling cross-origin requests. Mux only runs middlewares for
+// matched routes, so routes must also accept OPTIONS for the preflight to reach it; use Wrapper around the router
+// to answer preflights for every route.
+func (c *CORS) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return c.handler(next)
+	}
+}
+
+// Wrapper handles cross-origin requests, answering OPTIONS preflights itself
+func (c *CORS) Wrapper(next http.Handler) http.Handler {
+	return c.handler(next)
+}
+
+func (c *CORS) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(OriginHeader)
+		if r.Method == http.MethodOptions && r.Header.Get(accessControlRequestMethod) != "" {
+			c.preflight(w, r, origin)
+			return
+		}
+
+		w.Header().Add(VaryHeader, OriginHeader)
+		if origin != "" && c.originAllowed(origin) {
+			c.setAllowOrigin(w, origin)
+			if len(c.options.ExposedHeaders) > 0 {
+				w.Header().Set(accessControlExposeHeaders, strings.Join(c.options.ExposedHeaders, ", "))
+			}
+		}
+
+		// call next
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers the OPTIONS preflight request, rejecting origins, methods and headers that are not allowed
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	header := w.Header()
+	header.Add(VaryHeader, OriginHeader)
+	header.Add(VaryHeader, accessControlRequestMethod)
+	header.Add(VaryHeader, accessControlRequestHeaders)
+
+	requestedMethod := r.Header.Get(accessControlRequestMethod)
+	requestedHeaders := parseHeaderList(r.Header.Get(accessControlRequestHeaders))
+	if origin == "" || !c.originAllowed(origin) || !containsFold(c.allowedMethods, requestedMethod) || !c.headersAllowed(requestedHeaders) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	c.setAllowOrigin(w, origin)
+	header.Set(accessControlAllowMethods, strings.Join(c.allowedMethods, ", "))
+	if len(requestedHeaders) > 0 {
+		header.Set(accessControlAllowHeaders, strings.Join(requestedHeaders, ", "))
+	}
+	if c.options.MaxAge > 0 {
+		header.Set(accessControlMaxAge, strconv.Itoa(int(c.options.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) setAllowOrigin(w http.ResponseWriter, origin string) {
+	if c.allowAll {
+		w.Header().Set(accessControlAllowOrigin, "*")
+	} else {
+		w.Header().Set(accessControlAllowOrigin, origin)
+	}
+	if c.options.AllowCredentials {
+		w.Header().Set(accessControlAllowCredentials, "true")
+	}
+}
+
+func (c *CORS) originAllowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.origins {
+		if allowed.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) headersAllowed(headers []string) bool {
+	if c.allowAnyHeader {
+		return true
+	}
+	for _, header := range headers {
+		if !containsFold(c.allowedHeaders, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaderList splits a comma separated header list
+func parseHeaderList(value string) []string {
+	var headers []string
+	for _, header := range strings.Split(value, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+	return headers
+}
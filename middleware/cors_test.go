@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupCORSRouter(t *testing.T, options CORSOptions) http.Handler {
+	appRouter := mux.NewRouter()
+	appRouter.Use(SecurityWrapper)
+	appRouter.HandleFunc("/api/assets", successHandler).Methods("GET", "POST")
+	cors, err := NewCORS(options)
+	if err != nil {
+		t.Fatalf("Not expecting error creating CORS: %v", err)
+	}
+	return cors.Wrapper(appRouter)
+}
+
+func Test_CORS_Answers_Preflight(t *testing.T) {
+	handler := setupCORSRouter(t, CORSOptions{AllowedOrigins: []string{"https://*.example.com"}, MaxAge: 10 * time.Minute})
+
+	req := httptest.NewRequest("OPTIONS", "/api/assets", nil)
+	req.Header.Set(OriginHeader, "https://ui.example.com")
+	req.Header.Set(accessControlRequestMethod, "POST")
+	req.Header.Set(accessControlRequestHeaders, "content-type, x-request-id")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://ui.example.com", w.Header().Get(accessControlAllowOrigin))
+	assert.Equal(t, "content-type, x-request-id", w.Header().Get(accessControlAllowHeaders))
+	assert.Contains(t, w.Header().Get(accessControlAllowMethods), "POST")
+	assert.Equal(t, "600", w.Header().Get(accessControlMaxAge))
+	assert.Contains(t, w.Header().Values(VaryHeader), OriginHeader)
+}
+
+func Test_CORS_Rejects_Disallowed_Preflight(t *testing.T) {
+	handler := setupCORSRouter(t, CORSOptions{AllowedOrigins: []string{"https://ui.example.com"}})
+
+	for _, tc := range []struct{ origin, method, headers string }{
+		{"https://evil.com", "GET", ""},
+		{"https://ui.example.com", "TRACE", ""},
+		{"https://ui.example.com", "GET", "x-custom"},
+	} {
+		req := httptest.NewRequest("OPTIONS", "/api/assets", nil)
+		req.Header.Set(OriginHeader, tc.origin)
+		req.Header.Set(accessControlRequestMethod, tc.method)
+		req.Header.Set(accessControlRequestHeaders, tc.headers)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Empty(t, w.Header().Get(accessControlAllowOrigin))
+	}
+}
+
+func Test_CORS_Actual_Request_With_Credentials_And_Security_Headers(t *testing.T) {
+	handler := setupCORSRouter(t, CORSOptions{AllowedOriginPatterns: []string{`https://ui-[0-9]+\.example\.com`}, AllowCredentials: true})
+
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	req.Header.Set(OriginHeader, "https://ui-12.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://ui-12.example.com", w.Header().Get(accessControlAllowOrigin))
+	assert.Equal(t, "true", w.Header().Get(accessControlAllowCredentials))
+	assert.Equal(t, RequestIDHeader, w.Header().Get(accessControlExposeHeaders))
+	assert.Equal(t, "no-store", w.Header().Get(CacheControlHeader))
+	assert.Equal(t, OriginHeader, w.Header().Get(VaryHeader))
+}
+
+func Test_CORS_Wildcard_Origin(t *testing.T) {
+	handler := setupCORSRouter(t, CORSOptions{AllowedOrigins: []string{"*"}})
+
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	req.Header.Set(OriginHeader, "https://anywhere.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "*", w.Header().Get(accessControlAllowOrigin))
+
+	other := httptest.NewRequest("GET", "/api/assets", nil)
+	other.Header.Set(OriginHeader, "https://other.com")
+	restricted := httptest.NewRecorder()
+	setupCORSRouter(t, CORSOptions{AllowedOrigins: []string{"https://ui.example.com"}}).ServeHTTP(restricted, other)
+	assert.Empty(t, restricted.Header().Get(accessControlAllowOrigin))
+	assert.Equal(t, http.StatusOK, restricted.Code)
+}
+
+func Test_CORS_Rejects_Invalid_Options(t *testing.T) {
+	_, err := NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	assert.Error(t, err, "Any origin should not be allowed with credentials")
+
+	_, err = NewCORS(CORSOptions{AllowedOriginPatterns: []string{`https://(ui\.example\.com`}})
+	assert.Error(t, err, "An invalid origin pattern should be reported")
+
+	_, err = NewCORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowedOriginPatterns: []string{`https://ui-[0-9]+\.example\.com`}})
+	assert.NoError(t, err)
+}
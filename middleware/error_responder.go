@@ -0,0 +1,21 @@
+package middleware
+
+import "net/http"
+
+// ErrorResponder writes the error response for a request rejected by a middleware. The status is decided by
+// the middleware, the message id selects the localized message. The eemi package provides an implementation
+// writing EEMI responses, see eemi.NewErrorResponder.
+type ErrorResponder func(w http.ResponseWriter, r *http.Request, status int, messageID string, templateData map[string]string)
+
+// DefaultErrorResponder writes the status text, it is used when a middleware has no ErrorResponder configured
+func DefaultErrorResponder(w http.ResponseWriter, r *http.Request, status int, messageID string, templateData map[string]string) {
+	http.Error(w, http.StatusText(status), status)
+}
+
+// orDefaultResponder returns the responder, or DefaultErrorResponder when it is nil
+func orDefaultResponder(responder ErrorResponder) ErrorResponder {
+	if responder == nil {
+		return DefaultErrorResponder
+	}
+	return responder
+}
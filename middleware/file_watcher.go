@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileWatcher polls the modification time of files and calls reload when any of them changes
+type fileWatcher struct {
+	files    []string
+	reload   func()
+	modTimes map[string]time.Time
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// watchFiles starts polling the files every interval, nothing is watched when the interval is not positive
+func watchFiles(files []string, interval time.Duration, reload func()) *fileWatcher {
+	fw := &fileWatcher{files: files, reload: reload, modTimes: map[string]time.Time{}, stop: make(chan struct{})}
+	fw.changed()
+	if interval > 0 {
+		go fw.run(interval)
+	}
+	return fw
+}
+
+func (fw *fileWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if fw.changed() {
+				fw.reload()
+			}
+		case <-fw.stop:
+			return
+		}
+	}
+}
+
+// changed records the current modification times and reports whether any of them differs from the last poll
+func (fw *fileWatcher) changed() bool {
+	changed := false
+	for _, file := range fw.files {
+		var modTime time.Time
+		if info, err := os.Stat(file); err == nil {
+			modTime = info.ModTime()
+		}
+		if !modTime.Equal(fw.modTimes[file]) {
+			fw.modTimes[file] = modTime
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Stop stops polling the files
+func (fw *fileWatcher) Stop() {
+	fw.once.Do(func() { close(fw.stop) })
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileWatcher_Reloads_On_Change(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "watched.json")
+	ioutil.WriteFile(file, []byte("v1"), 0600)
+
+	reloads := make(chan struct{}, 10)
+	fw := watchFiles([]string{file}, 10*time.Millisecond, func() { reloads <- struct{}{} })
+	defer fw.Stop()
+
+	future := time.Now().Add(time.Minute)
+	ioutil.WriteFile(file, []byte("v2"), 0600)
+	os.Chtimes(file, future, future)
+
+	select {
+	case <-reloads:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expecting reload after file change")
+	}
+}
+
+func Test_FileWatcher_Without_Interval_Does_Not_Poll(t *testing.T) {
+	fw := watchFiles([]string{"missing.json"}, 0, func() { t.Error("Not expecting reload") })
+	fw.Stop()
+	fw.Stop()
+	assert.False(t, fw.changed())
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+const (
+	// IdempotencyKeyHeader represents the Idempotency-Key Header param
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set to "true" on the replayed responses
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	// IdempotencyConflictMessageID is the message id used for a retry received while the first request still runs
+	IdempotencyConflictMessageID = "IDEMPOTENCY_CONFLICT"
+	// IdempotencyMismatchMessageID is the message id used for a key reused with a different request
+	IdempotencyMismatchMessageID = "IDEMPOTENCY_KEY_MISMATCH"
+)
+
+// DefaultIdempotencyTTL is how long the responses are kept by default
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the keys accepted from the clients
+const maxIdempotencyKeyLength = 255
+
+// idempotencyExcludedHeaders are the response headers not replayed, they belong to the retry
+var idempotencyExcludedHeaders = []string{RequestIDHeader, "Date", "Set-Cookie"}
+
+// IdempotencyOptions configures the idempotency middleware
+type IdempotencyOptions struct {
+	// Routes select the requests honoring the Idempotency-Key, every POST and PATCH request when empty
+	Routes []RouteMatcher
+	// Required rejects the selected requests without Idempotency-Key with a 400
+	Required bool
+	// TTL is how long the responses are replayed, DefaultIdempotencyTTL when zero
+	TTL time.Duration
+	// Store keeps the records, a MemoryIdempotencyStore when nil
+	Store IdempotencyStore
+	// ErrorResponder writes the 400, 409 and 422 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+}
+
+// IdempotencyMiddleware is a gorilla mux middleware replaying the response of requests retried with the same
+// Idempotency-Key
+func IdempotencyMiddleware(options IdempotencyOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	deduplicator := newIdempotencyHandler(options, logger)
+	return func(next http.Handler) http.Handler {
+		return deduplicator.handler(next)
+	}
+}
+
+// IdempotencyWrapper runs the first request of an Idempotency-Key and stores its response, which is replayed to
+// the retries with the same key and request. A retry received while the first request runs gets a 409, a key
+// reused with a different method, path or body gets a 422. Keys are scoped to the token subject when
+// authenticated, and 5xx responses are not stored so the request can be retried. It must run inside the timeout
+// layer, in the handler goroutine, so the key of a timed out request stays in use until the handler returns.
+func IdempotencyWrapper(next http.Handler, options IdempotencyOptions, logger log.LoggerType) http.Handler {
+	return newIdempotencyHandler(options, logger).handler(next)
+}
+
+type idempotencyHandler struct {
+	options IdempotencyOptions
+	logger  log.LoggerType
+}
+
+// newIdempotencyHandler applies the option defaults, the store is created once so every request shares the records
+func newIdempotencyHandler(options IdempotencyOptions, logger log.LoggerType) *idempotencyHandler {
+	if options.TTL == 0 {
+		options.TTL = DefaultIdempotencyTTL
+	}
+	if options.Store == nil {
+		options.Store = NewMemoryIdempotencyStore()
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	return &idempotencyHandler{options: options, logger: logger}
+}
+
+func (h *idempotencyHandler) handler(next http.Handler) http.Handler {
+	options := h.options
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !options.selects(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" || len(idempotencyKey) > maxIdempotencyKeyLength {
+			if options.Required || idempotencyKey != "" {
+				options.ErrorResponder(w, r, http.StatusBadRequest, BadRequestMessageID, map[string]string{"Header": IdempotencyKeyHeader})
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		fingerprint, err := requestFingerprint(r)
+		if err != nil {
+			h.logger.Warnf("Failed reading the body of request %s %s: %v", r.Method, requestURI(r), err)
+			options.ErrorResponder(w, r, http.StatusBadRequest, BadRequestMessageID, nil)
+			return
+		}
+
+		key := idempotencyKey
+		if claims := GetClaims(r); claims != nil {
+			key = claims.Subject + "|" + idempotencyKey
+		}
+		existing, reserved, err := options.Store.Reserve(r.Context(), key, fingerprint, options.TTL)
+		if err != nil {
+			h.logger.Errorf("Idempotency store failed, running request without deduplication: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !reserved {
+			h.respondExisting(w, r, existing, fingerprint)
+			return
+		}
+
+		// the record is stored even when the deadline of the request has expired
+		ctx := detachedContext{r.Context()}
+		recorder := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// the handler panicked or failed, let the client retry
+			if !completed {
+				if err := options.Store.Release(ctx, key); err != nil {
+					h.logger.Errorf("Failed releasing idempotency key: %v", err)
+				}
+			}
+		}()
+
+		// call next
+		next.ServeHTTP(wrapResponseWriter(recorder, w), r)
+
+		if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+			return
+		}
+		record := IdempotencyRecord{Fingerprint: fingerprint, Status: recorder.status, Header: recorder.header, Body: recorder.body.Bytes()}
+		if err := options.Store.Complete(ctx, key, record, options.TTL); err != nil {
+			h.logger.Errorf("Failed storing idempotent response: %v", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// respondExisting replays the stored response, or rejects the retry when the key is in use or reused
+func (h *idempotencyHandler) respondExisting(w http.ResponseWriter, r *http.Request, existing *IdempotencyRecord, fingerprint string) {
+	if existing.Fingerprint != fingerprint {
+		h.logger.Warnf("Idempotency key of request %s %s was used with a different request", r.Method, requestURI(r))
+		h.options.ErrorResponder(w, r, http.StatusUnprocessableEntity, IdempotencyMismatchMessageID, nil)
+		return
+	}
+	if !existing.Completed {
+		h.options.ErrorResponder(w, r, http.StatusConflict, IdempotencyConflictMessageID, nil)
+		return
+	}
+
+	header := w.Header()
+	for name, values := range existing.Header {
+		header[name] = values
+	}
+	header.Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(existing.Status)
+	w.Write(existing.Body)
+}
+
+// selects reports whether the request honors the Idempotency-Key
+func (o IdempotencyOptions) selects(r *http.Request) bool {
+	if len(o.Routes) == 0 {
+		return r.Method == http.MethodPost || r.Method == http.MethodPatch
+	}
+	for i := range o.Routes {
+		if o.Routes[i].Matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFingerprint hashes the method, path, query and body of the request, the body is restored for the handler
+func requestFingerprint(r *http.Request) (string, error) {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + requestURI(r) + "\n"))
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash.Write(body)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// idempotencyRecorder writes through while keeping a copy of the response
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *idempotencyRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+		for _, name := range idempotencyExcludedHeaders {
+			w.header.Del(name)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *idempotencyRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyRecord is the state of an idempotency key: reserved while its first request runs, then holding the
+// response replayed to the retries
+type IdempotencyRecord struct {
+	// Fingerprint identifies the request the key was first used with
+	Fingerprint string
+	// Completed is false while the first request runs
+	Completed bool
+	Status    int
+	Header    http.Header
+	Body      []byte
+}
+
+// IdempotencyStore keeps the idempotency records. The in-memory store suits a single instance, implement the
+// interface over a shared backend to deduplicate across instances.
+type IdempotencyStore interface {
+	// Reserve stores a running record for the key when there is none and returns true, otherwise it returns the
+	// existing record and false
+	Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error)
+	// Complete stores the response of the reserved key
+	Complete(ctx context.Context, key string, record IdempotencyRecord, ttl time.Duration) error
+	// Release drops the record of the key, so the request can be retried
+	Release(ctx context.Context, key string) error
+}
+
+// idempotencySweepInterval is how often the in-memory store drops expired records
+const idempotencySweepInterval = time.Minute
+
+type idempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// MemoryIdempotencyStore is an in-memory IdempotencyStore expiring the records after their ttl
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewMemoryIdempotencyStore creates an empty in-memory store
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: map[string]*idempotencyEntry{}, now: time.Now}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expiresAt) {
+		record := entry.record
+		return &record, false, nil
+	}
+	s.entries[key] = &idempotencyEntry{record: IdempotencyRecord{Fingerprint: fingerprint}, expiresAt: now.Add(ttl)}
+	return nil, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, record IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.Completed = true
+	s.entries[key] = &idempotencyEntry{record: record, expiresAt: s.now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// sweep drops the expired records
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < idempotencySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MemoryIdempotencyStore_Expires_Records(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryIdempotencyStore()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	_, reserved, err := store.Reserve(ctx, "key", "fingerprint", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	existing, reserved, _ := store.Reserve(ctx, "key", "fingerprint", time.Minute)
+	assert.False(t, reserved)
+	assert.False(t, existing.Completed)
+
+	assert.NoError(t, store.Complete(ctx, "key", IdempotencyRecord{Fingerprint: "fingerprint", Status: 201}, time.Hour))
+	now = now.Add(30 * time.Minute)
+	existing, reserved, _ = store.Reserve(ctx, "key", "fingerprint", time.Minute)
+	assert.False(t, reserved)
+	assert.True(t, existing.Completed)
+	assert.Equal(t, 201, existing.Status)
+
+	now = now.Add(time.Hour)
+	_, reserved, _ = store.Reserve(ctx, "key", "fingerprint", time.Minute)
+	assert.True(t, reserved, "Expired records should be replaced")
+	assert.Len(t, store.entries, 1)
+
+	assert.NoError(t, store.Release(ctx, "key"))
+	_, reserved, _ = store.Reserve(ctx, "key", "fingerprint", time.Minute)
+	assert.True(t, reserved, "Released keys can be reserved again")
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupIdempotencyRouter(options IdempotencyOptions, handler http.HandlerFunc) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(IdempotencyMiddleware(options, log.NewLogger("", "")))
+	appRouter.HandleFunc("/api/assets", handler)
+	return appRouter
+}
+
+func idempotentRequest(appRouter *mux.Router, method string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/assets", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w
+}
+
+func Test_Idempotency_Replays_Stored_Response(t *testing.T) {
+	var calls int32
+	appRouter := setupIdempotencyRouter(IdempotencyOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Location", "/api/assets/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	})
+
+	first := idempotentRequest(appRouter, "POST", "key-1", `{"name":"asset"}`)
+	replay := idempotentRequest(appRouter, "POST", "key-1", `{"name":"asset"}`)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "The handler should run once")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, http.StatusCreated, replay.Code)
+	assert.Equal(t, `{"id":1}`, replay.Body.String())
+	assert.Equal(t, "/api/assets/1", replay.Header().Get("Location"))
+	assert.Equal(t, "true", replay.Header().Get(IdempotentReplayedHeader))
+
+	idempotentRequest(appRouter, "POST", "", `{"name":"asset"}`)
+	idempotentRequest(appRouter, "GET", "key-2", "")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "Requests without key and GET requests are not deduplicated")
+}
+
+func Test_Idempotency_Rejects_Mismatch_And_Concurrent_Duplicates(t *testing.T) {
+	var messageIDs []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+	appRouter := setupIdempotencyRouter(IdempotencyOptions{
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, messageID string, data map[string]string) {
+			messageIDs = append(messageIDs, messageID)
+			w.WriteHeader(status)
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- idempotentRequest(appRouter, "POST", "key-1", `{"name":"asset"}`)
+	}()
+	<-started
+
+	assert.Equal(t, http.StatusConflict, idempotentRequest(appRouter, "POST", "key-1", `{"name":"asset"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, idempotentRequest(appRouter, "POST", "key-1", `{"name":"other"}`).Code)
+	close(release)
+	assert.Equal(t, http.StatusCreated, (<-done).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, idempotentRequest(appRouter, "PATCH", "key-1", `{"name":"asset"}`).Code)
+	assert.Equal(t, []string{IdempotencyConflictMessageID, IdempotencyMismatchMessageID, IdempotencyMismatchMessageID}, messageIDs)
+}
+
+func Test_Idempotency_Does_Not_Store_Server_Errors(t *testing.T) {
+	var calls int32
+	appRouter := setupIdempotencyRouter(IdempotencyOptions{}, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	assert.Equal(t, http.StatusServiceUnavailable, idempotentRequest(appRouter, "POST", "key-1", `{}`).Code)
+	assert.Equal(t, http.StatusCreated, idempotentRequest(appRouter, "POST", "key-1", `{}`).Code)
+	assert.Equal(t, http.StatusCreated, idempotentRequest(appRouter, "POST", "key-1", `{}`).Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func Test_Idempotency_Required_Key_On_Routes(t *testing.T) {
+	appRouter := setupIdempotencyRouter(IdempotencyOptions{
+		Routes:   []RouteMatcher{{Route: "/api/assets", Methods: []string{"PUT"}}},
+		Required: true,
+	}, successHandler)
+
+	assert.Equal(t, http.StatusBadRequest, idempotentRequest(appRouter, "PUT", "", `{}`).Code)
+	assert.Equal(t, http.StatusOK, idempotentRequest(appRouter, "PUT", "key-1", `{}`).Code)
+	assert.Equal(t, http.StatusOK, idempotentRequest(appRouter, "POST", "", `{}`).Code, "Only the configured routes are checked")
+}
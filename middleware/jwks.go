@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// verificationKey is a key used to verify token signatures. The key is an *rsa.PublicKey, an
+// *ecdsa.PublicKey or the []byte secret of an HMAC key.
+type verificationKey struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// jsonWebKey is a single key of a JWKS document
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	K       string `json:"k"`
+}
+
+// keySet holds the verification keys loaded from a JWKS file and PEM files
+type keySet struct {
+	mu   sync.RWMutex
+	keys []verificationKey
+}
+
+// candidates returns the keys to try for the key id, every key when the token has no key id
+func (ks *keySet) candidates(keyID string) []verificationKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if keyID == "" {
+		return ks.keys
+	}
+	var keys []verificationKey
+	for _, key := range ks.keys {
+		if key.id == keyID {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// load replaces the keys with the ones read from the files, the current keys are kept on error
+func (ks *keySet) load(jwksFile string, pemFiles []string) error {
+	var keys []verificationKey
+	if jwksFile != "" {
+		jwksKeys, err := loadJWKS(jwksFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, jwksKeys...)
+	}
+	for _, pemFile := range pemFiles {
+		pemKeys, err := loadPEMKeys(pemFile)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, pemKeys...)
+	}
+	if len(keys) == 0 {
+		return errors.New("no verification keys found")
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = keys
+	return nil
+}
+
+func loadJWKS(file string) ([]verificationKey, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("invalid JWKS file %s: %w", file, err)
+	}
+
+	var keys []verificationKey
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in JWKS file %s: %w", jwk.KeyID, file, err)
+		}
+		keys = append(keys, verificationKey{id: jwk.KeyID, key: key})
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.K, "="))
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("missing key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// loadPEMKeys reads the public keys and certificates of a PEM file, using the file name without its
+// extension as key id
+func loadPEMKeys(file string) ([]verificationKey, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	keyID := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+	var keys []verificationKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var certificate *x509.Certificate
+			certificate, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = certificate.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid PEM block in %s: %w", file, err)
+		}
+		keys = append(keys, verificationKey{id: keyID, key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", file)
+	}
+	return keys, nil
+}
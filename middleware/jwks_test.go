@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_KeySet_Loads_JWKS_And_PEM_Keys(t *testing.T) {
+	keys := newTestKeys(t)
+	ks := &keySet{}
+
+	assert.Nil(t, ks.load(keys.jwksFile, []string{keys.pemFile}))
+	assert.Len(t, ks.candidates(""), 4)
+	assert.Len(t, ks.candidates("ec-1"), 1)
+	assert.Len(t, ks.candidates("pem-key"), 1)
+	assert.Empty(t, ks.candidates("unknown"))
+}
+
+func Test_KeySet_Keeps_Keys_When_Reload_Fails(t *testing.T) {
+	keys := newTestKeys(t)
+	ks := &keySet{}
+	assert.Nil(t, ks.load(keys.jwksFile, nil))
+
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	ioutil.WriteFile(invalid, []byte(`{"keys":[{"kty":"EC","crv":"P-521","x":"AQ","y":"AQ"}]}`), 0600)
+
+	assert.NotNil(t, ks.load(invalid, nil))
+	assert.NotNil(t, ks.load("", nil))
+	assert.NotNil(t, ks.load("", []string{invalid}))
+	assert.Len(t, ks.candidates(""), 3)
+}
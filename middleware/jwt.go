@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmHS256 = "HS256"
+)
+
+// ContextClaimsKey is of type contextKey to save the validated token claims
+const ContextClaimsKey contextKey = "claimsKey"
+
+var (
+	errTokenMalformed   = errors.New("token is malformed")
+	errTokenAlgorithm   = errors.New("token algorithm is not allowed")
+	errTokenSignature   = errors.New("token signature is invalid")
+	errTokenExpired     = errors.New("token is expired")
+	errTokenNoExpiry    = errors.New("token has no expiry")
+	errTokenNotYetValid = errors.New("token is not valid yet")
+	errTokenIssuer      = errors.New("token issuer is not accepted")
+	errTokenAudience    = errors.New("token audience is not accepted")
+)
+
+// Claims are the validated claims of a bearer token
+type Claims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  Audience    `json:"aud"`
+	ExpiresAt NumericDate `json:"exp"`
+	NotBefore NumericDate `json:"nbf"`
+	IssuedAt  NumericDate `json:"iat"`
+	ID        string      `json:"jti"`
+	Scope     string      `json:"scope"`
+	Roles     []string    `json:"roles"`
+	// Raw holds every claim of the token, including the custom ones
+	Raw map[string]interface{} `json:"-"`
+}
+
+// Scopes returns the space delimited scope claim as a list
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// Audience is the aud claim, which may be a single string or a list of strings
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// NumericDate is a JWT date in seconds since the epoch, zero when the claim is missing
+type NumericDate int64
+
+func (d *NumericDate) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+	*d = NumericDate(seconds)
+	return nil
+}
+
+// Time returns the date as a time.Time
+func (d NumericDate) Time() time.Time {
+	return time.Unix(int64(d), 0)
+}
+
+// GetClaims returns the claims of the authenticated request, or nil when the request was not authenticated
+func GetClaims(r *http.Request) *Claims {
+	return ClaimsFromContext(r.Context())
+}
+
+// ClaimsFromContext returns the claims stored in the context, or nil when there are none
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(ContextClaimsKey).(*Claims)
+	return claims
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// tokenValidation holds the checks applied to the token claims
+type tokenValidation struct {
+	algorithms    []string
+	issuers       []string
+	audiences     []string
+	clockSkew     time.Duration
+	requireExpiry bool
+	now           func() time.Time
+}
+
+// parseToken verifies the signature of the compact serialized token against the key set and validates its claims
+func parseToken(token string, keys *keySet, validation tokenValidation) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return nil, errTokenMalformed
+	}
+	if !containsString(validation.algorithms, header.Algorithm) {
+		return nil, errTokenAlgorithm
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys.candidates(header.KeyID) {
+		if verifySignature(header.Algorithm, key.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errTokenSignature
+	}
+
+	claims := &Claims{}
+	if err := decodeTokenPart(parts[1], claims); err != nil {
+		return nil, errTokenMalformed
+	}
+	if err := decodeTokenPart(parts[1], &claims.Raw); err != nil {
+		return nil, errTokenMalformed
+	}
+	return claims, validation.validate(claims)
+}
+
+func decodeTokenPart(part string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(target)
+}
+
+// verifySignature checks the signature, making sure the key type matches the algorithm
+func verifySignature(algorithm string, key crypto.PublicKey, signed []byte, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch algorithm {
+	case AlgorithmRS256:
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	case AlgorithmES256:
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest[:], r, s)
+	case AlgorithmHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	default:
+		return false
+	}
+}
+
+func (v tokenValidation) validate(claims *Claims) error {
+	now := v.now()
+	if claims.ExpiresAt == 0 && v.requireExpiry {
+		return errTokenNoExpiry
+	}
+	if claims.ExpiresAt != 0 && now.After(claims.ExpiresAt.Time().Add(v.clockSkew)) {
+		return errTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(v.clockSkew).Before(claims.NotBefore.Time()) {
+		return errTokenNotYetValid
+	}
+	if len(v.issuers) > 0 && !containsString(v.issuers, claims.Issuer) {
+		return errTokenIssuer
+	}
+	if len(v.audiences) > 0 {
+		accepted := false
+		for _, audience := range claims.Audience {
+			if containsString(v.audiences, audience) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return errTokenAudience
+		}
+	}
+	return nil
+}
+
+// containsString reports whether the value is in the list
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
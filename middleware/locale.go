@@ -3,8 +3,10 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
 
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"golang.org/x/text/language"
@@ -19,31 +21,153 @@ const ContextLangKey contextKey = "langKey"
 // ContextLocalizerKey is of type contextKey to save localizer instance
 const ContextLocalizerKey contextKey = "localizerKey"
 
+const (
+	// AcceptLanguageHeader represents the Accept-Language Header param
+	AcceptLanguageHeader = "Accept-Language"
+	// ContentLanguageHeader represents the Content-Language Header param
+	ContentLanguageHeader = "Content-Language"
+)
+
+// LocaleOptions configures the sources of the locale selection, they are checked in the order query param,
+// cookie, header, claim and finally Accept-Language. An empty source name disables the source.
+type LocaleOptions struct {
+	// QueryParam is the query param overriding the locale, e.g. "lang"
+	QueryParam string
+	// Cookie is the cookie holding the locale preference
+	Cookie string
+	// Header is the header holding the user locale preference
+	Header string
+	// Claim is the bearer token claim holding the user locale preference, nested claims are separated by dots
+	Claim string
+}
+
 // LocaleSelectionMiddleware is a gorilla mux middleware to set language selection for the request
 // based on information provided in the request params else the default language will be utilized
 func LocaleSelectionMiddleware(i18nBundle *i18n.Bundle, languageMatcher language.Matcher, logger log.LoggerType) func(http.Handler) http.Handler {
+	return LocaleSelectionMiddlewareWithOptions(i18nBundle, languageMatcher, LocaleOptions{}, logger)
+}
+
+// LocaleSelectionMiddlewareWithOptions is a gorilla mux middleware selecting the locale from the configured sources
+func LocaleSelectionMiddlewareWithOptions(i18nBundle *i18n.Bundle, languageMatcher language.Matcher, options LocaleOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	selector := newLocaleSelector(i18nBundle, languageMatcher, options, logger)
 	return func(next http.Handler) http.Handler {
-		return LocaleSelectionWrapper(next, i18nBundle, languageMatcher, logger)
+		return selector.handler(next)
 	}
 }
 
+// LocaleSelectionWrapper selects the locale from the Accept-Language header
 func LocaleSelectionWrapper(next http.Handler, i18nBundle *i18n.Bundle, languageMatcher language.Matcher, logger log.LoggerType) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return LocaleSelectionWrapperWithOptions(next, i18nBundle, languageMatcher, LocaleOptions{}, logger)
+}
 
-		// retrieve ACCEPT-LANGUAGE header information
-		acceptLangHeaderValue := r.Header.Get("Accept-Language")
+// LocaleSelectionWrapperWithOptions selects the supported locale matching the first source set on the request and
+// stores it with its localizer in the context. The response carries the selected locale in Content-Language, and
+// the locale is forwarded on outbound service calls, see trace.GetHeaders.
+func LocaleSelectionWrapperWithOptions(next http.Handler, i18nBundle *i18n.Bundle, languageMatcher language.Matcher, options LocaleOptions, logger log.LoggerType) http.Handler {
+	return newLocaleSelector(i18nBundle, languageMatcher, options, logger).handler(next)
+}
 
-		languageTag, _ := language.MatchStrings(languageMatcher, acceptLangHeaderValue)
-		logger.Info("locale: ", languageTag.String())
+type localeSelector struct {
+	bundle  *i18n.Bundle
+	matcher language.Matcher
+	options LocaleOptions
+	logger  log.LoggerType
+	// localizers caches a localizer per matched tag, the matcher bounds the tags to the supported ones
+	localizers sync.Map
+}
+
+func newLocaleSelector(i18nBundle *i18n.Bundle, languageMatcher language.Matcher, options LocaleOptions, logger log.LoggerType) *localeSelector {
+	return &localeSelector{bundle: i18nBundle, matcher: languageMatcher, options: options, logger: logger}
+}
+
+func (s *localeSelector) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		languageTag, source := s.selectLocale(r)
+		locale := languageTag.String()
+		s.logger.Debugf("locale: %s, selected from %s", locale, source)
+
+		header := w.Header()
+		header.Set(ContentLanguageHeader, locale)
+		header.Add(VaryHeader, AcceptLanguageHeader)
+		if s.options.Cookie != "" {
+			header.Add(VaryHeader, "Cookie")
+		}
+		if s.options.Header != "" {
+			header.Add(VaryHeader, s.options.Header)
+		}
 
 		// create new context by adding locale information identified based on provided information
-		newCtx := context.WithValue(r.Context(), ContextLangKey, languageTag.String())
+		newCtx := context.WithValue(r.Context(), ContextLangKey, locale)
+		newCtx = trace.ContextWithLocale(newCtx, locale)
 
 		// add localizer to the context
-		i18nLocalizer := i18n.NewLocalizer(i18nBundle, acceptLangHeaderValue)
-		newCtx = context.WithValue(newCtx, ContextLocalizerKey, i18nLocalizer)
+		newCtx = context.WithValue(newCtx, ContextLocalizerKey, s.localizer(locale))
 
 		// call next
 		next.ServeHTTP(w, r.WithContext(newCtx))
 	})
 }
+
+// selectLocale returns the supported tag matching the first source with a supported locale, and the source name
+func (s *localeSelector) selectLocale(r *http.Request) (language.Tag, string) {
+	if s.options.QueryParam != "" {
+		if tag, ok := s.match(r.URL.Query().Get(s.options.QueryParam)); ok {
+			return tag, "query"
+		}
+	}
+	if s.options.Cookie != "" {
+		if cookie, err := r.Cookie(s.options.Cookie); err == nil {
+			if tag, ok := s.match(cookie.Value); ok {
+				return tag, "cookie"
+			}
+		}
+	}
+	if s.options.Header != "" {
+		if tag, ok := s.match(r.Header.Get(s.options.Header)); ok {
+			return tag, "header"
+		}
+	}
+	if s.options.Claim != "" {
+		if values, ok := (requestAttributes{claims: GetClaims(r)}).lookup("claim." + s.options.Claim); ok && len(values) > 0 {
+			if tag, ok := s.match(values[0]); ok {
+				return tag, "claim"
+			}
+		}
+	}
+
+	languageTag, _ := language.MatchStrings(s.matcher, r.Header.Get(AcceptLanguageHeader))
+	return supportedTag(languageTag), "accept-language"
+}
+
+// match returns the supported tag matching the locale, false when the locale is empty, invalid or unsupported
+func (s *localeSelector) match(locale string) (language.Tag, bool) {
+	if locale == "" {
+		return language.Und, false
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return language.Und, false
+	}
+	matched, _, confidence := s.matcher.Match(tag)
+	if confidence == language.No {
+		return language.Und, false
+	}
+	return supportedTag(matched), true
+}
+
+// localizer returns the cached localizer of the locale
+func (s *localeSelector) localizer(locale string) *i18n.Localizer {
+	if cached, ok := s.localizers.Load(locale); ok {
+		return cached.(*i18n.Localizer)
+	}
+	cached, _ := s.localizers.LoadOrStore(locale, i18n.NewLocalizer(s.bundle, locale))
+	return cached.(*i18n.Localizer)
+}
+
+// supportedTag drops the regional extension the matcher adds for a regional variant of a supported tag
+func supportedTag(tag language.Tag) language.Tag {
+	if stripped, err := tag.SetTypeForKey("rg", ""); err == nil {
+		return stripped
+	}
+	return tag
+}
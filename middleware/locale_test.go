@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
 
 	"github.com/gorilla/mux"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
@@ -77,3 +78,97 @@ func TestLangSelectionMiddlewareWithAcceptLanguageHeaderUnsupportedExpectsENLoca
 	w := httptest.NewRecorder()
 	appRouter.ServeHTTP(w, req)
 }
+
+func setupLocaleOptionsMiddleware(options LocaleOptions, handler http.Handler) *mux.Router {
+
+	i18nBundle := i18n.NewBundle(language.English)
+
+	languageMatcher := language.NewMatcher([]language.Tag{
+		language.English, language.German, language.French,
+	})
+
+	appRouter := mux.NewRouter().StrictSlash(true)
+	appRouter.Use(LocaleSelectionMiddlewareWithOptions(i18nBundle, languageMatcher, options, log.NewLogger("", "")))
+	appRouter.Handle("/", handler).Methods("GET")
+
+	return appRouter
+}
+
+func TestLangSelectionMiddlewareWithOptionsSourcesInPriorityOrder(t *testing.T) {
+
+	options := LocaleOptions{QueryParam: "lang", Cookie: "locale", Header: "X-User-Locale"}
+
+	tests := []struct {
+		name     string
+		target   string
+		cookie   string
+		header   string
+		expected string
+	}{
+		{name: "query param", target: "/?lang=fr", cookie: "de", header: "de", expected: "fr"},
+		{name: "unsupported query param", target: "/?lang=es", cookie: "de", header: "fr", expected: "de"},
+		{name: "cookie", target: "/", cookie: "de", header: "fr", expected: "de"},
+		{name: "header", target: "/", header: "fr", expected: "fr"},
+		{name: "accept language", target: "/", expected: "de"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.target, nil)
+		req.Header.Add("Accept-Language", "de")
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "locale", Value: test.cookie})
+		}
+		if test.header != "" {
+			req.Header.Add("X-User-Locale", test.header)
+		}
+
+		appRouter := setupLocaleOptionsMiddleware(options, verifyMiddlewareFnCall(t, test.expected))
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, req)
+
+		if actual := w.Header().Get(ContentLanguageHeader); actual != test.expected {
+			t.Errorf("%s: expecting Content-Language to be %s but got %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestLangSelectionMiddlewareSetsVaryAndForwardsLocale(t *testing.T) {
+
+	var forwarded string
+	appRouter := setupLocaleOptionsMiddleware(LocaleOptions{Cookie: "locale"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = trace.GetHeaders(r.Context())[trace.AcceptLanguageHeader]
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add("Accept-Language", "de-CH")
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+
+	if forwarded != "de" {
+		t.Errorf("Expecting locale de to be forwarded but got %s", forwarded)
+	}
+	if vary := w.Header().Values(VaryHeader); len(vary) != 2 || vary[0] != AcceptLanguageHeader || vary[1] != "Cookie" {
+		t.Errorf("Expecting Vary on Accept-Language and Cookie but got %v", vary)
+	}
+}
+
+func TestLangSelectionMiddlewareCachesLocalizerPerLocale(t *testing.T) {
+
+	var localizers []*i18n.Localizer
+	appRouter := setupLocaleOptionsMiddleware(LocaleOptions{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		localizers = append(localizers, r.Context().Value(ContextLocalizerKey).(*i18n.Localizer))
+	}))
+
+	for _, locale := range []string{"de", "de-AT", "fr"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add("Accept-Language", locale)
+		appRouter.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if localizers[0] != localizers[1] {
+		t.Errorf("Expecting the localizer to be reused for the same locale")
+	}
+	if localizers[0] == localizers[2] {
+		t.Errorf("Expecting a separate localizer per locale")
+	}
+}
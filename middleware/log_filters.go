@@ -0,0 +1,316 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MaskedLogValue replaces the values of denied headers and masked body fields
+const MaskedLogValue = "****"
+
+// DefaultHeaderDenyList lists the headers whose values are masked in the request log by default
+var DefaultHeaderDenyList = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// LogFilterConfig declares how headers and bodies are redacted in the request log.
+// Headers are logged as a map of header name to value.
+type LogFilterConfig struct {
+	// HeaderAllowList restricts the logged headers to the listed names, all headers are logged when empty
+	HeaderAllowList []string
+	// HeaderDenyList lists the headers whose values are masked, on top of DefaultHeaderDenyList
+	HeaderDenyList []string
+	// LogDefaultDenyList logs the values of the DefaultHeaderDenyList headers not listed in HeaderDenyList
+	LogDefaultDenyList bool
+	// BodyMaskPaths are JSON paths of the body fields to mask, e.g. $.password, $..token or $.items[*].secret.
+	// Bodies that cannot be parsed as JSON are redacted when a mask path applies.
+	BodyMaskPaths []string
+	// Rules are the per-route rules, the first rule matching the request is applied
+	Rules []LogFilterRule
+}
+
+// LogFilterRule adds redaction for the requests selected by its RouteMatcher
+type LogFilterRule struct {
+	RouteMatcher
+	// RedactHeaders replaces all logged headers with RedactedLogMessage
+	RedactHeaders bool
+	// RedactBody replaces the logged bodies with RedactedLogMessage
+	RedactBody bool
+	// HeaderAllowList is added to the config allow list
+	HeaderAllowList []string
+	// HeaderDenyList is added to the config deny list
+	HeaderDenyList []string
+	// BodyMaskPaths are added to the config mask paths
+	BodyMaskPaths []string
+}
+
+// DefaultLogFilterConfig returns the config used when no log filters are provided: sensitive headers are
+// masked and swagger content is removed from logging
+func DefaultLogFilterConfig() LogFilterConfig {
+	return LogFilterConfig{
+		HeaderDenyList: DefaultHeaderDenyList,
+		Rules: []LogFilterRule{
+			{RouteMatcher: RouteMatcher{Route: "**swagger**"}, RedactHeaders: true, RedactBody: true},
+		},
+	}
+}
+
+// NewLogFilters creates log filters applying the declarative config
+func NewLogFilters(config LogFilterConfig) *LogFilters {
+	return &LogFilters{Config: &config}
+}
+
+// requestLogFilter selects the header and body representation logged for a request
+type requestLogFilter interface {
+	headers(r *http.Request) interface{}
+	body(r *http.Request, body []byte) string
+}
+
+// newRequestLogFilter returns the filter for the configured LogFilters
+func newRequestLogFilter(filters *LogFilters) requestLogFilter {
+	if filters == nil {
+		return newConfigLogFilter(DefaultLogFilterConfig())
+	}
+	if filters.Config != nil {
+		return newConfigLogFilter(*filters.Config)
+	}
+	return funcLogFilter{filters}
+}
+
+// funcLogFilter applies the Header and Body filter functions
+type funcLogFilter struct {
+	filters *LogFilters
+}
+
+func (f funcLogFilter) headers(r *http.Request) interface{} {
+	return f.filters.Header(r.RequestURI, r.Header)
+}
+
+func (f funcLogFilter) body(r *http.Request, body []byte) string {
+	return f.filters.Body(r.RequestURI, body)
+}
+
+// configLogFilter applies a LogFilterConfig, parsing the JSON paths once
+type configLogFilter struct {
+	config    LogFilterConfig
+	maskPaths map[string]jsonPath
+}
+
+func newConfigLogFilter(config LogFilterConfig) configLogFilter {
+	if !config.LogDefaultDenyList {
+		config.HeaderDenyList = append(append([]string{}, DefaultHeaderDenyList...), config.HeaderDenyList...)
+	}
+	f := configLogFilter{config: config, maskPaths: map[string]jsonPath{}}
+	paths := append([]string{}, config.BodyMaskPaths...)
+	for _, rule := range config.Rules {
+		paths = append(paths, rule.BodyMaskPaths...)
+	}
+	for _, path := range paths {
+		// unparseable paths are kept as nil so matching bodies are redacted rather than leaked
+		parsed, _ := parseJSONPath(path)
+		f.maskPaths[path] = parsed
+	}
+	return f
+}
+
+func (f configLogFilter) rule(r *http.Request) *LogFilterRule {
+	for i := range f.config.Rules {
+		if f.config.Rules[i].Matches(r) {
+			return &f.config.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (f configLogFilter) headers(r *http.Request) interface{} {
+	allowList := f.config.HeaderAllowList
+	denyList := f.config.HeaderDenyList
+	if rule := f.rule(r); rule != nil {
+		if rule.RedactHeaders {
+			return RedactedLogMessage
+		}
+		allowList = append(append([]string{}, allowList...), rule.HeaderAllowList...)
+		denyList = append(append([]string{}, denyList...), rule.HeaderDenyList...)
+	}
+
+	logged := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		if len(allowList) > 0 && !containsFold(allowList, name) {
+			continue
+		}
+		if containsFold(denyList, name) {
+			logged[name] = MaskedLogValue
+		} else {
+			logged[name] = strings.Join(values, ", ")
+		}
+	}
+	return logged
+}
+
+func (f configLogFilter) body(r *http.Request, body []byte) string {
+	paths := f.config.BodyMaskPaths
+	if rule := f.rule(r); rule != nil {
+		if rule.RedactBody {
+			return RedactedLogMessage
+		}
+		paths = append(append([]string{}, paths...), rule.BodyMaskPaths...)
+	}
+	if len(paths) == 0 || len(body) == 0 {
+		return string(body)
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return RedactedLogMessage
+	}
+	for _, path := range paths {
+		parsed := f.maskPaths[path]
+		if parsed == nil {
+			return RedactedLogMessage
+		}
+		document = parsed.mask(document)
+	}
+
+	masked, err := json.Marshal(document)
+	if err != nil {
+		return RedactedLogMessage
+	}
+	return string(masked)
+}
+
+// jsonPath is a parsed JSON path supporting child names, bracket names, indexes, wildcards and
+// recursive descent, e.g. $.user.password, $['api-key'], $.items[0].id, $.items[*].secret or $..token
+type jsonPath []jsonPathSegment
+
+type jsonPathSegment struct {
+	key       string
+	index     int
+	wildcard  bool
+	recursive bool
+}
+
+func parseJSONPath(path string) (jsonPath, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("json path %q must start with $", path)
+	}
+	parsed := jsonPath{}
+	rest := path[1:]
+	for len(rest) > 0 {
+		segment := jsonPathSegment{index: -1}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			segment.recursive = true
+			rest = rest[2:]
+		case rest[0] == '.':
+			rest = rest[1:]
+		case rest[0] != '[':
+			return nil, fmt.Errorf("unexpected %q in json path %q", rest[0], path)
+		}
+
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket in json path %q", path)
+			}
+			selector := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case selector == "*":
+				segment.wildcard = true
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				segment.key = selector[1 : len(selector)-1]
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid selector %q in json path %q", selector, path)
+				}
+				segment.index = index
+			}
+		} else {
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			segment.key = rest[:end]
+			rest = rest[end:]
+			if segment.key == "" {
+				return nil, fmt.Errorf("empty name in json path %q", path)
+			}
+			if segment.key == "*" {
+				segment.key = ""
+				segment.wildcard = true
+			}
+		}
+		parsed = append(parsed, segment)
+	}
+	return parsed, nil
+}
+
+// mask replaces the values selected by the path with MaskedLogValue and returns the updated document
+func (p jsonPath) mask(document interface{}) interface{} {
+	if len(p) == 0 {
+		return MaskedLogValue
+	}
+	maskSegments(document, p)
+	return document
+}
+
+func maskSegments(node interface{}, segments []jsonPathSegment) {
+	segment, rest := segments[0], segments[1:]
+	if segment.recursive {
+		current := segment
+		current.recursive = false
+		maskSegments(node, append([]jsonPathSegment{current}, rest...))
+		forEachChild(node, func(child interface{}) {
+			maskSegments(child, segments)
+		})
+		return
+	}
+
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		for key, value := range typed {
+			if segment.wildcard || (segment.index < 0 && segment.key == key) {
+				if len(rest) == 0 {
+					typed[key] = MaskedLogValue
+				} else {
+					maskSegments(value, rest)
+				}
+			}
+		}
+	case []interface{}:
+		for i, value := range typed {
+			if segment.wildcard || segment.index == i {
+				if len(rest) == 0 {
+					typed[i] = MaskedLogValue
+				} else {
+					maskSegments(value, rest)
+				}
+			}
+		}
+	}
+}
+
+func forEachChild(node interface{}, fn func(child interface{})) {
+	switch typed := node.(type) {
+	case map[string]interface{}:
+		for _, value := range typed {
+			fn(value)
+		}
+	case []interface{}:
+		for _, value := range typed {
+			fn(value)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LogFilterConfig_Masks_Denied_Headers_As_Map(t *testing.T) {
+	filter := newConfigLogFilter(DefaultLogFilterConfig())
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Accept", "text/plain")
+
+	headers := filter.headers(req).(map[string]string)
+
+	assert.Equal(t, MaskedLogValue, headers["Authorization"])
+	assert.Equal(t, MaskedLogValue, headers["Cookie"])
+	assert.Equal(t, "application/json, text/plain", headers["Accept"])
+}
+
+func Test_LogFilterConfig_Allow_List_And_Route_Rules(t *testing.T) {
+	filter := newConfigLogFilter(LogFilterConfig{
+		HeaderAllowList: []string{"Accept"},
+		Rules: []LogFilterRule{
+			{RouteMatcher: RouteMatcher{Route: "/api/login"}, HeaderAllowList: []string{"X-Client"}, BodyMaskPaths: []string{"$.password"}},
+			{RouteMatcher: RouteMatcher{Route: "/api/files/**"}, RedactHeaders: true, RedactBody: true},
+		},
+	})
+
+	login := httptest.NewRequest("POST", "/api/login", nil)
+	login.Header.Set("Accept", "application/json")
+	login.Header.Set("X-Client", "ui")
+	login.Header.Set("X-Other", "dropped")
+	assert.Equal(t, map[string]string{"Accept": "application/json", "X-Client": "ui"}, filter.headers(login))
+	assert.Equal(t, `{"password":"****","user":"bob"}`, filter.body(login, []byte(`{"user":"bob","password":"pw"}`)))
+
+	files := httptest.NewRequest("GET", "/api/files/a/b", nil)
+	assert.Equal(t, RedactedLogMessage, filter.headers(files))
+	assert.Equal(t, RedactedLogMessage, filter.body(files, []byte("data")))
+}
+
+func Test_LogFilterConfig_Masks_Json_Paths(t *testing.T) {
+	filter := newConfigLogFilter(LogFilterConfig{BodyMaskPaths: []string{"$..token", "$.items[*].secret", "$['api-key']", "$.list[1]"}})
+	req := httptest.NewRequest("POST", "/", nil)
+
+	body := `{"token":"a","nested":{"token":"b","deep":[{"token":"c"}]},"items":[{"secret":"s","id":1}],"api-key":"k","list":[1,2,3]}`
+	masked := filter.body(req, []byte(body))
+
+	assert.Equal(t, `{"api-key":"****","items":[{"id":1,"secret":"****"}],"list":[1,"****",3],"nested":{"deep":[{"token":"****"}],"token":"****"},"token":"****"}`, masked)
+}
+
+func Test_LogFilterConfig_Redacts_Unparseable_Bodies(t *testing.T) {
+	filter := newConfigLogFilter(LogFilterConfig{BodyMaskPaths: []string{"$.password"}})
+	req := httptest.NewRequest("POST", "/", nil)
+	assert.Equal(t, RedactedLogMessage, filter.body(req, []byte(`{"password":"pw"`)))
+
+	invalid := newConfigLogFilter(LogFilterConfig{BodyMaskPaths: []string{"password"}})
+	assert.Equal(t, RedactedLogMessage, invalid.body(req, []byte(`{"password":"pw"}`)))
+
+	unmasked := newConfigLogFilter(LogFilterConfig{})
+	assert.Equal(t, "plain text", unmasked.body(req, []byte("plain text")))
+}
+
+func Test_ParseJSONPath_Errors(t *testing.T) {
+	for _, path := range []string{"password", "$.", "$[x]", "$[1", "$a"} {
+		_, err := parseJSONPath(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func Test_Logging_Middleware_Uses_Route_Template_Rules(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	filters := NewLogFilters(LogFilterConfig{
+		Rules: []LogFilterRule{{RouteMatcher: RouteMatcher{Route: "/users/{id}"}, BodyMaskPaths: []string{"$.password"}}},
+	})
+
+	appRouter := mux.NewRouter()
+	appRouter.Use(LoggingMiddlewareWithOptions(newBufferedLogger(buffer), LoggingOptions{Filters: filters}))
+	appRouter.HandleFunc("/users/{id}", successHandler)
+
+	req := httptest.NewRequest("PUT", "/users/42", strings.NewReader(`{"password":"pw"}`))
+	req.Header.Set("Authorization", "Bearer secret")
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, `{"password":"****"}`, entries[0]["request-body"])
+	assert.Equal(t, MaskedLogValue, entries[0]["request-header"].(map[string]interface{})["Authorization"], "Default deny list is always applied")
+}
+
+func Test_LogFilterConfig_Opts_Out_Of_Default_Deny_List(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Secret", "secret")
+
+	filter := newConfigLogFilter(LogFilterConfig{HeaderDenyList: []string{"X-Secret"}})
+	assert.Equal(t, map[string]string{"Authorization": MaskedLogValue, "X-Secret": MaskedLogValue}, filter.headers(req))
+
+	optOut := newConfigLogFilter(LogFilterConfig{HeaderDenyList: []string{"X-Secret"}, LogDefaultDenyList: true})
+	assert.Equal(t, map[string]string{"Authorization": "Bearer secret", "X-Secret": MaskedLogValue}, optOut.headers(req))
+}
+
+func Test_HeaderFilterDefault_Masks_Sensitive_Headers(t *testing.T) {
+	header := http.Header{"Authorization": []string{"Bearer secret"}, "Accept": []string{"application/json"}}
+
+	logged := HeaderFilterDefault("/api", header)
+
+	assert.NotContains(t, logged, "secret")
+	assert.Contains(t, logged, "application/json")
+	assert.Equal(t, "Bearer secret", header.Get("Authorization"), "Original header should not be modified")
+}
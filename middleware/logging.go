@@ -3,79 +3,153 @@ package middleware
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
 )
 
 const RedactedLogMessage = "-- Removed from logging --"
 
+// TruncatedLogMarker is appended to logged bodies that exceed the maximum captured body size
+const TruncatedLogMarker = "-- Truncated --"
+
+// BinaryContentLogMessage replaces bodies whose content type is not captured for logging
+const BinaryContentLogMessage = "-- Binary content not logged --"
+
+// DefaultMaxLoggedBodySize is the default number of request and response body bytes captured for logging
+const DefaultMaxLoggedBodySize = 16 * 1024
+
+// DefaultBinaryContentTypes lists the media types, or media type prefixes ending in "/", whose bodies are
+// not captured for logging by default
+var DefaultBinaryContentTypes = []string{
+	"application/octet-stream",
+	"application/pdf",
+	"application/zip",
+	"application/gzip",
+	"multipart/form-data",
+	"image/",
+	"audio/",
+	"video/",
+	"font/",
+}
+
+// LoggingOptions configures the logging middleware
+type LoggingOptions struct {
+	// Filters applied to the logged headers and bodies, DefaultLogFilterConfig is used when nil
+	Filters *LogFilters
+	// ExtraParams are additional fields added to every request log entry
+	ExtraParams map[string]LoggingParam
+	// MaxBodySize is the maximum number of body bytes captured for logging. DefaultMaxLoggedBodySize is used
+	// when zero, a negative value disables body capture
+	MaxBodySize int
+	// BinaryContentTypes lists the media types whose bodies are not captured, DefaultBinaryContentTypes when nil
+	BinaryContentTypes []string
+	// AccessLog switches to the access log mode, writing a single line per request without the bodies
+	AccessLog *AccessLogOptions
+}
+
 func LoggingMiddleware(logger log.LoggerType) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return LoggingWrapper(next, logger, nil, nil)
 	}
 }
 
+// LoggingMiddlewareWithOptions is a gorilla mux middleware logging every request and response using the provided options
+func LoggingMiddlewareWithOptions(logger log.LoggerType, options LoggingOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return LoggingWrapperWithOptions(next, logger, options)
+	}
+}
+
 func LoggingWrapper(next http.Handler, logger log.LoggerType, filters *LogFilters, extraParams map[string]LoggingParam) http.Handler {
+	return LoggingWrapperWithOptions(next, logger, LoggingOptions{Filters: filters, ExtraParams: extraParams})
+}
+
+// LoggingWrapperWithOptions logs every request and response using the provided options.
+// A new logger is derived for each request so concurrent requests never share log fields.
+func LoggingWrapperWithOptions(next http.Handler, logger log.LoggerType, options LoggingOptions) http.Handler {
+	if options.AccessLog != nil {
+		return accessLogWrapper(next, logger, *options.AccessLog)
+	}
+
+	filters := newRequestLogFilter(options.Filters)
+	maxBodySize := options.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxLoggedBodySize
+	}
+	binaryContentTypes := options.BinaryContentTypes
+	if binaryContentTypes == nil {
+		binaryContentTypes = DefaultBinaryContentTypes
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		if filters == nil {
-			filters = &LogFilters{Header: HeaderFilterDefault, Body: BodyFilterDefault}
+		// reuse the id set by RequestIDWrapper so the logs match the id returned to the caller
+		requestId := GetRequestID(r)
+		if requestId == "" {
+			requestId = uuid.NewString()
 		}
 
-		requestId, _ := uuid.NewRandom()
+		// share the timings with the Server-Timing middleware so the phases are logged
+		r = r.WithContext(trace.ContextWithTimings(r.Context()))
 
-		// Read body bytes stream and then reset value
-		bodyBytes, _ := ioutil.ReadAll(r.Body)
-		r.Body.Close()
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+		// capture the start of the body and leave the complete stream for the handler
+		requestBinary := isEncoded(r.Header) || isBinaryContentType(r.Header.Get(contentTypeHeader), binaryContentTypes)
+		var bodyBytes []byte
+		var bodyTruncated bool
+		if !requestBinary {
+			bodyBytes, bodyTruncated = captureRequestBody(r, maxBodySize)
+		}
 
 		// log custom fields
-		logger = logger.WithCustomFields(map[string]interface{}{
+		fields := map[string]interface{}{
 			"request-id":     requestId,
 			"request-uri":    r.RequestURI,
 			"request-method": r.Method,
-			"request-header": filters.Header(r.RequestURI, r.Header),
-			"request-body":   filters.Body(r.RequestURI, bodyBytes),
-		})
-
-		if extraParams != nil {
-			for k := range extraParams {
-				loggingParam := extraParams[k]
-				param := loggingParam(r)
-				if param != nil {
-					logger = logger.WithCustomFields(map[string]interface{}{
-						k: param,
-					})
-				}
+			"request-header": filters.headers(r),
+			"request-body":   formatLoggedBody(filters, r, bodyBytes, bodyTruncated, requestBinary),
+		}
+
+		for k, loggingParam := range options.ExtraParams {
+			if param := loggingParam(r); param != nil {
+				fields[k] = param
 			}
 		}
 
+		requestLogger := logger.WithCustomFields(fields)
+
 		// create logging responseWriter to capture response body
 		loggingRW := &loggingResponseWriter{
-			ResponseWriter: w,
+			ResponseWriter:     w,
+			maxBodySize:        maxBodySize,
+			binaryContentTypes: binaryContentTypes,
 		}
 
-		logger.Infof("Request to %s endpoint", r.RequestURI)
+		requestLogger.Infof("Request to %s endpoint", r.RequestURI)
 
 		start := makeTimestamp()
 
 		// call next
-		next.ServeHTTP(loggingRW, r)
+		next.ServeHTTP(wrapResponseWriter(loggingRW, w), r)
 
 		finish := makeTimestamp()
 
-		logger = logger.WithCustomFields(map[string]interface{}{
+		responseFields := map[string]interface{}{
 			"response-code": loggingRW.status,
 			"response-time": finish - start,
-			"response-body": filters.Body(r.RequestURI, loggingRW.body),
-		})
-
-		logger.Infof("Response from %s endpoint", r.RequestURI)
+			"response-body": formatLoggedBody(filters, r, loggingRW.body.Bytes(), loggingRW.truncated, loggingRW.binary),
+		}
+		if phases := trace.GetTimings(r.Context()).Phases(); len(phases) > 0 {
+			responseFields["response-phases"] = timingPhaseFields(phases)
+		}
+		requestLogger.WithCustomFields(responseFields).Infof("Response from %s endpoint", r.RequestURI)
 	})
 }
 
@@ -83,25 +157,113 @@ func makeTimestamp() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
 
+// captureRequestBody reads at most maxBodySize bytes of the request body for logging and replaces the body
+// so the handler still reads the complete, unmodified stream
+func captureRequestBody(r *http.Request, maxBodySize int) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody || maxBodySize < 0 {
+		return nil, false
+	}
+
+	captured, _ := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxBodySize)+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(captured), r.Body), r.Body}
+
+	if len(captured) > maxBodySize {
+		return captured[:maxBodySize], true
+	}
+	return captured, false
+}
+
+func formatLoggedBody(filters requestLogFilter, r *http.Request, body []byte, truncated bool, binary bool) string {
+	if binary {
+		return BinaryContentLogMessage
+	}
+	logged := filters.body(r, body)
+	if truncated && logged != RedactedLogMessage {
+		logged = logged + " " + TruncatedLogMarker
+	}
+	return logged
+}
+
+// isEncoded reports whether the body has a content coding, compressed bodies are logged as binary
+func isEncoded(header http.Header) bool {
+	encoding := header.Get(ContentEncodingHeader)
+	return encoding != "" && !strings.EqualFold(encoding, "identity")
+}
+
+// isBinaryContentType reports whether the content type matches one of the binary media types
+func isBinaryContentType(contentType string, binaryContentTypes []string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for _, binaryType := range binaryContentTypes {
+		if strings.HasSuffix(binaryType, "/") && strings.HasPrefix(mediaType, binaryType) {
+			return true
+		}
+		if mediaType == binaryType {
+			return true
+		}
+	}
+	return false
+}
+
 type loggingResponseWriter struct {
-	status int
-	body   []byte
+	status             int
+	written            int64
+	body               bytes.Buffer
+	truncated          bool
+	binary             bool
+	maxBodySize        int
+	binaryContentTypes []string
 	http.ResponseWriter
 }
 
 func (w *loggingResponseWriter) WriteHeader(code int) {
-	w.status = code
+	w.recordHeader(code)
 	w.ResponseWriter.WriteHeader(code)
 }
 
 func (w *loggingResponseWriter) Write(body []byte) (int, error) {
-	w.body = body
-	return w.ResponseWriter.Write(body)
+	w.recordHeader(http.StatusOK)
+	n, err := w.ResponseWriter.Write(body)
+	w.written += int64(n)
+	w.capture(body[:n])
+	return n, err
+}
+
+// recordHeader keeps the first status written and checks whether the response body should be captured
+func (w *loggingResponseWriter) recordHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	w.binary = isEncoded(w.Header()) || isBinaryContentType(w.Header().Get(contentTypeHeader), w.binaryContentTypes)
+}
+
+// capture keeps the written chunks up to the maximum body size
+func (w *loggingResponseWriter) capture(chunk []byte) {
+	if w.binary || w.maxBodySize < 0 {
+		return
+	}
+	remaining := w.maxBodySize - w.body.Len()
+	if len(chunk) > remaining {
+		chunk = chunk[:remaining]
+		w.truncated = true
+	}
+	w.body.Write(chunk)
 }
 
 type LogFilters struct {
 	Header HeaderFilter
 	Body   BodyFilter
+	// Config holds declarative redaction rules, when set it is used instead of Header and Body
+	Config *LogFilterConfig
 }
 
 type HeaderFilter func(uri string, header http.Header) string
@@ -112,8 +274,19 @@ func HeaderFilterDefault(uri string, header http.Header) string {
 	if strings.Contains(uri, "swagger") {
 		return RedactedLogMessage
 	} else {
-		return fmt.Sprintf("%s", header)
+		return fmt.Sprintf("%s", maskHeaders(header, DefaultHeaderDenyList))
+	}
+}
+
+// maskHeaders returns a copy of the header with the values of the denied headers masked
+func maskHeaders(header http.Header, denyList []string) http.Header {
+	masked := header.Clone()
+	for name := range masked {
+		if containsFold(denyList, name) {
+			masked[name] = []string{MaskedLogValue}
+		}
 	}
+	return masked
 }
 
 func BodyFilterDefault(uri string, body []byte) string {
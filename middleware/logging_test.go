@@ -3,8 +3,13 @@ package middleware
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gorilla/mux"
@@ -18,7 +23,7 @@ func Test_Logging_Middleware(t *testing.T) {
 	buffer := bytes.NewBuffer(buff)
 	templog := logrus.Logger{
 		Out:       buffer,
-		Formatter: log.CustomFormatter{&logrus.JSONFormatter{}},
+		Formatter: log.CustomFormatter{Formatter: &logrus.JSONFormatter{}},
 		Hooks:     make(logrus.LevelHooks),
 		Level:     logrus.DebugLevel,
 	}
@@ -62,3 +67,137 @@ func successHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	w.Write([]byte("response value"))
 }
+
+func newBufferedLogger(buffer io.Writer) log.LoggerType {
+	templog := &logrus.Logger{
+		Out:       buffer,
+		Formatter: log.CustomFormatter{Formatter: &logrus.JSONFormatter{}},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     logrus.DebugLevel,
+	}
+	return &log.CustomLogger{Entry: templog.WithField("app", "app")}
+}
+
+func readLogEntries(t *testing.T, buffer *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expecting JSON log entry, got %s", line)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func Test_Logging_Middleware_Truncates_Bodies_And_Keeps_Full_Request_Stream(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	requestBody := strings.Repeat("a", 20)
+	var handlerBody string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		handlerBody = string(b)
+		w.Write([]byte("first-"))
+		w.Write([]byte("second-"))
+		w.Write([]byte("third"))
+	})
+
+	wrapper := LoggingWrapperWithOptions(handler, newBufferedLogger(buffer), LoggingOptions{MaxBodySize: 10})
+	req := httptest.NewRequest("POST", "/test", strings.NewReader(requestBody))
+	w := httptest.NewRecorder()
+	wrapper.ServeHTTP(w, req)
+
+	assert.Equal(t, requestBody, handlerBody, "Handler should receive the complete body")
+	assert.Equal(t, "first-second-third", w.Body.String())
+
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, "aaaaaaaaaa "+TruncatedLogMarker, entries[0]["request-body"])
+	assert.Equal(t, "first-seco "+TruncatedLogMarker, entries[1]["response-body"])
+	assert.Equal(t, float64(200), entries[1]["response-code"])
+}
+
+func Test_Logging_Middleware_Skips_Binary_Content(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte{0x89, 0x50, 0x4e, 0x47})
+	})
+
+	wrapper := LoggingWrapperWithOptions(handler, newBufferedLogger(buffer), LoggingOptions{})
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader([]byte{0x00, 0x01}))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	wrapper.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, BinaryContentLogMessage, entries[0]["request-body"])
+	assert.Equal(t, BinaryContentLogMessage, entries[1]["response-body"])
+}
+
+func Test_Logging_Middleware_Skips_Compressed_Content(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(ContentEncodingHeader, EncodingGzip)
+		w.Write([]byte{0x1f, 0x8b})
+	})
+
+	wrapper := LoggingWrapperWithOptions(handler, newBufferedLogger(buffer), LoggingOptions{})
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader([]byte{0x1f, 0x8b}))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ContentEncodingHeader, EncodingGzip)
+	wrapper.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries := readLogEntries(t, buffer)
+	assert.Equal(t, BinaryContentLogMessage, entries[0]["request-body"])
+	assert.Equal(t, BinaryContentLogMessage, entries[1]["response-body"])
+}
+
+func Test_Logging_Middleware_Preserves_Optional_Writer_Interfaces(t *testing.T) {
+	var isFlusher, isHijacker bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher = w.(http.Flusher)
+		_, isHijacker = w.(http.Hijacker)
+	})
+
+	wrapper := LoggingWrapperWithOptions(handler, newBufferedLogger(&bytes.Buffer{}), LoggingOptions{})
+	wrapper.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream", nil))
+
+	assert.True(t, isFlusher, "Recorder flusher should be exposed")
+	assert.False(t, isHijacker, "Hijacker should not be exposed when the underlying writer lacks it")
+}
+
+func Test_Logging_Middleware_Concurrent_Requests_Do_Not_Share_Fields(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	var mu sync.Mutex
+	logger := newBufferedLogger(&lockedBuffer{buffer: buffer, mu: &mu})
+	uri := func(r *http.Request) *string {
+		value := r.URL.Path
+		return &value
+	}
+	wrapper := LoggingWrapper(http.HandlerFunc(successHandler), logger, nil, map[string]LoggingParam{"path": uri})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wrapper.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/path/"+strings.Repeat("x", i), nil))
+		}(i)
+	}
+	wg.Wait()
+
+	for _, entry := range readLogEntries(t, buffer) {
+		assert.Equal(t, entry["path"], entry["request-uri"])
+	}
+}
+
+type lockedBuffer struct {
+	buffer *bytes.Buffer
+	mu     *sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
@@ -0,0 +1,254 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// DefaultMaintenanceRetryAfter is the Retry-After of the blocked requests when the window has no end
+const DefaultMaintenanceRetryAfter = 5 * time.Minute
+
+// DefaultMaintenanceAllowedMethods are the methods served during maintenance by default, the reads
+var DefaultMaintenanceAllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// MaintenanceWindow is the maintenance state, it is the content of the maintenance file and of the admin handler
+type MaintenanceWindow struct {
+	// Active turns the maintenance on, within the window when Start or End are set
+	Active bool `json:"active"`
+	// Start and End bound the window, it starts at once when Start is zero and lasts until turned off when End is
+	// zero
+	Start time.Time `json:"start,omitempty"`
+	End   time.Time `json:"end,omitempty"`
+	// MessageID is the message id of the 503 responses, ServiceUnavailableMessageID when empty
+	MessageID string `json:"messageId,omitempty"`
+	// TemplateData is passed to the error responder along with RetryAfter and End
+	TemplateData map[string]string `json:"templateData,omitempty"`
+	// AllowedMethods are the methods still served, DefaultMaintenanceAllowedMethods when empty
+	AllowedMethods []string `json:"allowedMethods,omitempty"`
+	// AllowedRoutes are the requests still served whatever their method
+	AllowedRoutes []RouteMatcher `json:"allowedRoutes,omitempty"`
+}
+
+// MaintenanceOptions configures the maintenance mode
+type MaintenanceOptions struct {
+	// File holds the JSON MaintenanceWindow, the maintenance is off while the file does not exist. The changes made
+	// through the admin handler are written to the file.
+	File string
+	// ReloadInterval is how often the file is checked for changes, it is only read once when zero
+	ReloadInterval time.Duration
+	// Window is the initial state when no file is configured
+	Window MaintenanceWindow
+	// Bypass select the requests never blocked, e.g. the health and admin routes
+	Bypass []RouteMatcher
+	// RetryAfter is the Retry-After of the blocked requests when the window has no end,
+	// DefaultMaintenanceRetryAfter when zero
+	RetryAfter time.Duration
+	// ErrorResponder writes the 503 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+}
+
+// MaintenanceMode rejects the requests other than the allowed ones with a 503 while a maintenance window is in
+// effect. It is toggled through its admin handler or its watched file.
+type MaintenanceMode struct {
+	options MaintenanceOptions
+	logger  log.LoggerType
+	now     func() time.Time
+
+	mu      sync.RWMutex
+	window  MaintenanceWindow
+	watcher *fileWatcher
+}
+
+// NewMaintenanceMode reads the maintenance file and starts watching it for changes
+func NewMaintenanceMode(options MaintenanceOptions, logger log.LoggerType) (*MaintenanceMode, error) {
+	if options.RetryAfter <= 0 {
+		options.RetryAfter = DefaultMaintenanceRetryAfter
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	m := &MaintenanceMode{options: options, logger: logger, now: time.Now, window: options.Window}
+
+	if options.File == "" {
+		m.watcher = watchFiles(nil, 0, nil)
+		return m, nil
+	}
+	window, err := LoadMaintenanceWindow(options.File)
+	if err != nil {
+		return nil, err
+	}
+	m.window = window
+	m.watcher = watchFiles([]string{options.File}, options.ReloadInterval, m.reload)
+	return m, nil
+}
+
+// LoadMaintenanceWindow reads a maintenance file, a missing file is an inactive window
+func LoadMaintenanceWindow(file string) (MaintenanceWindow, error) {
+	var window MaintenanceWindow
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if os.IsNotExist(err) {
+		return window, nil
+	}
+	if err != nil {
+		return window, err
+	}
+	if err := json.Unmarshal(data, &window); err != nil {
+		return window, fmt.Errorf("invalid maintenance file %s: %w", file, err)
+	}
+	return window, nil
+}
+
+func (m *MaintenanceMode) reload() {
+	window, err := LoadMaintenanceWindow(m.options.File)
+	if err != nil {
+		m.logger.Errorf("Failed to reload maintenance file, keeping the current state: %v", err)
+		return
+	}
+	m.setWindow(window)
+}
+
+// Close stops watching the maintenance file
+func (m *MaintenanceMode) Close() {
+	m.watcher.Stop()
+}
+
+// Window returns the maintenance state
+func (m *MaintenanceMode) Window() MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.window
+}
+
+// InEffect reports whether the maintenance blocks requests now
+func (m *MaintenanceMode) InEffect() bool {
+	return m.Window().inEffect(m.now())
+}
+
+// SetWindow changes the maintenance state, and writes it to the maintenance file when one is configured
+func (m *MaintenanceMode) SetWindow(window MaintenanceWindow) error {
+	if m.options.File != "" {
+		data, err := json.MarshalIndent(window, "", "  ")
+		if err != nil {
+			return err
+		}
+		// the file is replaced at once so the watchers never read a partial state
+		temp := m.options.File + ".tmp"
+		if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(temp, m.options.File); err != nil {
+			return err
+		}
+	}
+	m.setWindow(window)
+	return nil
+}
+
+func (m *MaintenanceMode) setWindow(window MaintenanceWindow) {
+	m.mu.Lock()
+	m.window = window
+	m.mu.Unlock()
+	if window.Active {
+		m.logger.Infof("Maintenance mode turned on, window %v to %v", window.Start, window.End)
+	} else {
+		m.logger.Infof("Maintenance mode turned off")
+	}
+}
+
+// AdminHandler reads the maintenance state on GET, replaces it with the JSON MaintenanceWindow of a PUT and turns
+// the maintenance off on DELETE. It must be registered behind authentication and listed in the Bypass routes.
+func (m *MaintenanceMode) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var window MaintenanceWindow
+			if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+				m.options.ErrorResponder(w, r, http.StatusBadRequest, BadRequestMessageID, nil)
+				return
+			}
+			if err := m.SetWindow(window); err != nil {
+				m.logger.Errorf("Failed changing the maintenance state: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		case http.MethodDelete:
+			if err := m.SetWindow(MaintenanceWindow{}); err != nil {
+				m.logger.Errorf("Failed changing the maintenance state: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		window := m.Window()
+		w.Header().Set(contentTypeHeader, "application/json")
+		json.NewEncoder(w).Encode(struct {
+			MaintenanceWindow
+			InEffect bool `json:"inEffect"`
+		}{window, window.inEffect(m.now())})
+	})
+}
+
+// Middleware returns a gorilla mux middleware blocking the requests during maintenance
+func (m *MaintenanceMode) Middleware() func(http.Handler) http.Handler {
+	return m.Wrapper
+}
+
+// Wrapper rejects the requests other than the allowed methods, allowed routes and bypass routes with a 503 while
+// the maintenance is in effect. The Retry-After is the time left until the end of the window.
+func (m *MaintenanceMode) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		window := m.Window()
+		now := m.now()
+		if !window.inEffect(now) || window.allows(r) || matchesAny(m.options.Bypass, r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter := m.options.RetryAfter
+		if !window.End.IsZero() {
+			retryAfter = window.End.Sub(now)
+		}
+		seconds := strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds()))))
+		templateData := map[string]string{"RetryAfter": seconds}
+		if !window.End.IsZero() {
+			templateData["End"] = window.End.UTC().Format(time.RFC3339)
+		}
+		for key, value := range window.TemplateData {
+			templateData[key] = value
+		}
+		messageID := window.MessageID
+		if messageID == "" {
+			messageID = ServiceUnavailableMessageID
+		}
+
+		w.Header().Set(RetryAfterHeader, seconds)
+		m.options.ErrorResponder(w, r, http.StatusServiceUnavailable, messageID, templateData)
+	})
+}
+
+// inEffect reports whether the window is active at the time
+func (mw MaintenanceWindow) inEffect(now time.Time) bool {
+	return mw.Active && (mw.Start.IsZero() || !now.Before(mw.Start)) && (mw.End.IsZero() || now.Before(mw.End))
+}
+
+// allows reports whether the request is still served during the window
+func (mw MaintenanceWindow) allows(r *http.Request) bool {
+	methods := mw.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultMaintenanceAllowedMethods
+	}
+	return containsFold(methods, r.Method) || matchesAny(mw.AllowedRoutes, r)
+}
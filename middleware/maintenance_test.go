@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupMaintenanceRouter(maintenance *MaintenanceMode) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(maintenance.Middleware())
+	appRouter.HandleFunc("/api/assets", successHandler)
+	appRouter.HandleFunc("/api/assets/import", successHandler)
+	appRouter.Handle("/admin/maintenance", maintenance.AdminHandler())
+	return appRouter
+}
+
+func Test_Maintenance_Blocks_Writes_In_Window(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	var messageID string
+	var templateData map[string]string
+	maintenance, err := NewMaintenanceMode(MaintenanceOptions{
+		Window: MaintenanceWindow{
+			Active:        true,
+			Start:         now.Add(-time.Minute),
+			End:           now.Add(90 * time.Second),
+			TemplateData:  map[string]string{"Reason": "upgrade"},
+			AllowedRoutes: []RouteMatcher{{Route: "/api/assets/import"}},
+		},
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID, templateData = id, data
+			w.WriteHeader(status)
+		},
+	}, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	defer maintenance.Close()
+	maintenance.now = func() time.Time { return now }
+	appRouter := setupMaintenanceRouter(maintenance)
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/assets", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "90", w.Header().Get(RetryAfterHeader))
+	assert.Equal(t, ServiceUnavailableMessageID, messageID)
+	assert.Equal(t, map[string]string{"RetryAfter": "90", "End": "2026-05-01T12:01:30Z", "Reason": "upgrade"}, templateData)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/assets", nil),
+		httptest.NewRequest(http.MethodPost, "/api/assets/import", nil),
+	} {
+		w = httptest.NewRecorder()
+		appRouter.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, req.URL.Path)
+	}
+
+	// the window is over
+	maintenance.now = func() time.Time { return now.Add(2 * time.Minute) }
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/assets", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func Test_Maintenance_Admin_Handler(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance.json")
+	maintenance, err := NewMaintenanceMode(MaintenanceOptions{
+		File:   file,
+		Bypass: []RouteMatcher{{Route: "/admin/**"}},
+	}, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	defer maintenance.Close()
+	appRouter := setupMaintenanceRouter(maintenance)
+	assert.False(t, maintenance.InEffect(), "a missing file is an inactive window")
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/maintenance", strings.NewReader(`{"active":true}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"inEffect":true`)
+	assert.True(t, maintenance.InEffect())
+
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/assets", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "300", w.Header().Get(RetryAfterHeader), "a window without end uses the default Retry-After")
+
+	// the state is kept in the file
+	window, err := LoadMaintenanceWindow(file)
+	assert.NoError(t, err)
+	assert.True(t, window.Active)
+
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/maintenance", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, maintenance.InEffect())
+
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/admin/maintenance", strings.NewReader(`not json`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_Maintenance_Watches_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "maintenance.json")
+	maintenance, err := NewMaintenanceMode(MaintenanceOptions{File: file, ReloadInterval: 10 * time.Millisecond}, log.NewLogger("", ""))
+	assert.NoError(t, err)
+	defer maintenance.Close()
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"active":true,"allowedMethods":["GET"]}`), 0600))
+	assert.Eventually(t, maintenance.InEffect, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, os.Remove(file))
+	assert.Eventually(t, func() bool { return !maintenance.InEffect() }, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{`), 0600))
+	_, err = NewMaintenanceMode(MaintenanceOptions{File: file}, log.NewLogger("", ""))
+	assert.Error(t, err)
+}
@@ -0,0 +1,285 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MetricsContentType is the content type of the Prometheus text exposition format
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultMetricsNamespace prefixes the metric names by default
+const DefaultMetricsNamespace = "http_server"
+
+// UnmatchedRouteLabel is the route label of the requests not matching a route
+const UnmatchedRouteLabel = "unmatched"
+
+// DefaultDurationBuckets are the default upper bounds in seconds of the request duration histogram
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are the default upper bounds in bytes of the response size histogram
+var DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// metricsMethods are the methods kept as label values, the other ones are counted as OTHER
+var metricsMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions,
+}
+
+// MetricsOptions configures the HTTP metrics
+type MetricsOptions struct {
+	// Namespace prefixes the metric names, DefaultMetricsNamespace when empty
+	Namespace string
+	// DurationBuckets are the upper bounds in seconds of the duration histogram, DefaultDurationBuckets when empty
+	DurationBuckets []float64
+	// SizeBuckets are the upper bounds in bytes of the response size histogram, DefaultSizeBuckets when empty
+	SizeBuckets []float64
+	// Router resolves the route template when the metrics wrap the router instead of being registered with
+	// Router.Use
+	Router *mux.Router
+}
+
+// HTTPMetrics records the request count, in-flight requests, request duration and response size of the requests,
+// labelled by method, route template and status class
+type HTTPMetrics struct {
+	options  MetricsOptions
+	inFlight int64
+
+	mu        sync.Mutex
+	series    map[metricLabels]*requestSeries
+	gauges    []metricGauge
+	durations []float64
+	sizes     []float64
+}
+
+// metricGauge is a gauge read when the metrics are scraped
+type metricGauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+type metricLabels struct {
+	method string
+	route  string
+	status string
+}
+
+type requestSeries struct {
+	count    uint64
+	duration histogram
+	size     histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHTTPMetrics creates the metrics, they are exposed by Handler
+func NewHTTPMetrics(options MetricsOptions) *HTTPMetrics {
+	if options.Namespace == "" {
+		options.Namespace = DefaultMetricsNamespace
+	}
+	if len(options.DurationBuckets) == 0 {
+		options.DurationBuckets = DefaultDurationBuckets
+	}
+	if len(options.SizeBuckets) == 0 {
+		options.SizeBuckets = DefaultSizeBuckets
+	}
+	return &HTTPMetrics{
+		options:   options,
+		series:    map[metricLabels]*requestSeries{},
+		durations: sortedBuckets(options.DurationBuckets),
+		sizes:     sortedBuckets(options.SizeBuckets),
+	}
+}
+
+// Middleware is a gorilla mux middleware recording the metrics of the requests
+func (m *HTTPMetrics) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return m.Wrapper(next)
+	}
+}
+
+// Wrapper records the metrics of the requests served by the next handler
+func (m *HTTPMetrics) Wrapper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		atomic.AddInt64(&m.inFlight, 1)
+		mw := &statusResponseWriter{ResponseWriter: w}
+		defer func() {
+			atomic.AddInt64(&m.inFlight, -1)
+			status := mw.status
+			if status == 0 {
+				// the handler panicked before answering
+				status = http.StatusInternalServerError
+			}
+			m.observe(metricLabels{method: metricsMethod(r.Method), route: m.route(r), status: statusClass(status)},
+				time.Since(start), mw.written)
+		}()
+
+		// call next
+		next.ServeHTTP(wrapResponseWriter(mw, w), r)
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+	})
+}
+
+// Handler serves the metrics in the Prometheus text exposition format
+func (m *HTTPMetrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, MetricsContentType)
+		w.Write([]byte(m.exposition()))
+	})
+}
+
+// AddGauge exposes a gauge read when the metrics are scraped, its name is prefixed with the namespace
+func (m *HTTPMetrics) AddGauge(name string, help string, value func() float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges = append(m.gauges, metricGauge{name: m.options.Namespace + "_" + name, help: help, value: value})
+}
+
+// route returns the route template of the request
+func (m *HTTPMetrics) route(r *http.Request) string {
+	if template := RouteTemplate(r); template != "" {
+		return template
+	}
+	if m.options.Router != nil {
+		var match mux.RouteMatch
+		if m.options.Router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				return template
+			}
+		}
+	}
+	return UnmatchedRouteLabel
+}
+
+func (m *HTTPMetrics) observe(labels metricLabels, duration time.Duration, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series, ok := m.series[labels]
+	if !ok {
+		series = &requestSeries{
+			duration: histogram{counts: make([]uint64, len(m.durations))},
+			size:     histogram{counts: make([]uint64, len(m.sizes))},
+		}
+		m.series[labels] = series
+	}
+	series.count++
+	series.duration.observe(m.durations, duration.Seconds())
+	series.size.observe(m.sizes, float64(size))
+}
+
+// exposition renders the metrics, the series are sorted so the output is stable
+func (m *HTTPMetrics) exposition() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]metricLabels, 0, len(m.series))
+	for key := range m.series {
+		labels = append(labels, key)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].route != labels[j].route {
+			return labels[i].route < labels[j].route
+		}
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].status < labels[j].status
+	})
+
+	namespace := m.options.Namespace
+	var out strings.Builder
+	writeMetricHeader(&out, namespace+"_requests_in_flight", "gauge", "Number of requests being served.")
+	fmt.Fprintf(&out, "%s_requests_in_flight %d\n", namespace, atomic.LoadInt64(&m.inFlight))
+
+	for _, gauge := range m.gauges {
+		writeMetricHeader(&out, gauge.name, "gauge", gauge.help)
+		fmt.Fprintf(&out, "%s %s\n", gauge.name, strconv.FormatFloat(gauge.value(), 'g', -1, 64))
+	}
+
+	writeMetricHeader(&out, namespace+"_requests_total", "counter", "Total number of requests served.")
+	for _, key := range labels {
+		fmt.Fprintf(&out, "%s_requests_total{%s} %d\n", namespace, key.format(), m.series[key].count)
+	}
+
+	writeMetricHeader(&out, namespace+"_request_duration_seconds", "histogram", "Duration of the requests in seconds.")
+	for _, key := range labels {
+		m.series[key].duration.write(&out, namespace+"_request_duration_seconds", key, m.durations)
+	}
+
+	writeMetricHeader(&out, namespace+"_response_size_bytes", "histogram", "Size of the response bodies in bytes.")
+	for _, key := range labels {
+		m.series[key].size.write(&out, namespace+"_response_size_bytes", key, m.sizes)
+	}
+	return out.String()
+}
+
+func (l metricLabels) format() string {
+	return fmt.Sprintf(`method="%s",route="%s",status="%s"`, escapeLabelValue(l.method), escapeLabelValue(l.route), escapeLabelValue(l.status))
+}
+
+// observe counts the value in the first bucket holding it, values over the last bound only count in +Inf
+func (h *histogram) observe(buckets []float64, value float64) {
+	h.count++
+	h.sum += value
+	for i, bound := range buckets {
+		if value <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// write renders the cumulative buckets, the sum and the count of the histogram
+func (h *histogram) write(out *strings.Builder, name string, labels metricLabels, buckets []float64) {
+	series := labels.format()
+	cumulative := uint64(0)
+	for i, bound := range buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"%s\"} %d\n", name, series, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, series, h.count)
+	fmt.Fprintf(out, "%s_sum{%s} %s\n", name, series, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(out, "%s_count{%s} %d\n", name, series, h.count)
+}
+
+func writeMetricHeader(out *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func metricsMethod(method string) string {
+	if containsString(metricsMethods, method) {
+		return method
+	}
+	return "OTHER"
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func sortedBuckets(buckets []float64) []float64 {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return sorted
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrapeMetrics(t *testing.T, metrics *HTTPMetrics) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, MetricsContentType, w.Header().Get(contentTypeHeader))
+	return w.Body.String()
+}
+
+func Test_Metrics_Labels_By_Route_Template(t *testing.T) {
+	metrics := NewHTTPMetrics(MetricsOptions{DurationBuckets: []float64{1, 0.1}, SizeBuckets: []float64{10, 100}})
+	appRouter := mux.NewRouter()
+	appRouter.Use(metrics.Middleware())
+	appRouter.HandleFunc("/api/assets/{id}", successHandler)
+	appRouter.HandleFunc("/api/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	for _, target := range []string{"/api/assets/1", "/api/assets/2", "/api/missing"} {
+		appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	exposition := scrapeMetrics(t, metrics)
+	assert.Contains(t, exposition, "# TYPE http_server_requests_total counter\n")
+	assert.Contains(t, exposition, `http_server_requests_total{method="GET",route="/api/assets/{id}",status="2xx"} 2`+"\n")
+	assert.Contains(t, exposition, `http_server_requests_total{method="GET",route="/api/missing",status="4xx"} 1`+"\n")
+	assert.NotContains(t, exposition, "/api/assets/1", "Raw paths should not be used as labels")
+	assert.Contains(t, exposition, `http_server_request_duration_seconds_bucket{method="GET",route="/api/assets/{id}",status="2xx",le="0.1"} 2`+"\n")
+	assert.Contains(t, exposition, `http_server_request_duration_seconds_count{method="GET",route="/api/assets/{id}",status="2xx"} 2`+"\n")
+	assert.Contains(t, exposition, `http_server_response_size_bytes_bucket{method="GET",route="/api/assets/{id}",status="2xx",le="10"} 0`+"\n")
+	assert.Contains(t, exposition, `http_server_response_size_bytes_bucket{method="GET",route="/api/assets/{id}",status="2xx",le="100"} 2`+"\n")
+	assert.Contains(t, exposition, `http_server_response_size_bytes_sum{method="GET",route="/api/assets/{id}",status="2xx"} 28`+"\n")
+	assert.Contains(t, exposition, "http_server_requests_in_flight 0\n")
+}
+
+func Test_Metrics_Wrapping_Router_And_In_Flight(t *testing.T) {
+	var metrics *HTTPMetrics
+	var inFlight string
+	appRouter := mux.NewRouter()
+	appRouter.HandleFunc("/api/assets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		inFlight = scrapeMetrics(t, metrics)
+	})
+	metrics = NewHTTPMetrics(MetricsOptions{Namespace: "assets", Router: appRouter})
+	handler := metrics.Wrapper(appRouter)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/assets/1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", "/api/assets/1", nil))
+
+	assert.Contains(t, inFlight, "assets_requests_in_flight 1\n")
+	exposition := scrapeMetrics(t, metrics)
+	assert.Contains(t, exposition, `assets_requests_total{method="GET",route="/api/assets/{id}",status="2xx"} 1`)
+	assert.Contains(t, exposition, `assets_requests_total{method="GET",route="unmatched",status="4xx"} 1`)
+	assert.Contains(t, exposition, `assets_requests_total{method="OTHER",route="/api/assets/{id}",status="2xx"} 1`)
+	assert.Equal(t, 1, strings.Count(exposition, "# TYPE assets_request_duration_seconds histogram"))
+}
+
+func Test_Metrics_Records_Panics_As_Server_Errors(t *testing.T) {
+	metrics := NewHTTPMetrics(MetricsOptions{})
+	handler := metrics.Wrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+
+	assert.Panics(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/assets", nil))
+	})
+	assert.Contains(t, scrapeMetrics(t, metrics), `http_server_requests_total{method="GET",route="unmatched",status="5xx"} 1`)
+}
+
+func Test_Metrics_Escapes_Label_Values(t *testing.T) {
+	assert.Equal(t, `method="GET",route="/a\"b\\c\n",status="2xx"`, metricLabels{method: "GET", route: "/a\"b\\c\n", status: "2xx"}.format())
+}
+
+func Test_Metrics_Exposes_Added_Gauges(t *testing.T) {
+	metrics := NewHTTPMetrics(MetricsOptions{})
+	value := 1.5
+	metrics.AddGauge("queue_depth", "Number of queued requests.", func() float64 { return value })
+
+	value = 3
+	exposition := scrapeMetrics(t, metrics)
+	assert.Contains(t, exposition, "# TYPE http_server_queue_depth gauge\nhttp_server_queue_depth 3\n")
+}
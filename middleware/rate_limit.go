@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// TooManyRequestsMessageID is the message id used for requests rejected by the rate limiter
+const TooManyRequestsMessageID = "TOO_MANY_REQUESTS"
+
+// RetryAfterHeader represents the Retry-After Header param
+const RetryAfterHeader = "Retry-After"
+
+const (
+	// RateLimitLimitHeader represents the X-RateLimit-Limit Header param
+	RateLimitLimitHeader = "X-RateLimit-Limit"
+	// RateLimitRemainingHeader represents the X-RateLimit-Remaining Header param
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// RateLimitResetHeader represents the X-RateLimit-Reset Header param, in seconds until the limit resets
+	RateLimitResetHeader = "X-RateLimit-Reset"
+)
+
+// RateLimitKeyFunc returns the key requests are counted by, requests with an empty key are not limited
+type RateLimitKeyFunc func(r *http.Request) string
+
+// KeyByClientIP counts the requests by client address, resolved behind the trusted proxies by the
+// ClientIPResolver
+func KeyByClientIP(r *http.Request) string {
+	return remoteIP(r)
+}
+
+// KeyBySubject counts the requests by the subject of the bearer token
+func KeyBySubject(r *http.Request) string {
+	if claims := GetClaims(r); claims != nil {
+		return claims.Subject
+	}
+	return ""
+}
+
+// KeyByHeader counts the requests by the value of the header
+func KeyByHeader(name string) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// RouteRateLimit applies its limit to the requests selected by its RouteMatcher
+type RouteRateLimit struct {
+	RouteMatcher
+	Limit RateLimit
+	// Key overrides the key of the options for the route
+	Key RateLimitKeyFunc
+}
+
+// RateLimitOptions configures the rate limiting middleware
+type RateLimitOptions struct {
+	// Default is the limit of the requests not matching a route limit, they are not limited when nil
+	Default *RateLimit
+	// Routes are the per-route limits, the first matching one is applied
+	Routes []RouteRateLimit
+	// Key selects what requests are counted by, KeyByClientIP when nil
+	Key RateLimitKeyFunc
+	// Store keeps the counters, a MemoryRateLimitStore when nil
+	Store RateLimitStore
+	// ErrorResponder writes the 429 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the 429 responses, TooManyRequestsMessageID when empty
+	MessageID string
+}
+
+// RateLimitMiddleware is a gorilla mux middleware limiting the request rate
+func RateLimitMiddleware(options RateLimitOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	limiter := newRateLimiter(options, logger)
+	return func(next http.Handler) http.Handler {
+		return limiter.handler(next)
+	}
+}
+
+// RateLimitWrapper counts the requests against the matching limit, returning the X-RateLimit headers and
+// rejecting requests over the limit with a 429 and Retry-After. Requests are allowed when the store fails.
+func RateLimitWrapper(next http.Handler, options RateLimitOptions, logger log.LoggerType) http.Handler {
+	return newRateLimiter(options, logger).handler(next)
+}
+
+type rateLimiter struct {
+	options RateLimitOptions
+	logger  log.LoggerType
+}
+
+// newRateLimiter applies the option and limit defaults, the store is created once so every request shares the
+// counters
+func newRateLimiter(options RateLimitOptions, logger log.LoggerType) *rateLimiter {
+	if options.Key == nil {
+		options.Key = KeyByClientIP
+	}
+	if options.Store == nil {
+		options.Store = NewMemoryRateLimitStore()
+	}
+	if options.MessageID == "" {
+		options.MessageID = TooManyRequestsMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	if options.Default != nil {
+		limit := options.Default.withDefaults()
+		options.Default = &limit
+	}
+	routes := make([]RouteRateLimit, len(options.Routes))
+	for i, route := range options.Routes {
+		route.Limit = route.Limit.withDefaults()
+		routes[i] = route
+	}
+	options.Routes = routes
+	return &rateLimiter{options: options, logger: logger}
+}
+
+func (l *rateLimiter) handler(next http.Handler) http.Handler {
+	options := l.options
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, keyFunc, scope := options.limitFor(r)
+		key := ""
+		if limit != nil {
+			key = keyFunc(r)
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := options.Store.Take(r.Context(), scope+"|"+key, *limit, time.Now())
+		if err != nil {
+			l.logger.Errorf("Rate limit store failed, allowing request: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set(RateLimitLimitHeader, strconv.Itoa(result.Limit))
+		w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(result.Remaining))
+		w.Header().Set(RateLimitResetHeader, strconv.Itoa(ceilSeconds(result.Reset)))
+		if !result.Allowed {
+			retryAfter := ceilSeconds(result.RetryAfter)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set(RetryAfterHeader, strconv.Itoa(retryAfter))
+			options.ErrorResponder(w, r, http.StatusTooManyRequests, options.MessageID, map[string]string{"RetryAfter": strconv.Itoa(retryAfter)})
+			return
+		}
+
+		// call next
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitFor returns the limit, the key function and the counter scope of the request
+func (o RateLimitOptions) limitFor(r *http.Request) (*RateLimit, RateLimitKeyFunc, string) {
+	for i := range o.Routes {
+		route := &o.Routes[i]
+		if route.Matches(r) {
+			keyFunc := o.Key
+			if route.Key != nil {
+				keyFunc = route.Key
+			}
+			return &route.Limit, keyFunc, route.Route + " " + strings.Join(route.Methods, ",")
+		}
+	}
+	return o.Default, o.Key, ""
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitAlgorithm selects how requests are counted against a RateLimit
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket refills Requests tokens every Period and allows bursts up to Burst
+	TokenBucket RateLimitAlgorithm = iota
+	// SlidingWindow allows Requests in any Period, weighting the previous window by its overlap
+	SlidingWindow
+)
+
+// DefaultRateLimitPeriod is the Period of the rate limits of the middleware without one
+const DefaultRateLimitPeriod = time.Second
+
+// errInvalidRateLimit is returned by the in-memory store for limits without Requests or Period
+var errInvalidRateLimit = errors.New("rate limit requests and period must be positive")
+
+// RateLimit allows Requests per Period. The middleware allows a single request when Requests is not positive, per
+// DefaultRateLimitPeriod when Period is not positive.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	// Burst is the token bucket capacity, Requests when zero
+	Burst     int
+	Algorithm RateLimitAlgorithm
+}
+
+// RateLimitResult is the outcome of counting a request
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the limit is fully available again
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, zero when allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the rate limit counters. The in-memory store suits a single instance, implement the
+// interface over a shared backend to limit across instances.
+type RateLimitStore interface {
+	// Take counts one request for the key against the limit
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// rateLimitSweepInterval is how often the in-memory store drops idle counters
+const rateLimitSweepInterval = time.Minute
+
+type rateLimitCounter struct {
+	// token bucket state
+	tokens     float64
+	lastRefill time.Time
+	// sliding window state
+	windowStart   time.Time
+	previousCount int
+	currentCount  int
+	// lastSeen and period decide when the counter is idle
+	lastSeen time.Time
+	period   time.Duration
+}
+
+// MemoryRateLimitStore is an in-memory RateLimitStore
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	counters  map[string]*rateLimitCounter
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counters: map[string]*rateLimitCounter{}}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return RateLimitResult{}, errInvalidRateLimit
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+	counter, ok := s.counters[key]
+	if !ok {
+		counter = &rateLimitCounter{tokens: float64(burst(limit)), lastRefill: now, windowStart: now.Truncate(limit.Period)}
+		s.counters[key] = counter
+	}
+	counter.lastSeen = now
+	counter.period = limit.Period
+
+	if limit.Algorithm == SlidingWindow {
+		return counter.takeSlidingWindow(limit, now), nil
+	}
+	return counter.takeToken(limit, now), nil
+}
+
+// sweep drops the counters idle for more than two periods
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, counter := range s.counters {
+		if now.Sub(counter.lastSeen) > 2*counter.period {
+			delete(s.counters, key)
+		}
+	}
+}
+
+// withDefaults replaces the invalid Requests and Period, see RateLimit
+func (limit RateLimit) withDefaults() RateLimit {
+	if limit.Requests <= 0 {
+		limit.Requests = 1
+	}
+	if limit.Period <= 0 {
+		limit.Period = DefaultRateLimitPeriod
+	}
+	return limit
+}
+
+func burst(limit RateLimit) int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return limit.Requests
+}
+
+func (c *rateLimitCounter) takeToken(limit RateLimit, now time.Time) RateLimitResult {
+	capacity := float64(burst(limit))
+	perSecond := float64(limit.Requests) / limit.Period.Seconds()
+
+	c.tokens = math.Min(capacity, c.tokens+now.Sub(c.lastRefill).Seconds()*perSecond)
+	c.lastRefill = now
+
+	result := RateLimitResult{Limit: burst(limit)}
+	if c.tokens >= 1 {
+		c.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - c.tokens) / perSecond)
+	}
+	result.Remaining = int(c.tokens)
+	result.Reset = secondsDuration((capacity - c.tokens) / perSecond)
+	return result
+}
+
+func (c *rateLimitCounter) takeSlidingWindow(limit RateLimit, now time.Time) RateLimitResult {
+	windowStart := now.Truncate(limit.Period)
+	switch elapsedWindows := int(windowStart.Sub(c.windowStart) / limit.Period); {
+	case elapsedWindows == 1:
+		c.previousCount, c.currentCount = c.currentCount, 0
+	case elapsedWindows > 1:
+		c.previousCount, c.currentCount = 0, 0
+	}
+	c.windowStart = windowStart
+
+	elapsed := now.Sub(windowStart)
+	previousWeight := 1 - elapsed.Seconds()/limit.Period.Seconds()
+	used := float64(c.previousCount)*previousWeight + float64(c.currentCount)
+
+	result := RateLimitResult{Limit: limit.Requests, Reset: limit.Period - elapsed}
+	if used+1 <= float64(limit.Requests) {
+		c.currentCount++
+		used++
+		result.Allowed = true
+	} else {
+		result.RetryAfter = c.slidingWindowRetryAfter(limit, elapsed)
+	}
+	result.Remaining = int(math.Max(0, float64(limit.Requests)-used))
+	return result
+}
+
+// slidingWindowRetryAfter estimates when enough of the previous window has expired to allow a request
+func (c *rateLimitCounter) slidingWindowRetryAfter(limit RateLimit, elapsed time.Duration) time.Duration {
+	available := float64(limit.Requests - c.currentCount - 1)
+	if available < 0 || c.previousCount == 0 {
+		return limit.Period - elapsed
+	}
+	wait := limit.Period.Seconds()*(1-available/float64(c.previousCount)) - elapsed.Seconds()
+	return secondsDuration(math.Max(0, wait))
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MemoryStore_Token_Bucket_Refills(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Requests: 2, Period: time.Second, Burst: 3}
+	now := time.Unix(1000, 0)
+
+	for i := 0; i < 3; i++ {
+		result, _ := store.Take(context.TODO(), "k", limit, now)
+		assert.True(t, result.Allowed, "Burst should allow three requests")
+		assert.Equal(t, 2-i, result.Remaining)
+	}
+	result, _ := store.Take(context.TODO(), "k", limit, now)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+	assert.Equal(t, 3, result.Limit)
+
+	result, _ = store.Take(context.TODO(), "k", limit, now.Add(500*time.Millisecond))
+	assert.True(t, result.Allowed, "One token should be refilled")
+
+	other, _ := store.Take(context.TODO(), "other", limit, now)
+	assert.True(t, other.Allowed, "Keys should be counted separately")
+}
+
+func Test_MemoryStore_Sliding_Window(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Requests: 4, Period: 10 * time.Second, Algorithm: SlidingWindow}
+	start := time.Unix(1000, 0)
+
+	for i := 0; i < 4; i++ {
+		result, _ := store.Take(context.TODO(), "k", limit, start)
+		assert.True(t, result.Allowed)
+	}
+	result, _ := store.Take(context.TODO(), "k", limit, start.Add(5*time.Second))
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 5*time.Second, result.RetryAfter)
+
+	// half way into the next window the previous four requests weigh two
+	result, _ = store.Take(context.TODO(), "k", limit, start.Add(15*time.Second))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Remaining)
+	result, _ = store.Take(context.TODO(), "k", limit, start.Add(15*time.Second))
+	assert.True(t, result.Allowed)
+	result, _ = store.Take(context.TODO(), "k", limit, start.Add(15*time.Second))
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 2500*time.Millisecond, result.RetryAfter)
+
+	result, _ = store.Take(context.TODO(), "k", limit, start.Add(40*time.Second))
+	assert.True(t, result.Allowed, "Counters should reset after idle windows")
+	assert.Equal(t, 3, result.Remaining)
+}
+
+func Test_MemoryStore_Sweeps_Idle_Counters(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Requests: 1, Period: time.Second}
+	now := time.Unix(1000, 0)
+
+	store.Take(context.TODO(), "idle", limit, now)
+	store.Take(context.TODO(), "active", limit, now.Add(2*time.Minute))
+
+	assert.NotContains(t, store.counters, "idle")
+	assert.Contains(t, store.counters, "active")
+}
+
+func Test_MemoryStore_Rejects_Invalid_Limits(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	for _, limit := range []RateLimit{{Requests: 1}, {Period: time.Second}, {Requests: 1, Algorithm: SlidingWindow}} {
+		_, err := store.Take(context.TODO(), "k", limit, time.Unix(1000, 0))
+		assert.Error(t, err)
+	}
+}
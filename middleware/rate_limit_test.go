@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRateLimitRouter(options RateLimitOptions) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(RateLimitMiddleware(options, log.NewLogger("", "")))
+	appRouter.HandleFunc("/api/assets", successHandler)
+	appRouter.HandleFunc("/api/reports", successHandler)
+	return appRouter
+}
+
+func rateLimitedRequest(appRouter *mux.Router, target string, header string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	if header != "" {
+		req.Header.Set("X-Client-Id", header)
+	}
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w
+}
+
+func Test_RateLimit_Rejects_Over_Limit_With_Headers(t *testing.T) {
+	var templateData map[string]string
+	appRouter := setupRateLimitRouter(RateLimitOptions{
+		Default: &RateLimit{Requests: 2, Period: time.Minute},
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, messageID string, data map[string]string) {
+			templateData = data
+			w.WriteHeader(status)
+		},
+	})
+
+	w := rateLimitedRequest(appRouter, "/api/assets", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get(RateLimitLimitHeader))
+	assert.Equal(t, "1", w.Header().Get(RateLimitRemainingHeader))
+	assert.Equal(t, "30", w.Header().Get(RateLimitResetHeader))
+
+	rateLimitedRequest(appRouter, "/api/assets", "")
+	w = rateLimitedRequest(appRouter, "/api/assets", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get(RateLimitRemainingHeader))
+	assert.Equal(t, "30", w.Header().Get(RetryAfterHeader))
+	assert.Equal(t, "30", templateData["RetryAfter"])
+}
+
+func Test_RateLimit_Per_Route_Limits_And_Keys(t *testing.T) {
+	appRouter := setupRateLimitRouter(RateLimitOptions{
+		Routes: []RouteRateLimit{
+			{RouteMatcher: RouteMatcher{Route: "/api/reports"}, Limit: RateLimit{Requests: 1, Period: time.Minute}, Key: KeyByHeader("X-Client-Id")},
+		},
+	})
+
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(appRouter, "/api/reports", "a").Code)
+	assert.Equal(t, http.StatusTooManyRequests, rateLimitedRequest(appRouter, "/api/reports", "a").Code)
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(appRouter, "/api/reports", "b").Code, "Clients should be limited separately")
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(appRouter, "/api/reports", "").Code, "Requests without key are not limited")
+
+	for i := 0; i < 5; i++ {
+		w := rateLimitedRequest(appRouter, "/api/assets", "a")
+		assert.Equal(t, http.StatusOK, w.Code, "Routes without limit are not limited")
+		assert.Empty(t, w.Header().Get(RateLimitLimitHeader))
+	}
+}
+
+func Test_RateLimit_Key_By_Subject(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(t, "", KeyBySubject(req))
+	req = req.WithContext(context.WithValue(req.Context(), ContextClaimsKey, &Claims{Subject: "user-1"}))
+	assert.Equal(t, "user-1", KeyBySubject(req))
+	assert.Equal(t, "192.0.2.1", KeyByClientIP(req))
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("store unavailable")
+}
+
+func Test_RateLimit_Allows_Requests_When_Store_Fails(t *testing.T) {
+	appRouter := setupRateLimitRouter(RateLimitOptions{Default: &RateLimit{Requests: 1, Period: time.Minute}, Store: failingRateLimitStore{}})
+
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(appRouter, "/api/assets", "").Code)
+	assert.Equal(t, http.StatusOK, rateLimitedRequest(appRouter, "/api/assets", "").Code)
+}
+
+func Test_RateLimit_Applies_Defaults_To_Invalid_Limits(t *testing.T) {
+	for _, algorithm := range []RateLimitAlgorithm{TokenBucket, SlidingWindow} {
+		appRouter := setupRateLimitRouter(RateLimitOptions{Default: &RateLimit{Algorithm: algorithm}})
+
+		w := rateLimitedRequest(appRouter, "/api/assets", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "1", w.Header().Get(RateLimitLimitHeader))
+		assert.Equal(t, http.StatusTooManyRequests, rateLimitedRequest(appRouter, "/api/assets", "").Code)
+	}
+}
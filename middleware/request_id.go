@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
+)
+
+// RequestIDHeader represents the X-Request-Id Header param
+const RequestIDHeader = "X-Request-Id"
+
+// validRequestID limits incoming ids to a safe length and character set before they are logged and forwarded
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// RequestIDMiddleware is a gorilla mux middleware making sure every request carries a request id
+func RequestIDMiddleware(logger log.LoggerType) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return RequestIDWrapper(next, logger)
+	}
+}
+
+// RequestIDWrapper reuses a valid incoming X-Request-Id or generates a new one. The id is stored in the
+// request context, set on the request header for the trace propagation, and echoed in the response header.
+func RequestIDWrapper(next http.Handler, logger log.LoggerType) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			if requestID != "" {
+				logger.Debugf("Replacing invalid incoming request id")
+			}
+			requestID = uuid.NewString()
+		}
+
+		r.Header.Set(RequestIDHeader, requestID)
+		w.Header().Set(RequestIDHeader, requestID)
+
+		// call next
+		next.ServeHTTP(w, r.WithContext(trace.ContextWithRequestID(r.Context(), requestID)))
+	})
+}
+
+// GetRequestID returns the request id of the request, or an empty string when RequestIDWrapper was not used
+func GetRequestID(r *http.Request) string {
+	return trace.GetRequestID(r.Context())
+}
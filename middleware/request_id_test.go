@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveWithRequestID(t *testing.T, incoming string) (*httptest.ResponseRecorder, string) {
+	var contextID string
+	appRouter := mux.NewRouter()
+	appRouter.Use(RequestIDMiddleware(log.NewLogger("", "")))
+	appRouter.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		contextID = GetRequestID(r)
+		assert.Equal(t, contextID, trace.GetHeaders(r.Context())[trace.RequestIDHeader], "Request id should be forwarded downstream")
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if incoming != "" {
+		req.Header.Set(RequestIDHeader, incoming)
+	}
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	return w, contextID
+}
+
+func Test_RequestID_Reuses_Incoming_Id(t *testing.T) {
+	w, contextID := serveWithRequestID(t, "incoming-id-1")
+
+	assert.Equal(t, "incoming-id-1", contextID)
+	assert.Equal(t, "incoming-id-1", w.Header().Get(RequestIDHeader))
+}
+
+func Test_RequestID_Generates_Missing_Id(t *testing.T) {
+	w, contextID := serveWithRequestID(t, "")
+
+	assert.NotEmpty(t, contextID)
+	assert.Equal(t, contextID, w.Header().Get(RequestIDHeader))
+}
+
+func Test_RequestID_Replaces_Invalid_Id(t *testing.T) {
+	invalid := strings.Repeat("x", 200)
+	w, contextID := serveWithRequestID(t, invalid)
+
+	assert.NotEqual(t, invalid, contextID)
+	assert.Equal(t, contextID, w.Header().Get(RequestIDHeader))
+}
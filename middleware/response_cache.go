@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheMaxEntries is the default number of responses kept by the response cache
+	DefaultCacheMaxEntries = 1000
+	// DefaultCacheMaxSize is the default total body size kept by the response cache
+	DefaultCacheMaxSize = 64 * 1024 * 1024
+	// DefaultCacheMaxEntrySize is the default largest body kept by the response cache
+	DefaultCacheMaxEntrySize = 1024 * 1024
+)
+
+// ResponseCacheOptions bounds the response cache, the least recently used responses are evicted first
+type ResponseCacheOptions struct {
+	// MaxEntries is the number of responses kept, DefaultCacheMaxEntries when zero
+	MaxEntries int
+	// MaxSize is the total body size kept, DefaultCacheMaxSize when zero
+	MaxSize int64
+	// MaxEntrySize is the largest body kept, DefaultCacheMaxEntrySize when zero
+	MaxEntrySize int64
+}
+
+// ResponseCacheStats is a snapshot of the response cache
+type ResponseCacheStats struct {
+	Entries int
+	Size    int64
+	Hits    uint64
+	Misses  uint64
+}
+
+// ResponseCache keeps GET responses in memory, see CacheOptions.Store. It is safe for concurrent use.
+type ResponseCache struct {
+	options ResponseCacheOptions
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// vary keeps the request headers each URL varies on, as set by the handler
+	vary   map[string]*cacheVary
+	size   int64
+	hits   uint64
+	misses uint64
+}
+
+// cacheVary is the request headers a URL varies on, kept while the URL has responses
+type cacheVary struct {
+	names   []string
+	entries int
+}
+
+// cacheEntry is a stored response, fresh until expires and served stale until staleUntil
+type cacheEntry struct {
+	key          string
+	base         string
+	path         string
+	status       int
+	header       http.Header
+	body         []byte
+	stored       time.Time
+	expires      time.Time
+	staleUntil   time.Time
+	revalidating bool
+}
+
+// NewResponseCache creates an empty response cache
+func NewResponseCache(options ResponseCacheOptions) *ResponseCache {
+	if options.MaxEntries <= 0 {
+		options.MaxEntries = DefaultCacheMaxEntries
+	}
+	if options.MaxSize <= 0 {
+		options.MaxSize = DefaultCacheMaxSize
+	}
+	if options.MaxEntrySize <= 0 {
+		options.MaxEntrySize = DefaultCacheMaxEntrySize
+	}
+	return &ResponseCache{
+		options: options,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		vary:    map[string]*cacheVary{},
+	}
+}
+
+// Purge removes the responses of the path, whatever their query and variant, and returns how many were removed
+func (c *ResponseCache) Purge(path string) int {
+	return c.purge(func(entry *cacheEntry) bool { return entry.path == path })
+}
+
+// PurgePrefix removes the responses of the paths starting with the prefix and returns how many were removed
+func (c *ResponseCache) PurgePrefix(prefix string) int {
+	return c.purge(func(entry *cacheEntry) bool { return strings.HasPrefix(entry.path, prefix) })
+}
+
+// PurgeAll removes every response
+func (c *ResponseCache) PurgeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.vary = map[string]*cacheVary{}
+	c.size = 0
+}
+
+// Stats returns the number of responses, their total size and the hit and miss counts
+func (c *ResponseCache) Stats() ResponseCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ResponseCacheStats{Entries: c.lru.Len(), Size: c.size, Hits: c.hits, Misses: c.misses}
+}
+
+// RegisterMetrics exposes the entries, size, hits and misses as gauges of the metrics
+func (c *ResponseCache) RegisterMetrics(metrics *HTTPMetrics) {
+	metrics.AddGauge("response_cache_entries", "Number of responses in the response cache.", func() float64 {
+		return float64(c.Stats().Entries)
+	})
+	metrics.AddGauge("response_cache_size_bytes", "Total body size of the responses in the response cache.", func() float64 {
+		return float64(c.Stats().Size)
+	})
+	metrics.AddGauge("response_cache_hits", "Number of requests served from the response cache.", func() float64 {
+		return float64(c.Stats().Hits)
+	})
+	metrics.AddGauge("response_cache_misses", "Number of cacheable requests not served from the response cache.", func() float64 {
+		return float64(c.Stats().Misses)
+	})
+}
+
+func (c *ResponseCache) purge(selects func(entry *cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if selects(element.Value.(*cacheEntry)) {
+			c.remove(element)
+			removed++
+		}
+		element = next
+	}
+	return removed
+}
+
+// variantKey returns the key of the response to the request for the base key, with the values of the request
+// headers the URL varies on
+func (c *ResponseCache) variantKey(base string, r *http.Request) string {
+	c.mu.Lock()
+	var names []string
+	if vary, ok := c.vary[base]; ok {
+		names = vary.names
+	}
+	c.mu.Unlock()
+	return varyKey(base, names, r)
+}
+
+func varyKey(base string, names []string, r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(base)
+	for _, name := range names {
+		key.WriteString("\n" + name + ":" + strings.Join(r.Header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// lookup returns the stored response, counting the hit or miss
+func (c *ResponseCache) lookup(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok || !c.now().Before(element.Value.(*cacheEntry).staleUntil) {
+		if ok {
+			c.remove(element)
+		}
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry), true
+}
+
+// startRevalidation reports whether the caller revalidates the stale entry, a single caller does at a time
+func (c *ResponseCache) startRevalidation(entry *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.revalidating {
+		return false
+	}
+	entry.revalidating = true
+	return true
+}
+
+// endRevalidation lets the stale entry be revalidated again after a failed revalidation
+func (c *ResponseCache) endRevalidation(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.revalidating = false
+}
+
+// store keeps the response of the base key under the variant of the request, evicting the least recently used
+// responses over the limits
+func (c *ResponseCache) store(base string, vary []string, r *http.Request, entry *cacheEntry) {
+	if int64(len(entry.body)) > c.options.MaxEntrySize {
+		return
+	}
+	entry.base, entry.key = base, varyKey(base, vary, r)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	if _, ok := c.vary[base]; !ok {
+		c.vary[base] = &cacheVary{}
+	}
+	c.vary[base].names = vary
+	c.vary[base].entries++
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	for c.lru.Len() > c.options.MaxEntries || c.size > c.options.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+	if vary := c.vary[entry.base]; vary != nil {
+		if vary.entries--; vary.entries <= 0 {
+			delete(c.vary, entry.base)
+		}
+	}
+}
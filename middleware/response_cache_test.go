@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeResponse(store *ResponseCache, target string, body string) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	now := store.now()
+	store.store(target, nil, req, &cacheEntry{
+		path:       requestPath(req),
+		status:     http.StatusOK,
+		header:     http.Header{},
+		body:       []byte(body),
+		stored:     now,
+		expires:    now.Add(time.Minute),
+		staleUntil: now.Add(time.Minute),
+	})
+}
+
+func Test_Response_Cache_Evicts_Least_Recently_Used(t *testing.T) {
+	store := NewResponseCache(ResponseCacheOptions{MaxEntries: 3, MaxSize: 40, MaxEntrySize: 20})
+	for i := 0; i < 3; i++ {
+		storeResponse(store, fmt.Sprintf("/api/assets/%d", i), "0123456789")
+	}
+	_, ok := store.lookup("/api/assets/0")
+	assert.True(t, ok)
+
+	storeResponse(store, "/api/assets/3", "0123456789")
+	_, ok = store.lookup("/api/assets/1")
+	assert.False(t, ok, "the least recently used response is evicted over MaxEntries")
+	_, ok = store.lookup("/api/assets/0")
+	assert.True(t, ok)
+
+	storeResponse(store, "/api/assets/4", "01234567890123456789")
+	assert.Equal(t, ResponseCacheStats{Entries: 3, Size: 40, Hits: 2, Misses: 1}, store.Stats(), "responses are evicted over MaxSize")
+	_, ok = store.lookup("/api/assets/2")
+	assert.False(t, ok)
+
+	storeResponse(store, "/api/assets/5", "a body over the entry size")
+	_, ok = store.lookup("/api/assets/5")
+	assert.False(t, ok, "responses over MaxEntrySize are not stored")
+}
+
+func Test_Response_Cache_Expires_Entries(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	store := NewResponseCache(ResponseCacheOptions{})
+	store.now = func() time.Time { return now }
+	storeResponse(store, "/api/assets", "response value")
+
+	now = now.Add(time.Minute)
+	_, ok := store.lookup("/api/assets")
+	assert.False(t, ok)
+	assert.Equal(t, ResponseCacheStats{Misses: 1}, store.Stats(), "expired responses are removed")
+}
+
+func Test_Response_Cache_Purge(t *testing.T) {
+	store := NewResponseCache(ResponseCacheOptions{})
+	for _, target := range []string{"/api/standards/a", "/api/standards/a?page=2", "/api/standards/ab", "/api/assets/1"} {
+		storeResponse(store, target, "response value")
+	}
+
+	assert.Equal(t, 2, store.Purge("/api/standards/a"), "every query of the path is purged")
+	assert.Equal(t, 1, store.PurgePrefix("/api/standards"))
+	assert.Equal(t, 0, store.PurgePrefix("/api/standards"))
+	assert.Equal(t, ResponseCacheStats{Entries: 1, Size: int64(len("response value"))}, store.Stats())
+
+	store.PurgeAll()
+	assert.Equal(t, ResponseCacheStats{}, store.Stats())
+	assert.Empty(t, store.vary)
+}
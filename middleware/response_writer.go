@@ -0,0 +1,92 @@
+package middleware
+
+import "net/http"
+
+// contentTypeHeader represents the Content-Type header param
+const contentTypeHeader = "Content-Type"
+
+// wrapResponseWriter returns a response writer that writes through wrapped but still exposes the optional
+// http.Flusher, http.Hijacker and http.Pusher interfaces implemented by original, so streaming, SSE and
+// websocket upgrades keep working behind a middleware. When wrapped implements http.Flusher itself its
+// Flush is used, allowing it to push out any buffered data first, and likewise its own http.Hijacker.
+func wrapResponseWriter(wrapped http.ResponseWriter, original http.ResponseWriter) http.ResponseWriter {
+	flusher, isFlusher := original.(http.Flusher)
+	if ownFlusher, ok := wrapped.(http.Flusher); ok && isFlusher {
+		flusher = ownFlusher
+	}
+	hijacker, isHijacker := original.(http.Hijacker)
+	if ownHijacker, ok := wrapped.(http.Hijacker); ok && isHijacker {
+		hijacker = ownHijacker
+	}
+	pusher, isPusher := original.(http.Pusher)
+
+	switch {
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{wrapped, flusher, hijacker, pusher}
+	case isFlusher && isHijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{wrapped, flusher, hijacker}
+	case isFlusher && isPusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{wrapped, flusher, pusher}
+	case isHijacker && isPusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{wrapped, hijacker, pusher}
+	case isFlusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{wrapped, flusher}
+	case isHijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{wrapped, hijacker}
+	case isPusher:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{wrapped, pusher}
+	default:
+		return struct {
+			http.ResponseWriter
+		}{wrapped}
+	}
+}
+
+// statusResponseWriter records the status and the size of the response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
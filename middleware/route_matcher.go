@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteMatcher selects requests by gorilla mux route and method. It is shared by the middlewares
+// supporting per-route configuration.
+type RouteMatcher struct {
+	// Route is a mux route name, a mux route template such as /api/assets/{type}, or a path glob such as
+	// /static/*.css where * matches within a path segment and ** matches across segments
+	Route string
+	// Methods limits the match to the listed methods, any method matches when empty
+	Methods []string
+}
+
+// globPatterns caches the compiled path globs by pattern
+var globPatterns sync.Map
+
+// Matches reports whether the request is selected by the matcher
+func (m RouteMatcher) Matches(r *http.Request) bool {
+	if len(m.Methods) > 0 && !containsFold(m.Methods, r.Method) {
+		return false
+	}
+	if m.Route == "" {
+		return true
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if route.GetName() == m.Route {
+			return true
+		}
+		if template, err := route.GetPathTemplate(); err == nil && template == m.Route {
+			return true
+		}
+	}
+	return globPattern(m.Route).MatchString(requestPath(r))
+}
+
+// requestPath returns the path of the request, falling back to the request URI for requests built without a URL
+func requestPath(r *http.Request) string {
+	if r.URL != nil {
+		return r.URL.Path
+	}
+	return r.RequestURI
+}
+
+// RouteTemplate returns the gorilla mux path template matched by the request, or an empty string when the
+// request was not routed by mux. Use it instead of the raw URI to keep log and metric labels bounded.
+func RouteTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return ""
+}
+
+func globPattern(glob string) *regexp.Regexp {
+	if pattern, ok := globPatterns.Load(glob); ok {
+		return pattern.(*regexp.Regexp)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			expr.WriteString("[^/]*")
+		case glob[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	pattern := regexp.MustCompile(expr.String())
+	globPatterns.Store(glob, pattern)
+	return pattern
+}
+
+// containsFold reports whether the value is in the list, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func matchThroughRouter(matcher RouteMatcher, method string, target string) bool {
+	matched := false
+	appRouter := mux.NewRouter()
+	appRouter.HandleFunc("/api/assets/{type}", func(w http.ResponseWriter, r *http.Request) {
+		matched = matcher.Matches(r)
+	}).Name("assets")
+	appRouter.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched = matcher.Matches(r)
+	})
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil))
+	return matched
+}
+
+func Test_RouteMatcher_Matches_Template_Name_And_Method(t *testing.T) {
+	assert.True(t, matchThroughRouter(RouteMatcher{Route: "/api/assets/{type}"}, "GET", "/api/assets/cam"))
+	assert.True(t, matchThroughRouter(RouteMatcher{Route: "assets", Methods: []string{"patch"}}, "PATCH", "/api/assets/cam"))
+	assert.False(t, matchThroughRouter(RouteMatcher{Route: "assets", Methods: []string{"PATCH"}}, "GET", "/api/assets/cam"))
+	assert.True(t, matchThroughRouter(RouteMatcher{}, "DELETE", "/anything"))
+}
+
+func Test_RouteMatcher_Matches_Path_Globs(t *testing.T) {
+	assert.True(t, matchThroughRouter(RouteMatcher{Route: "/static/*.css"}, "GET", "/static/site.css"))
+	assert.False(t, matchThroughRouter(RouteMatcher{Route: "/static/*.css"}, "GET", "/static/css/site.css"))
+	assert.True(t, matchThroughRouter(RouteMatcher{Route: "/static/**"}, "GET", "/static/css/site.css"))
+	assert.True(t, matchThroughRouter(RouteMatcher{Route: "**swagger**"}, "GET", "/api/swagger/index.html"))
+}
+
+func Test_RouteTemplate(t *testing.T) {
+	template := ""
+	appRouter := mux.NewRouter()
+	appRouter.HandleFunc("/api/assets/{type}", func(w http.ResponseWriter, r *http.Request) {
+		template = RouteTemplate(r)
+	})
+	appRouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/assets/cam", nil))
+
+	assert.Equal(t, "/api/assets/{type}", template)
+	assert.Equal(t, "", RouteTemplate(httptest.NewRequest("GET", "/", nil)))
+}
@@ -1,6 +1,11 @@
 package middleware
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
 
 //OptionsContentTypeHeader represents the X-Content-Type-Options Header param
 const OptionsContentTypeHeader = "X-Content-Type-Options"
@@ -20,15 +25,190 @@ const CSPHeader = "Content-Security-Policy"
 // hstsHeader represents the HSTS Header param
 const HSTSHeader = "Strict-Transport-Security"
 
-//Middleware to handle the security headers
-func SecurityWrapper(next http.Handler) http.Handler {
+// ReferrerPolicyHeader represents the Referrer-Policy Header param
+const ReferrerPolicyHeader = "Referrer-Policy"
+
+// PermissionsPolicyHeader represents the Permissions-Policy Header param
+const PermissionsPolicyHeader = "Permissions-Policy"
+
+// COOPHeader represents the Cross-Origin-Opener-Policy Header param
+const COOPHeader = "Cross-Origin-Opener-Policy"
+
+// COEPHeader represents the Cross-Origin-Embedder-Policy Header param
+const COEPHeader = "Cross-Origin-Embedder-Policy"
+
+// CORPHeader represents the Cross-Origin-Resource-Policy Header param
+const CORPHeader = "Cross-Origin-Resource-Policy"
+
+// SecurityPolicy lists the security headers set on every response, empty values are not set
+type SecurityPolicy struct {
+	ContentTypeOptions        string
+	XSSProtection             string
+	ContentSecurityPolicy     string
+	HSTS                      *HSTSPolicy
+	ReferrerPolicy            string
+	PermissionsPolicy         string
+	CrossOriginOpenerPolicy   string
+	CrossOriginEmbedderPolicy string
+	CrossOriginResourcePolicy string
+	CacheControl              string
+	Pragma                    string
+	// Overrides are applied in order on top of the policy for the matching requests
+	Overrides []SecurityOverride
+}
+
+// SecurityOverride changes the security headers for the requests selected by its RouteMatcher
+type SecurityOverride struct {
+	RouteMatcher
+	// Policy values that are set replace the values of the base policy, its Overrides are ignored
+	Policy SecurityPolicy
+	// Omit lists the headers that are not set for the matching requests
+	Omit []string
+}
+
+// HSTSPolicy builds the Strict-Transport-Security header value
+type HSTSPolicy struct {
+	MaxAge            time.Duration
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+func (h HSTSPolicy) String() string {
+	value := "max-age=" + strconv.FormatInt(int64(h.MaxAge/time.Second), 10)
+	if h.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if h.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// CSPBuilder builds a Content-Security-Policy header value, keeping the directives in the order they are added
+type CSPBuilder struct {
+	directives []string
+	sources    map[string][]string
+}
+
+// NewCSPBuilder creates an empty Content-Security-Policy builder
+func NewCSPBuilder() *CSPBuilder {
+	return &CSPBuilder{sources: map[string][]string{}}
+}
+
+// Directive adds the sources to the directive, e.g. Directive("script-src", "'self'", "'unsafe-inline'")
+func (b *CSPBuilder) Directive(name string, sources ...string) *CSPBuilder {
+	if _, ok := b.sources[name]; !ok {
+		b.directives = append(b.directives, name)
+	}
+	b.sources[name] = append(b.sources[name], sources...)
+	return b
+}
+
+// Build returns the header value
+func (b *CSPBuilder) Build() string {
+	parts := make([]string, 0, len(b.directives))
+	for _, name := range b.directives {
+		parts = append(parts, strings.TrimSpace(name+" "+strings.Join(b.sources[name], " ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// DefaultSecurityPolicy returns the headers set by SecurityWrapper
+func DefaultSecurityPolicy() SecurityPolicy {
+	return SecurityPolicy{
+		ContentTypeOptions:    "nosniff",
+		XSSProtection:         "1; mode=block",
+		CacheControl:          "no-store",
+		Pragma:                "no-cache",
+		ContentSecurityPolicy: NewCSPBuilder().Directive("frame-ancestors", "'self'").Build(),
+		HSTS:                  &HSTSPolicy{MaxAge: 365 * 24 * time.Hour},
+	}
+}
+
+// HTMLSecurityPolicy returns a policy setting HSTS and CSP only for the swagger path and html files
+func HTMLSecurityPolicy(swaggerPath string) SecurityPolicy {
+	htmlHeaders := SecurityPolicy{
+		ContentSecurityPolicy: NewCSPBuilder().Directive("frame-ancestors", "'self'").Build(),
+		HSTS:                  &HSTSPolicy{MaxAge: 365 * 24 * time.Hour},
+	}
+	return SecurityPolicy{
+		Overrides: []SecurityOverride{
+			{RouteMatcher: RouteMatcher{Route: swaggerPath}, Policy: htmlHeaders},
+			{RouteMatcher: RouteMatcher{Route: "**.html"}, Policy: htmlHeaders},
+			{RouteMatcher: RouteMatcher{Route: "**.htm"}, Policy: htmlHeaders},
+		},
+	}
+}
+
+// headers returns the header values of the policy without its overrides
+func (p SecurityPolicy) headers() map[string]string {
+	headers := map[string]string{
+		OptionsContentTypeHeader: p.ContentTypeOptions,
+		XSSProtectionHeader:      p.XSSProtection,
+		CSPHeader:                p.ContentSecurityPolicy,
+		ReferrerPolicyHeader:     p.ReferrerPolicy,
+		PermissionsPolicyHeader:  p.PermissionsPolicy,
+		COOPHeader:               p.CrossOriginOpenerPolicy,
+		COEPHeader:               p.CrossOriginEmbedderPolicy,
+		CORPHeader:               p.CrossOriginResourcePolicy,
+		CacheControlHeader:       p.CacheControl,
+		PragmaHeader:             p.Pragma,
+	}
+	if p.HSTS != nil {
+		headers[HSTSHeader] = p.HSTS.String()
+	}
+	for name, value := range headers {
+		if value == "" {
+			delete(headers, name)
+		}
+	}
+	return headers
+}
+
+// requestHeaders returns the headers for the request after applying the matching overrides
+func (p SecurityPolicy) requestHeaders(r *http.Request, base map[string]string) map[string]string {
+	headers := base
+	copied := false
+	for _, override := range p.Overrides {
+		if !override.Matches(r) {
+			continue
+		}
+		if !copied {
+			headers = make(map[string]string, len(base))
+			for name, value := range base {
+				headers[name] = value
+			}
+			copied = true
+		}
+		for name, value := range override.Policy.headers() {
+			headers[name] = value
+		}
+		for _, name := range override.Omit {
+			delete(headers, http.CanonicalHeaderKey(name))
+		}
+	}
+	return headers
+}
+
+// SecurityPolicyMiddleware is a gorilla mux middleware setting the security headers of the policy
+func SecurityPolicyMiddleware(policy SecurityPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return SecurityPolicyWrapper(next, policy)
+	}
+}
+
+// SecurityPolicyWrapper sets the security headers of the policy before calling the next handler
+func SecurityPolicyWrapper(next http.Handler, policy SecurityPolicy) http.Handler {
+	base := policy.headers()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set(OptionsContentTypeHeader, "nosniff")
-		w.Header().Set(XSSProtectionHeader, "1; mode=block")
-		w.Header().Set(CacheControlHeader, "no-store")
-		w.Header().Set(PragmaHeader, "no-cache")
-		w.Header().Set(CSPHeader, "frame-ancestors 'self'")
-		w.Header().Set(HSTSHeader, "max-age=31536000")
+		for name, value := range policy.requestHeaders(r, base) {
+			w.Header().Set(name, value)
+		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+//Middleware to handle the security headers
+func SecurityWrapper(next http.Handler) http.Handler {
+	return SecurityPolicyWrapper(next, DefaultSecurityPolicy())
+}
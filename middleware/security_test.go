@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func newHttpHandler() http.Handler {
@@ -36,3 +39,64 @@ func Test_Security_Wrapper(t *testing.T) {
 	}
 
 }
+
+func Test_Security_Wrapper_Keeps_Default_Values(t *testing.T) {
+	respRecorder := httptest.NewRecorder()
+	SecurityWrapper(newHttpHandler()).ServeHTTP(respRecorder, httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, "nosniff", respRecorder.Header().Get(OptionsContentTypeHeader))
+	assert.Equal(t, "1; mode=block", respRecorder.Header().Get(XSSProtectionHeader))
+	assert.Equal(t, "no-store", respRecorder.Header().Get(CacheControlHeader))
+	assert.Equal(t, "no-cache", respRecorder.Header().Get(PragmaHeader))
+	assert.Equal(t, "frame-ancestors 'self'", respRecorder.Header().Get(CSPHeader))
+	assert.Equal(t, "max-age=31536000", respRecorder.Header().Get(HSTSHeader))
+	assert.Empty(t, respRecorder.Header().Get(ReferrerPolicyHeader))
+}
+
+func Test_Security_Policy_Builders(t *testing.T) {
+	csp := NewCSPBuilder().
+		Directive("default-src", "'self'").
+		Directive("img-src", "'self'", "data:").
+		Directive("default-src", "https://cdn.example.com").
+		Directive("upgrade-insecure-requests").
+		Build()
+	assert.Equal(t, "default-src 'self' https://cdn.example.com; img-src 'self' data:; upgrade-insecure-requests", csp)
+
+	hsts := HSTSPolicy{MaxAge: time.Hour, IncludeSubDomains: true, Preload: true}
+	assert.Equal(t, "max-age=3600; includeSubDomains; preload", hsts.String())
+}
+
+func Test_Security_Policy_Applies_Route_Overrides(t *testing.T) {
+	policy := DefaultSecurityPolicy()
+	policy.ReferrerPolicy = "no-referrer"
+	policy.CrossOriginOpenerPolicy = "same-origin"
+	policy.Overrides = []SecurityOverride{
+		{
+			RouteMatcher: RouteMatcher{Route: "/swagger/**"},
+			Policy:       SecurityPolicy{ContentSecurityPolicy: NewCSPBuilder().Directive("script-src", "'self'", "'unsafe-inline'").Build()},
+		},
+		{
+			RouteMatcher: RouteMatcher{Route: "/static/**", Methods: []string{"GET"}},
+			Policy:       SecurityPolicy{CacheControl: "public, max-age=86400"},
+			Omit:         []string{"pragma"},
+		},
+	}
+	handler := SecurityPolicyMiddleware(policy)(newHttpHandler())
+
+	swagger := httptest.NewRecorder()
+	handler.ServeHTTP(swagger, httptest.NewRequest("GET", "/swagger/index.html", nil))
+	assert.Equal(t, "script-src 'self' 'unsafe-inline'", swagger.Header().Get(CSPHeader))
+	assert.Equal(t, "no-store", swagger.Header().Get(CacheControlHeader))
+
+	static := httptest.NewRecorder()
+	handler.ServeHTTP(static, httptest.NewRequest("GET", "/static/app.js", nil))
+	assert.Equal(t, "public, max-age=86400", static.Header().Get(CacheControlHeader))
+	assert.Empty(t, static.Header().Get(PragmaHeader))
+	assert.Equal(t, "no-referrer", static.Header().Get(ReferrerPolicyHeader))
+	assert.Equal(t, "same-origin", static.Header().Get(COOPHeader))
+
+	api := httptest.NewRecorder()
+	handler.ServeHTTP(api, httptest.NewRequest("GET", "/api/assets", nil))
+	assert.Equal(t, "frame-ancestors 'self'", api.Header().Get(CSPHeader))
+	assert.Equal(t, "no-cache", api.Header().Get(PragmaHeader))
+}
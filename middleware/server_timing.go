@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/trace"
+)
+
+// ServerTimingHeader represents the Server-Timing Header param
+const ServerTimingHeader = "Server-Timing"
+
+// TotalTimingPhase names the phase covering the whole request in the Server-Timing header
+const TotalTimingPhase = "total"
+
+// ServerTimingOptions configures the Server-Timing middleware
+type ServerTimingOptions struct {
+	// InternalNetworks limit the header to the callers from these networks, every caller gets it when empty
+	InternalNetworks []*net.IPNet
+	// InternalCaller decides which callers get the header, it replaces InternalNetworks when set
+	InternalCaller func(r *http.Request) bool
+}
+
+// ServerTimingMiddleware is a gorilla mux middleware emitting the request phases as a Server-Timing header
+func ServerTimingMiddleware(options ServerTimingOptions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return ServerTimingWrapper(next, options)
+	}
+}
+
+// ServerTimingWrapper stores the request timings in the context, see trace.StartPhase, and emits the phases
+// stopped before the response header is written, followed by the total, as a Server-Timing header to the internal
+// callers. The logging middleware logs the phases as the response-phases field.
+func ServerTimingWrapper(next http.Handler, options ServerTimingOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(trace.ContextWithTimings(r.Context()))
+		if !options.internal(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tw := &timingResponseWriter{ResponseWriter: w, timings: trace.GetTimings(r.Context()), start: time.Now()}
+		// call next
+		next.ServeHTTP(wrapResponseWriter(tw, w), r)
+		// a handler writing no response still gets the header
+		tw.setHeader()
+	})
+}
+
+// internal reports whether the caller gets the Server-Timing header
+func (o ServerTimingOptions) internal(r *http.Request) bool {
+	if o.InternalCaller != nil {
+		return o.InternalCaller(r)
+	}
+	if len(o.InternalNetworks) == 0 {
+		return true
+	}
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, network := range o.InternalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerTiming formats the phases as a Server-Timing header value, e.g. db;desc="load assets";dur=12.5
+func ServerTiming(phases []trace.TimingPhase) string {
+	metrics := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		metric := timingToken(phase.Name)
+		if phase.Description != "" {
+			metric += `;desc="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(phase.Description) + `"`
+		}
+		metric += fmt.Sprintf(";dur=%.1f", float64(phase.Duration)/float64(time.Millisecond))
+		metrics = append(metrics, metric)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// timingPhaseFields sums the duration in milliseconds of the phases by name, for the log entries
+func timingPhaseFields(phases []trace.TimingPhase) map[string]int64 {
+	fields := map[string]int64{}
+	for _, phase := range phases {
+		fields[phase.Name] += phase.Duration.Milliseconds()
+	}
+	return fields
+}
+
+// timingToken replaces the characters not allowed in a metric name
+func timingToken(name string) string {
+	if name == "" {
+		return "_"
+	}
+	return strings.Map(func(c rune) rune {
+		if c > ' ' && c < 0x7f && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// timingResponseWriter sets the Server-Timing header when the response header is written
+type timingResponseWriter struct {
+	http.ResponseWriter
+	timings     *trace.Timings
+	start       time.Time
+	wroteHeader bool
+}
+
+func (w *timingResponseWriter) WriteHeader(code int) {
+	w.setHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingResponseWriter) Write(b []byte) (int, error) {
+	w.setHeader()
+	return w.ResponseWriter.Write(b)
+}
+
+// setHeader sets the Server-Timing header once, with the phases stopped so far
+func (w *timingResponseWriter) setHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	phases := append(w.timings.Phases(), trace.TimingPhase{Name: TotalTimingPhase, Duration: time.Since(w.start)})
+	w.Header().Set(ServerTimingHeader, ServerTiming(phases))
+}
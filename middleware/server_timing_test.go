@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func timedHandler(w http.ResponseWriter, r *http.Request) {
+	stop := trace.StartPhase(r.Context(), "db", `load "assets"`)
+	time.Sleep(time.Millisecond)
+	stop()
+	trace.GetTimings(r.Context()).Add("encode", "", 2*time.Millisecond)
+	w.Write([]byte("response value"))
+}
+
+func Test_Server_Timing_Header(t *testing.T) {
+	handler := ServerTimingWrapper(http.HandlerFunc(timedHandler), ServerTimingOptions{})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, regexp.MustCompile(`^db;desc="load \\"assets\\"";dur=\d+\.\d, encode;dur=2\.0, total;dur=\d+\.\d$`),
+		w.Header().Get(ServerTimingHeader))
+}
+
+func Test_Server_Timing_Header_Without_Response(t *testing.T) {
+	handler := ServerTimingWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), ServerTimingOptions{})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+	assert.Regexp(t, `^total;dur=`, w.Header().Get(ServerTimingHeader))
+}
+
+func Test_Server_Timing_Internal_Callers_Only(t *testing.T) {
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	handler := ServerTimingWrapper(http.HandlerFunc(timedHandler), ServerTimingOptions{InternalNetworks: []*net.IPNet{internal}})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+	req.RemoteAddr = "10.1.2.3:4567"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.NotEmpty(t, w.Header().Get(ServerTimingHeader))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+	assert.Empty(t, w.Header().Get(ServerTimingHeader))
+	assert.Equal(t, "response value", w.Body.String())
+}
+
+func Test_Server_Timing_Phases_Are_Logged(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	handler := LoggingWrapperWithOptions(ServerTimingWrapper(http.HandlerFunc(timedHandler), ServerTimingOptions{}),
+		newBufferedLogger(buffer), LoggingOptions{})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+
+	entries := readLogEntries(t, buffer)
+	phases := entries[1]["response-phases"].(map[string]interface{})
+	assert.Equal(t, float64(2), phases["encode"])
+	assert.Contains(t, phases, "db")
+}
+
+func Test_Server_Timing_Tokens(t *testing.T) {
+	assert.Equal(t, "GET_assets", timingToken("GET assets"))
+	assert.Equal(t, "_", timingToken(""))
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
+)
+
+// TimeoutMessageID is the message id used for requests exceeding their deadline
+const TimeoutMessageID = "REQUEST_TIMEOUT"
+
+// RouteTimeout applies its timeout to the requests selected by its RouteMatcher
+type RouteTimeout struct {
+	RouteMatcher
+	Timeout time.Duration
+}
+
+// TimeoutOptions configures the timeout middleware
+type TimeoutOptions struct {
+	// Default is the timeout of the requests not matching a route timeout, they have no deadline when zero
+	Default time.Duration
+	// Routes are the per-route timeouts, the first matching one is applied
+	Routes []RouteTimeout
+	// RespectInbound shortens the timeout to the budget sent by the caller in the trace.RequestTimeoutHeader, the
+	// requests whose budget is spent are rejected at once
+	RespectInbound bool
+	// Status is the status of the timed out responses, http.StatusServiceUnavailable when zero
+	Status int
+	// ErrorResponder writes the timed out responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the timed out responses, TimeoutMessageID when empty
+	MessageID string
+}
+
+// TimeoutMiddleware is a gorilla mux middleware putting a deadline on the request context
+func TimeoutMiddleware(options TimeoutOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	timeouts := newTimeoutLimiter(options, logger)
+	return func(next http.Handler) http.Handler {
+		return timeouts.handler(next)
+	}
+}
+
+// TimeoutWrapper runs the handler with a deadline on the request context. When the deadline expires before the
+// handler has written the response, the error response is written and the later writes of the handler fail with
+// http.ErrHandlerTimeout. The deadline is sent downstream by the service clients, see trace.GetHeaders.
+func TimeoutWrapper(next http.Handler, options TimeoutOptions, logger log.LoggerType) http.Handler {
+	return newTimeoutLimiter(options, logger).handler(next)
+}
+
+type timeoutLimiter struct {
+	options TimeoutOptions
+	logger  log.LoggerType
+}
+
+// newTimeoutLimiter applies the option defaults
+func newTimeoutLimiter(options TimeoutOptions, logger log.LoggerType) *timeoutLimiter {
+	if options.Status == 0 {
+		options.Status = http.StatusServiceUnavailable
+	}
+	if options.MessageID == "" {
+		options.MessageID = TimeoutMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	return &timeoutLimiter{options: options, logger: logger}
+}
+
+func (l *timeoutLimiter) handler(next http.Handler) http.Handler {
+	options := l.options
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, ok := options.timeoutFor(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if timeout <= 0 {
+			l.logger.Warnf("Request %s %s arrived with its time budget spent", r.Method, requestURI(r))
+			options.ErrorResponder(w, r, options.Status, options.MessageID, map[string]string{"Timeout": timeout.String()})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			// a handler setting headers without writing still answers with them
+			if !tw.wroteHeader {
+				tw.writeHeader(http.StatusOK)
+			}
+		case p := <-panicked:
+			// re-panic in the serving goroutine so the recovery of the server applies
+			panic(p)
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if ctx.Err() != context.DeadlineExceeded {
+				// the client went away, there is nobody to respond to
+				return
+			}
+			l.logger.Warnf("Request %s %s exceeded its %v timeout", r.Method, requestURI(r), timeout)
+			if !tw.wroteHeader {
+				options.ErrorResponder(w, r, options.Status, options.MessageID, map[string]string{"Timeout": timeout.String()})
+			}
+		}
+	})
+}
+
+// timeoutFor returns the timeout of the request, zero when the inbound budget is spent, false when the request has
+// no deadline
+func (o TimeoutOptions) timeoutFor(r *http.Request) (time.Duration, bool) {
+	timeout := o.Default
+	for i := range o.Routes {
+		if o.Routes[i].Matches(r) {
+			timeout = o.Routes[i].Timeout
+			break
+		}
+	}
+	if o.RespectInbound {
+		if inbound, ok := trace.ParseTimeoutHeader(r.Header); ok {
+			if inbound <= 0 {
+				return 0, true
+			}
+			if timeout <= 0 || inbound < timeout {
+				timeout = inbound
+			}
+		}
+	}
+	return timeout, timeout > 0
+}
+
+// timeoutWriter buffers the headers of the handler until it writes the status, and discards the writes after
+// the deadline. Only http.Flusher is exposed, the connection can't be hijacked from the handler goroutine.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeader(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		if !tw.wroteHeader {
+			tw.writeHeader(http.StatusOK)
+		}
+		flusher.Flush()
+	}
+}
+
+// writeHeader copies the handler headers to the response, tw.mu must be held
+func (tw *timeoutWriter) writeHeader(status int) {
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for key, values := range tw.header {
+		dst[key] = values
+	}
+	tw.w.WriteHeader(status)
+}
@@ -0,0 +1,159 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rrd1986/common-go-modules/log"
+	"github.com/rrd1986/common-go-modules/trace"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTimeoutRouter(options TimeoutOptions, handler http.HandlerFunc) *mux.Router {
+	appRouter := mux.NewRouter()
+	appRouter.Use(TimeoutMiddleware(options, log.NewLogger("", "")))
+	appRouter.HandleFunc("/api/assets", handler)
+	appRouter.HandleFunc("/api/reports", handler)
+	return appRouter
+}
+
+func Test_Timeout_Responds_When_Deadline_Expires(t *testing.T) {
+	var messageID string
+	writeErr := make(chan error, 1)
+	appRouter := setupTimeoutRouter(TimeoutOptions{
+		Default: 20 * time.Millisecond,
+		Status:  http.StatusGatewayTimeout,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, id string, data map[string]string) {
+			messageID = id
+			w.WriteHeader(status)
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("X-Late", "true")
+		_, err := w.Write([]byte("late"))
+		writeErr <- err
+	})
+
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, TimeoutMessageID, messageID)
+	assert.Equal(t, http.ErrHandlerTimeout, <-writeErr, "Writes after the deadline should fail")
+	assert.Empty(t, w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Late"))
+}
+
+func Test_Timeout_Passes_Response_Before_Deadline(t *testing.T) {
+	appRouter := setupTimeoutRouter(TimeoutOptions{Default: time.Second}, func(w http.ResponseWriter, r *http.Request) {
+		remaining, ok := trace.RemainingTimeout(r.Context())
+		assert.True(t, ok)
+		assert.True(t, remaining > 0 && remaining <= time.Second)
+		w.Header().Set("X-Handler", "true")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("response value"))
+	})
+
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Handler"))
+	assert.Equal(t, "response value", w.Body.String())
+}
+
+func Test_Timeout_Keeps_Headers_Of_Handler_Writing_Nothing(t *testing.T) {
+	appRouter := setupTimeoutRouter(TimeoutOptions{Default: time.Second}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/api/assets/1")
+		w.Header().Set(ETagHeader, `"v1"`)
+	})
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest("GET", "/api/assets", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "/api/assets/1", w.Header().Get("Location"))
+	assert.Equal(t, `"v1"`, w.Header().Get(ETagHeader))
+}
+
+func Test_Timeout_Per_Route_And_Inbound_Budget(t *testing.T) {
+	var remaining time.Duration
+	var hasDeadline bool
+	appRouter := setupTimeoutRouter(TimeoutOptions{
+		Default:        time.Minute,
+		Routes:         []RouteTimeout{{RouteMatcher: RouteMatcher{Route: "/api/reports"}, Timeout: 0}},
+		RespectInbound: true,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		remaining, hasDeadline = trace.RemainingTimeout(r.Context())
+	})
+
+	req := httptest.NewRequest("GET", "/api/assets", nil)
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, hasDeadline)
+	assert.True(t, remaining > 30*time.Second)
+
+	req = httptest.NewRequest("GET", "/api/assets", nil)
+	req.Header.Set(trace.RequestTimeoutHeader, "500")
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, hasDeadline)
+	assert.True(t, remaining <= 500*time.Millisecond, "The inbound budget should shorten the timeout")
+
+	req = httptest.NewRequest("GET", "/api/reports", nil)
+	appRouter.ServeHTTP(httptest.NewRecorder(), req)
+	assert.False(t, hasDeadline, "A zero route timeout disables the deadline")
+}
+
+func Test_Timeout_Rejects_Spent_Inbound_Budget(t *testing.T) {
+	var status int
+	called := false
+	appRouter := setupTimeoutRouter(TimeoutOptions{
+		Default:        time.Minute,
+		RespectInbound: true,
+		Status:         http.StatusGatewayTimeout,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, s int, id string, data map[string]string) {
+			status = s
+			w.WriteHeader(s)
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	for _, budget := range []string{"0", "-20"} {
+		req := httptest.NewRequest("GET", "/api/assets", nil)
+		req.Header.Set(trace.RequestTimeoutHeader, budget)
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code, budget)
+		assert.Equal(t, http.StatusGatewayTimeout, status, budget)
+		assert.False(t, called, "The handler should not run once the budget is spent")
+	}
+}
+
+func Test_Timeout_Repanics_In_Serving_Goroutine(t *testing.T) {
+	handler := TimeoutWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}), TimeoutOptions{Default: time.Second}, log.NewLogger("", ""))
+
+	assert.PanicsWithValue(t, "handler failed", func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/assets", nil))
+	})
+}
+
+func Test_Timeout_Flushes_Streamed_Responses(t *testing.T) {
+	handler := TimeoutWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chunk"))
+		w.(http.Flusher).Flush()
+	}), TimeoutOptions{Default: time.Second}, log.NewLogger("", ""))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/assets", nil))
+	assert.True(t, w.Flushed)
+	assert.Equal(t, "chunk", w.Body.String())
+}
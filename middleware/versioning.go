@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rrd1986/common-go-modules/log"
+)
+
+// ContextAPIVersionKey is of type contextKey to save the selected API version
+const ContextAPIVersionKey contextKey = "apiVersionKey"
+
+const (
+	// APIVersionHeader represents the API-Version Header param
+	APIVersionHeader = "API-Version"
+	// DeprecationHeader represents the Deprecation Header param
+	DeprecationHeader = "Deprecation"
+	// SunsetHeader represents the Sunset Header param
+	SunsetHeader = "Sunset"
+	// LinkHeader represents the Link Header param
+	LinkHeader = "Link"
+	// acceptHeader represents the Accept Header param
+	acceptHeader = "Accept"
+)
+
+// UnsupportedVersionMessageID is the message id used for requests asking for an unknown API version
+const UnsupportedVersionMessageID = "UNSUPPORTED_API_VERSION"
+
+// DefaultDeprecationLogInterval is how often a caller of a deprecated version is logged by default
+const DefaultDeprecationLogInterval = time.Hour
+
+// maxDeprecationCallers bounds the callers remembered to throttle the deprecation logs
+const maxDeprecationCallers = 10000
+
+// versionSegment matches the path segments looking like a version, e.g. v2 or v2.1
+var versionSegment = regexp.MustCompile(`^v\d+(\.\d+)*$`)
+
+// VersionDeprecation is the deprecation policy of an API version
+type VersionDeprecation struct {
+	Version string
+	// Routes limit the policy to some routes of the version, every route when empty
+	Routes []RouteMatcher
+	// Deprecated is when the version was deprecated, the Deprecation header is "true" when zero
+	Deprecated time.Time
+	// Sunset is when the version stops being served, no Sunset header when zero
+	Sunset time.Time
+	// Link is the documentation of the deprecation, linked with rel="deprecation"
+	Link string
+	// Successor is the URL of the replacing version, linked with rel="successor-version"
+	Successor string
+}
+
+// VersioningOptions configures the API version selection, the sources are checked in the order path prefix,
+// header and Accept media type parameter. An empty source name disables the source.
+type VersioningOptions struct {
+	// Versions are the supported versions, e.g. "v1" and "v2". A header or media type value may omit the "v".
+	Versions []string
+	// Default is the version of the requests naming none, the last supported version when empty
+	Default string
+	// PathPrefix selects the version from the first path segment, e.g. /v2/api/assets
+	PathPrefix bool
+	// StripPathPrefix removes the version segment from the path, so the versioned handlers share their routes.
+	// It requires the middleware to wrap the router rather than being registered with Router.Use.
+	StripPathPrefix bool
+	// Header is the header naming the version, e.g. APIVersionHeader
+	Header string
+	// MediaTypeParam is the Accept media type parameter naming the version, e.g. "version" for
+	// application/json; version=2
+	MediaTypeParam string
+	// Deprecations are the deprecation policies, the first one matching the request applies
+	Deprecations []VersionDeprecation
+	// LogInterval is how often a caller of a deprecated version is logged, DefaultDeprecationLogInterval when zero
+	LogInterval time.Duration
+	// ErrorResponder writes the 400 responses, DefaultErrorResponder when nil
+	ErrorResponder ErrorResponder
+	// MessageID is the message id of the 400 responses, UnsupportedVersionMessageID when empty
+	MessageID string
+}
+
+// VersioningMiddleware is a gorilla mux middleware selecting the API version of the requests
+func VersioningMiddleware(options VersioningOptions, logger log.LoggerType) func(http.Handler) http.Handler {
+	negotiator := newVersionNegotiator(options, logger)
+	return func(next http.Handler) http.Handler {
+		return negotiator.handler(next)
+	}
+}
+
+// VersioningWrapper stores the API version of the request in its context, see GetAPIVersion and
+// VersionedHandler, and echoes it in the configured header. An unknown version is rejected with a 400. The
+// responses of a deprecated version carry the Deprecation, Sunset and Link headers, and its callers are logged.
+func VersioningWrapper(next http.Handler, options VersioningOptions, logger log.LoggerType) http.Handler {
+	return newVersionNegotiator(options, logger).handler(next)
+}
+
+// GetAPIVersion returns the API version selected for the request, or an empty string when there is none
+func GetAPIVersion(r *http.Request) string {
+	version, _ := r.Context().Value(ContextAPIVersionKey).(string)
+	return version
+}
+
+// VersionedHandler dispatches the requests to the handler of their API version, the versions without handler
+// are answered with a 404
+func VersionedHandler(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[GetAPIVersion(r)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+type versionNegotiator struct {
+	options VersioningOptions
+	logger  log.LoggerType
+
+	mu      sync.Mutex
+	callers map[string]time.Time
+}
+
+// newVersionNegotiator applies the option defaults
+func newVersionNegotiator(options VersioningOptions, logger log.LoggerType) *versionNegotiator {
+	if options.Default == "" && len(options.Versions) > 0 {
+		options.Default = options.Versions[len(options.Versions)-1]
+	}
+	if options.LogInterval <= 0 {
+		options.LogInterval = DefaultDeprecationLogInterval
+	}
+	if options.MessageID == "" {
+		options.MessageID = UnsupportedVersionMessageID
+	}
+	options.ErrorResponder = orDefaultResponder(options.ErrorResponder)
+	return &versionNegotiator{options: options, logger: logger, callers: map[string]time.Time{}}
+}
+
+func (v *versionNegotiator) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested, fromPath := v.requestedVersion(r)
+		version := v.options.Default
+		if requested != "" {
+			var ok bool
+			if version, ok = v.supportedVersion(requested); !ok {
+				v.logger.Debugf("Rejecting request %s %s for unsupported API version %s", r.Method, requestURI(r), requested)
+				v.options.ErrorResponder(w, r, http.StatusBadRequest, v.options.MessageID,
+					map[string]string{"Version": requested, "Supported": strings.Join(v.options.Versions, ", ")})
+				return
+			}
+		}
+
+		header := w.Header()
+		if v.options.Header != "" {
+			header.Set(v.options.Header, version)
+			header.Add(VaryHeader, v.options.Header)
+		}
+		if v.options.MediaTypeParam != "" {
+			header.Add(VaryHeader, acceptHeader)
+		}
+		if deprecation := v.deprecation(r, version); deprecation != nil {
+			setDeprecationHeaders(header, deprecation)
+			v.logCaller(r, version)
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), ContextAPIVersionKey, version))
+		if fromPath && v.options.StripPathPrefix {
+			r = stripVersionSegment(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestedVersion returns the version named by the request, and whether it was named by the path
+func (v *versionNegotiator) requestedVersion(r *http.Request) (string, bool) {
+	if v.options.PathPrefix {
+		segment := strings.SplitN(strings.TrimPrefix(requestPath(r), "/"), "/", 2)[0]
+		if _, ok := v.supportedVersion(segment); ok || versionSegment.MatchString(segment) {
+			return segment, true
+		}
+	}
+	if v.options.Header != "" {
+		if version := strings.TrimSpace(r.Header.Get(v.options.Header)); version != "" {
+			return version, false
+		}
+	}
+	if v.options.MediaTypeParam != "" {
+		for _, mediaRange := range strings.Split(r.Header.Get(acceptHeader), ",") {
+			if _, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange)); err == nil && params[v.options.MediaTypeParam] != "" {
+				return params[v.options.MediaTypeParam], false
+			}
+		}
+	}
+	return "", false
+}
+
+// supportedVersion returns the supported version named by the value, with or without its "v"
+func (v *versionNegotiator) supportedVersion(value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+	for _, version := range v.options.Versions {
+		if strings.EqualFold(version, value) || strings.EqualFold(version, "v"+value) {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// deprecation returns the deprecation policy applying to the request, nil when the version is not deprecated
+func (v *versionNegotiator) deprecation(r *http.Request, version string) *VersionDeprecation {
+	for i := range v.options.Deprecations {
+		deprecation := &v.options.Deprecations[i]
+		if deprecation.Version == version && (len(deprecation.Routes) == 0 || matchesAny(deprecation.Routes, r)) {
+			return deprecation
+		}
+	}
+	return nil
+}
+
+// logCaller logs the caller of a deprecated version once per log interval
+func (v *versionNegotiator) logCaller(r *http.Request, version string) {
+	caller := remoteIP(r)
+	if claims := GetClaims(r); claims != nil && claims.Subject != "" {
+		caller = claims.Subject
+	}
+	route := RouteTemplate(r)
+	if route == "" {
+		route = requestPath(r)
+	}
+
+	now := time.Now()
+	key := version + " " + r.Method + " " + route + " " + caller
+	v.mu.Lock()
+	if last, ok := v.callers[key]; ok && now.Sub(last) < v.options.LogInterval {
+		v.mu.Unlock()
+		return
+	}
+	if len(v.callers) >= maxDeprecationCallers {
+		// drop the expired callers, or the oldest one when none expired
+		oldest := ""
+		for other, last := range v.callers {
+			if now.Sub(last) >= v.options.LogInterval {
+				delete(v.callers, other)
+			} else if oldest == "" || last.Before(v.callers[oldest]) {
+				oldest = other
+			}
+		}
+		if len(v.callers) >= maxDeprecationCallers {
+			delete(v.callers, oldest)
+		}
+	}
+	v.callers[key] = now
+	v.mu.Unlock()
+
+	v.logger.Warnf("Deprecated API version %s of %s %s called by %s (%s)", version, r.Method, route, caller, orDash(r.UserAgent()))
+}
+
+// setDeprecationHeaders sets the Deprecation (RFC 9745), Sunset (RFC 8594) and Link headers of the policy
+func setDeprecationHeaders(header http.Header, deprecation *VersionDeprecation) {
+	if deprecation.Deprecated.IsZero() {
+		header.Set(DeprecationHeader, "true")
+	} else {
+		header.Set(DeprecationHeader, "@"+strconv.FormatInt(deprecation.Deprecated.Unix(), 10))
+	}
+	if !deprecation.Sunset.IsZero() {
+		header.Set(SunsetHeader, deprecation.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if deprecation.Link != "" {
+		header.Add(LinkHeader, "<"+deprecation.Link+`>; rel="deprecation"; type="text/html"`)
+	}
+	if deprecation.Successor != "" {
+		header.Add(LinkHeader, "<"+deprecation.Successor+`>; rel="successor-version"`)
+	}
+}
+
+// stripVersionSegment returns a copy of the request without the version segment of its path
+func stripVersionSegment(r *http.Request) *http.Request {
+	stripped := r.Clone(r.Context())
+	trim := func(path string) string {
+		path = strings.TrimPrefix(path, "/")
+		if i := strings.Index(path, "/"); i >= 0 {
+			return path[i:]
+		}
+		return "/"
+	}
+	stripped.URL.Path = trim(r.URL.Path)
+	if r.URL.RawPath != "" {
+		stripped.URL.RawPath = trim(r.URL.RawPath)
+	}
+	stripped.RequestURI = stripped.URL.RequestURI()
+	return stripped
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupVersioningRouter(options VersioningOptions, buffer *bytes.Buffer) (*mux.Router, *string) {
+	var version string
+	appRouter := mux.NewRouter()
+	appRouter.Use(VersioningMiddleware(options, newBufferedLogger(buffer)))
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		version = GetAPIVersion(r)
+		w.Write([]byte("response value"))
+	}
+	appRouter.HandleFunc("/api/assets", handler)
+	appRouter.HandleFunc("/{version}/api/assets", handler)
+	return appRouter, &version
+}
+
+func Test_Versioning_Sources(t *testing.T) {
+	options := VersioningOptions{
+		Versions:       []string{"v1", "v2"},
+		PathPrefix:     true,
+		Header:         APIVersionHeader,
+		MediaTypeParam: "version",
+	}
+	tests := []struct {
+		name    string
+		path    string
+		header  string
+		accept  string
+		version string
+	}{
+		{name: "default is the last version", path: "/api/assets", version: "v2"},
+		{name: "path prefix", path: "/v1/api/assets", header: "2", version: "v1"},
+		{name: "header", path: "/api/assets", header: "v1", accept: "application/json; version=2", version: "v1"},
+		{name: "header without v", path: "/api/assets", header: "1", version: "v1"},
+		{name: "media type parameter", path: "/api/assets", accept: "text/html, application/json; version=1", version: "v1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appRouter, version := setupVersioningRouter(options, &bytes.Buffer{})
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.header != "" {
+				req.Header.Set(APIVersionHeader, test.header)
+			}
+			if test.accept != "" {
+				req.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+			appRouter.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, test.version, *version)
+			assert.Equal(t, test.version, w.Header().Get(APIVersionHeader))
+			assert.Equal(t, []string{APIVersionHeader, "Accept"}, w.Header().Values(VaryHeader))
+		})
+	}
+}
+
+func Test_Versioning_Rejects_Unknown_Versions(t *testing.T) {
+	var templateData map[string]string
+	options := VersioningOptions{
+		Versions:   []string{"v1", "v2"},
+		PathPrefix: true,
+		Header:     APIVersionHeader,
+		ErrorResponder: func(w http.ResponseWriter, r *http.Request, status int, messageID string, data map[string]string) {
+			assert.Equal(t, UnsupportedVersionMessageID, messageID)
+			templateData = data
+			w.WriteHeader(status)
+		},
+	}
+	appRouter, _ := setupVersioningRouter(options, &bytes.Buffer{})
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v3/api/assets", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, map[string]string{"Version": "v3", "Supported": "v1, v2"}, templateData)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+	req.Header.Set(APIVersionHeader, "beta")
+	w = httptest.NewRecorder()
+	appRouter.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "beta", templateData["Version"])
+}
+
+func Test_Versioning_Deprecation_Headers_And_Logs(t *testing.T) {
+	deprecated := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	options := VersioningOptions{
+		Versions: []string{"v1", "v2"},
+		Header:   APIVersionHeader,
+		Deprecations: []VersionDeprecation{{
+			Version:    "v1",
+			Routes:     []RouteMatcher{{Route: "/api/assets"}},
+			Deprecated: deprecated,
+			Sunset:     sunset,
+			Link:       "https://docs.example.com/deprecations/v1",
+			Successor:  "https://api.example.com/v2/api/assets",
+		}},
+	}
+	buffer := &bytes.Buffer{}
+	appRouter, _ := setupVersioningRouter(options, buffer)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+		req.Header.Set(APIVersionHeader, "v1")
+		w := httptest.NewRecorder()
+		appRouter.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "@1767225600", w.Header().Get(DeprecationHeader))
+		assert.Equal(t, "Thu, 31 Dec 2026 00:00:00 GMT", w.Header().Get(SunsetHeader))
+		assert.Equal(t, []string{
+			`<https://docs.example.com/deprecations/v1>; rel="deprecation"; type="text/html"`,
+			`<https://api.example.com/v2/api/assets>; rel="successor-version"`,
+		}, w.Header().Values(LinkHeader))
+	}
+	entries := readLogEntries(t, buffer)
+	assert.Len(t, entries, 1, "a caller is logged once per interval")
+	assert.True(t, strings.Contains(entries[0]["msg"].(string), "v1 of GET /api/assets called by 192.0.2.1"))
+
+	w := httptest.NewRecorder()
+	appRouter.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/assets", nil))
+	assert.Empty(t, w.Header().Get(DeprecationHeader), "v2 is not deprecated")
+}
+
+func Test_Versioning_Bounds_Remembered_Deprecation_Callers(t *testing.T) {
+	options := VersioningOptions{
+		Versions:     []string{"v1", "v2"},
+		Header:       APIVersionHeader,
+		Deprecations: []VersionDeprecation{{Version: "v1"}},
+	}
+	v := newVersionNegotiator(options, newBufferedLogger(&bytes.Buffer{}))
+	now := time.Now()
+	for i := 0; i < maxDeprecationCallers; i++ {
+		v.callers[strconv.Itoa(i)] = now.Add(time.Duration(i) * time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/assets", nil)
+	req.Header.Set(APIVersionHeader, "v1")
+	v.handler(http.HandlerFunc(successHandler)).ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Len(t, v.callers, maxDeprecationCallers, "the oldest caller should make room for the new one")
+	assert.NotContains(t, v.callers, "0")
+}
+
+func Test_Versioning_Wrapper_Strips_Path_Prefix(t *testing.T) {
+	appRouter := mux.NewRouter()
+	appRouter.Handle("/api/assets", VersionedHandler(map[string]http.Handler{
+		"v1": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("v1 assets")) }),
+		"v2": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("v2 assets")) }),
+	}))
+	options := VersioningOptions{Versions: []string{"v1", "v2"}, PathPrefix: true, StripPathPrefix: true}
+	handler := VersioningWrapper(appRouter, options, newBufferedLogger(&bytes.Buffer{}))
+
+	for path, body := range map[string]string{"/v1/api/assets": "v1 assets", "/v2/api/assets": "v2 assets", "/api/assets": "v2 assets"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, body, w.Body.String(), path)
+	}
+}
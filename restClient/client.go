@@ -29,7 +29,7 @@ type HTTPClient struct {
 func (client HTTPClient) Post(ctx context.Context, serviceURL string, header http.Header, payload *bytes.Buffer, userName string, userPass string) (interface{}, error) {
 
 	// create new request object
-	request, reqErr := http.NewRequest("POST", serviceURL, payload)
+	request, reqErr := http.NewRequestWithContext(requestContext(ctx), "POST", serviceURL, payload)
 	if reqErr != nil {
 		return nil, reqErr
 	}
@@ -78,7 +78,7 @@ func (client HTTPClient) Post(ctx context.Context, serviceURL string, header htt
 func (client HTTPClient) Get(ctx context.Context, serviceURL string, header http.Header, isTLS bool) (interface{}, error) {
 
 	// create new request object
-	request, reqErr := http.NewRequest("GET", serviceURL, nil)
+	request, reqErr := http.NewRequestWithContext(requestContext(ctx), "GET", serviceURL, nil)
 	if reqErr != nil {
 		return nil, reqErr
 	}
@@ -126,3 +126,11 @@ func (client HTTPClient) Get(ctx context.Context, serviceURL string, header http
 
 	return responseData, nil
 }
+
+// requestContext returns the context the outbound request is bound to, so it stops at the inbound request deadline
+func requestContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
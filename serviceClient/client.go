@@ -3,6 +3,7 @@ package serviceClient
 import (
 	"context"
 	"crypto/tls"
+	"net/http"
 	"net/url"
 	"os"
 
@@ -22,6 +23,9 @@ import (
 // Env var
 const restyDebugEnvVar = "REQUEST_DEBUG"
 
+// UpstreamTimingPhase names the timing phases of the calls made with the client, see trace.StartPhase
+const UpstreamTimingPhase = "upstream"
+
 // Error Codes
 const ErrorCodeResourceNotFound = 101
 const ErrorCodeServiceError = 102
@@ -71,6 +75,7 @@ func (c *client) GetApiPath() string {
 
 func (c *client) Get(ctx context.Context, params *map[string]string, headers *map[string]string, url string) (HeaderedResponse, error) {
 	r := c.getBasicRequest(ctx)
+	defer trace.StartPhase(ctx, UpstreamTimingPhase, upstreamDescription(http.MethodGet, url))()
 	if headers != nil {
 		r.SetHeaders(*headers)
 	}
@@ -82,6 +87,7 @@ func (c *client) Get(ctx context.Context, params *map[string]string, headers *ma
 
 func (c *client) Post(ctx context.Context, body interface{}, headers *map[string]string, url string) (HeaderedResponse, error) {
 	r := c.getBasicRequest(ctx)
+	defer trace.StartPhase(ctx, UpstreamTimingPhase, upstreamDescription(http.MethodPost, url))()
 	if headers != nil {
 		r.SetHeaders(*headers)
 	}
@@ -93,6 +99,7 @@ func (c *client) Post(ctx context.Context, body interface{}, headers *map[string
 
 func (c *client) Patch(ctx context.Context, body interface{}, headers *map[string]string, url string) (HeaderedResponse, error) {
 	r := c.getBasicRequest(ctx)
+	defer trace.StartPhase(ctx, UpstreamTimingPhase, upstreamDescription(http.MethodPatch, url))()
 	if headers != nil {
 		r.SetHeaders(*headers)
 	}
@@ -104,6 +111,7 @@ func (c *client) Patch(ctx context.Context, body interface{}, headers *map[strin
 
 func (c *client) Delete(ctx context.Context, params *map[string]string, headers *map[string]string, url string) (HeaderedResponse, error) {
 	r := c.getBasicRequest(ctx)
+	defer trace.StartPhase(ctx, UpstreamTimingPhase, upstreamDescription(http.MethodDelete, url))()
 	if headers != nil {
 		r.SetHeaders(*headers)
 	}
@@ -147,10 +155,22 @@ func (c *client) getBasicRequest(ctx context.Context) (r *resty.Request) {
 	} else {
 		req = c.client.R()
 	}
-	req.SetHeaders(trace.GetHeaders(ctx))
+	if ctx != nil {
+		// bind the request to the context so the downstream call stops at the inbound request deadline
+		req.SetContext(ctx)
+		req.SetHeaders(trace.GetHeaders(ctx))
+	}
 	return req
 }
 
+// upstreamDescription describes a call by its method and host, the path could hold identifiers
+func upstreamDescription(method string, rawURL string) string {
+	if parsed, err := url.Parse(rawURL); err == nil && parsed.Host != "" {
+		return method + " " + parsed.Host
+	}
+	return method
+}
+
 func GetResourceNotFoundError(resourceName string) error {
 	return ngciErrors.NewErrorStr(resourceName+" not found", ErrorCodeResourceNotFound)
 }
@@ -0,0 +1,96 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// timingsKey is the context key of the request timings
+type timingsKey struct{}
+
+// TimingPhase is a timed phase of a request, Duration is zero while the phase runs
+type TimingPhase struct {
+	Name        string
+	Description string
+	Start       time.Time
+	Duration    time.Duration
+	running     bool
+}
+
+// Timings collects the phases of a request, it is safe for concurrent use. A nil Timings ignores the phases so
+// the code timing its phases does not depend on the middleware being registered.
+type Timings struct {
+	mu     sync.Mutex
+	phases []TimingPhase
+}
+
+// ContextWithTimings stores new timings in the context, the timings already stored are kept
+func ContextWithTimings(ctx context.Context) context.Context {
+	if GetTimings(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, timingsKey{}, &Timings{})
+}
+
+// GetTimings returns the timings stored in the context, or nil when there are none
+func GetTimings(ctx context.Context) *Timings {
+	if ctx == nil {
+		return nil
+	}
+	timings, _ := ctx.Value(timingsKey{}).(*Timings)
+	return timings
+}
+
+// StartPhase starts a phase of the request timings stored in the context and returns the function stopping it
+//
+//	defer trace.StartPhase(ctx, "db", "load assets")()
+func StartPhase(ctx context.Context, name string, description string) func() {
+	return GetTimings(ctx).Start(name, description)
+}
+
+// Start starts a phase and returns the function stopping it, stopping a phase again has no effect
+func (t *Timings) Start(name string, description string) func() {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	index := len(t.phases)
+	t.phases = append(t.phases, TimingPhase{Name: name, Description: description, Start: time.Now(), running: true})
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if phase := &t.phases[index]; phase.running {
+			phase.running = false
+			phase.Duration = time.Since(phase.Start)
+		}
+	}
+}
+
+// Add records a phase measured by the caller
+func (t *Timings) Add(name string, description string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, TimingPhase{Name: name, Description: description, Start: time.Now().Add(-duration), Duration: duration})
+}
+
+// Phases returns the stopped phases in the order they were started
+func (t *Timings) Phases() []TimingPhase {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phases := make([]TimingPhase, 0, len(t.phases))
+	for _, phase := range t.phases {
+		if !phase.running {
+			phases = append(phases, phase)
+		}
+	}
+	return phases
+}
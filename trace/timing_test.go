@@ -0,0 +1,41 @@
+package trace
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimingsRecordStoppedPhases(t *testing.T) {
+	ctx := ContextWithTimings(context.TODO())
+	if ContextWithTimings(ctx) != ctx {
+		t.Errorf("Expecting the timings already stored to be kept")
+	}
+
+	stopDB := StartPhase(ctx, "db", "load assets")
+	stopEncode := StartPhase(ctx, "encode", "")
+	time.Sleep(2 * time.Millisecond)
+	stopDB()
+	stopDB()
+	GetTimings(ctx).Add("cache", "", 3*time.Millisecond)
+
+	phases := GetTimings(ctx).Phases()
+	if len(phases) != 2 || phases[0].Name != "db" || phases[1].Name != "cache" {
+		t.Fatalf("Expecting the stopped phases in start order, got %v", phases)
+	}
+	if phases[0].Duration < 2*time.Millisecond || phases[0].Description != "load assets" {
+		t.Errorf("Unexpected db phase %v", phases[0])
+	}
+	stopEncode()
+	if phases := GetTimings(ctx).Phases(); len(phases) != 3 {
+		t.Errorf("Expecting the encode phase once stopped, got %v", phases)
+	}
+}
+
+func TestTimingsWithoutContextAreIgnored(t *testing.T) {
+	StartPhase(context.TODO(), "db", "")()
+	StartPhase(nil, "db", "")()
+	if phases := GetTimings(context.TODO()).Phases(); phases != nil {
+		t.Errorf("Expecting no phases, got %v", phases)
+	}
+}
@@ -4,11 +4,23 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const TracingContextHeaders = "TRACE_HEADERS"
 
+// RequestIDHeader is the header carrying the request id between services.
+// The id is stored in the context under the same key used for propagated trace headers.
+const RequestIDHeader = "x-request-id"
+
+// RequestTimeoutHeader carries the remaining time budget of the request in milliseconds
+const RequestTimeoutHeader = "x-request-timeout-ms"
+
+// AcceptLanguageHeader carries the locale selected for the request to the called services
+const AcceptLanguageHeader = "accept-language"
+
 var TraceHeadersToPropagate []string
 
 func init() {
@@ -30,11 +42,17 @@ func ContextWithTraceHeaders(ctx context.Context, r *http.Request) context.Conte
 }
 
 func RequestWithTraceHeaders(ctx context.Context, r *http.Request) *http.Request {
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
 	for _, header := range TraceHeadersToPropagate {
 		if value, ok := ctx.Value(header).(string); ok {
 			r.Header.Add(header, value)
 		}
 	}
+	for header, value := range contextHeaders(ctx) {
+		r.Header.Set(header, value)
+	}
 	return r
 }
 
@@ -45,6 +63,9 @@ func GetHeaders(ctx context.Context) map[string]string {
 			headers[header] = value
 		}
 	}
+	for header, value := range contextHeaders(ctx) {
+		headers[header] = value
+	}
 	return headers
 }
 
@@ -57,5 +78,72 @@ func SetTraceHeaders(ctx context.Context, h http.Header) http.Header {
 			h.Add(header, value)
 		}
 	}
+	for header, value := range contextHeaders(ctx) {
+		h.Set(header, value)
+	}
 	return h
 }
+
+// ContextWithRequestID stores the request id in the context so it is forwarded on outbound calls
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, RequestIDHeader, requestID)
+}
+
+// GetRequestID returns the request id stored in the context, or an empty string when there is none
+func GetRequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(RequestIDHeader).(string)
+	return requestID
+}
+
+// ContextWithLocale stores the locale selected for the request so it is forwarded on outbound calls
+func ContextWithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, AcceptLanguageHeader, locale)
+}
+
+// GetLocale returns the locale stored in the context, or an empty string when there is none
+func GetLocale(ctx context.Context) string {
+	locale, _ := ctx.Value(AcceptLanguageHeader).(string)
+	return locale
+}
+
+// RemainingTimeout returns the time left before the context deadline, false when the context has no deadline
+func RemainingTimeout(ctx context.Context) (time.Duration, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// ParseTimeoutHeader returns the time budget sent in the RequestTimeoutHeader of an inbound request, zero when the
+// budget is spent
+func ParseTimeoutHeader(h http.Header) (time.Duration, bool) {
+	milliseconds, err := strconv.ParseInt(h.Get(RequestTimeoutHeader), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if milliseconds < 0 {
+		milliseconds = 0
+	}
+	return time.Duration(milliseconds) * time.Millisecond, true
+}
+
+// contextHeaders returns the headers derived from the context rather than copied from the inbound request:
+// the request id, the selected locale and the remaining time budget
+func contextHeaders(ctx context.Context) map[string]string {
+	headers := map[string]string{}
+	if requestID := GetRequestID(ctx); requestID != "" {
+		headers[RequestIDHeader] = requestID
+	}
+	if locale := GetLocale(ctx); locale != "" {
+		headers[AcceptLanguageHeader] = locale
+	}
+	if remaining, ok := RemainingTimeout(ctx); ok {
+		headers[RequestTimeoutHeader] = strconv.FormatInt(remaining.Milliseconds(), 10)
+	}
+	return headers
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestJSONMarshallSuccess(t *testing.T) {
@@ -13,3 +14,66 @@ func TestJSONMarshallSuccess(t *testing.T) {
 		t.Errorf("Headers not initialised")
 	}
 }
+
+func TestRequestIDIsForwardedOnce(t *testing.T) {
+	ctx := ContextWithRequestID(context.TODO(), "abc-123")
+
+	h := SetTraceHeaders(ctx, nil)
+	if values := h.Values(RequestIDHeader); len(values) != 1 || values[0] != "abc-123" {
+		t.Errorf("Expecting a single request id header, got %v", values)
+	}
+
+	if GetHeaders(ctx)[RequestIDHeader] != "abc-123" {
+		t.Errorf("Expecting request id in propagated headers")
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header = nil
+	r = RequestWithTraceHeaders(ctx, r)
+	if r.Header.Get(RequestIDHeader) != "abc-123" {
+		t.Errorf("Expecting request id on outbound request")
+	}
+}
+
+func TestGetRequestIDMissing(t *testing.T) {
+	if GetRequestID(context.TODO()) != "" {
+		t.Errorf("Expecting empty request id")
+	}
+}
+
+func TestLocaleIsForwarded(t *testing.T) {
+	ctx := ContextWithLocale(context.TODO(), "de")
+
+	if GetLocale(ctx) != "de" {
+		t.Errorf("Expecting locale to be stored in the context")
+	}
+	if GetHeaders(ctx)[AcceptLanguageHeader] != "de" {
+		t.Errorf("Expecting locale in propagated headers")
+	}
+	if h := SetTraceHeaders(ctx, nil); h.Get(AcceptLanguageHeader) != "de" {
+		t.Errorf("Expecting locale on outbound headers")
+	}
+}
+
+func TestRemainingTimeoutIsForwarded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Minute)
+	defer cancel()
+
+	remaining, ok := RemainingTimeout(ctx)
+	if !ok || remaining <= 0 || remaining > time.Minute {
+		t.Errorf("Expecting remaining timeout within a minute, got %v", remaining)
+	}
+
+	h := SetTraceHeaders(ctx, nil)
+	forwarded, ok := ParseTimeoutHeader(h)
+	if !ok || forwarded <= 0 || forwarded > time.Minute {
+		t.Errorf("Expecting forwarded timeout header, got %v", h)
+	}
+
+	if _, ok := RemainingTimeout(context.TODO()); ok {
+		t.Errorf("Expecting no timeout without deadline")
+	}
+	if _, ok := ParseTimeoutHeader(http.Header{}); ok {
+		t.Errorf("Expecting no timeout without header")
+	}
+}
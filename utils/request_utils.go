@@ -3,11 +3,17 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	"io"
 	"io/ioutil"
 	"net/http"
 )
 
+// MaxPayloadSize is the size limit of the payloads read by RetrievePayload, they are not limited when zero. The
+// body limit middleware applies the per-route limits before the handler is called.
+var MaxPayloadSize int64
+
 // Gets the valid path parameter for a request from the given http request
 func GetPathParam(r *http.Request, paramName string) (paramValue string, err error) {
 	paramVals := []string{paramName}
@@ -66,10 +72,17 @@ func retrieveJSONPayload(r *http.Request) (interface{}, error) {
 	var payload interface{}
 
 	if r.ContentLength > 0 {
-		body, readError := ioutil.ReadAll(r.Body)
+		var reader io.Reader = r.Body
+		if MaxPayloadSize > 0 {
+			reader = io.LimitReader(r.Body, MaxPayloadSize+1)
+		}
+		body, readError := ioutil.ReadAll(reader)
 		if readError != nil {
 			return nil, readError
 		}
+		if MaxPayloadSize > 0 && int64(len(body)) > MaxPayloadSize {
+			return nil, fmt.Errorf("payload exceeds the maximum size of %d bytes", MaxPayloadSize)
+		}
 
 		jsonError := json.Unmarshal(body, &payload)
 		if jsonError != nil {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -77,3 +78,38 @@ func TestRetrievePayloadXmlPayloadThrowsError(t *testing.T) {
 		t.Errorf(responseMismatchPrintFormat)
 	}
 }
+
+func TestRetrievePayloadOversizePayloadThrowsError(t *testing.T) {
+
+	defaultSize := MaxPayloadSize
+	MaxPayloadSize = 16
+	defer func() { MaxPayloadSize = defaultSize }()
+
+	payloadData := `{"Feb":{"Fullform":"February"}}`
+	payload := []byte(payloadData)
+	request, _ := http.NewRequest("POST", "/sample/request", bytes.NewBuffer(payload))
+	request.Header.Set(ContentType, JSONContentType)
+
+	actual, err := RetrievePayload(request)
+
+	// check if data is same as expected
+	if err == nil {
+		t.Errorf("Expecting an exception for a payload over the maximum size")
+	}
+	if actual != nil {
+		t.Errorf(responseMismatchPrintFormat)
+	}
+}
+
+func TestRetrievePayloadLargePayloadIsNotLimitedByDefault(t *testing.T) {
+
+	payloadData := `{"data":"` + strings.Repeat("a", 2*1024*1024) + `"}`
+	request, _ := http.NewRequest("POST", "/sample/request", bytes.NewBufferString(payloadData))
+	request.Header.Set(ContentType, JSONContentType)
+
+	actual, err := RetrievePayload(request)
+
+	if err != nil || actual == nil {
+		t.Errorf("Expecting payloads over 1 MiB to be read without limit, got %v", err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/rrd1986/common-go-modules/log"
 	"github.com/rrd1986/common-go-modules/middleware"
@@ -84,12 +83,7 @@ func updateResponseWriter(w http.ResponseWriter, data []byte) {
 	w.Header().Set("Content-Length", strconv.Itoa(contentLength))
 }
 
+// SetSecurityHeaders sets the HSTS and CSP headers for the swagger path and html files, see middleware.HTMLSecurityPolicy
 func SetSecurityHeaders(h http.Handler, swaggerPath string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if (r.RequestURI == swaggerPath) || (strings.HasSuffix(r.RequestURI, ".html")) || (strings.HasSuffix(r.RequestURI, ".htm")) {
-			w.Header().Set(HSTSHeader, "max-age=31536000")
-			w.Header().Set(middleware.CSPHeader, "frame-ancestors 'self'")
-		}
-		h.ServeHTTP(w, r)
-	})
+	return middleware.SecurityPolicyWrapper(h, middleware.HTMLSecurityPolicy(swaggerPath))
 }